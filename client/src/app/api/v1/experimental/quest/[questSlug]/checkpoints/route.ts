@@ -9,7 +9,8 @@ export async function GET(
   const backendUrl = process.env.BACKEND_API_URL ?? 'http://localhost:8080';
 	
   const response = await fetch(
-    `${backendUrl}/v0/quest/${questSlug}/checkpoints`,
+    // ?labId= gives each checkpoint the lab's status
+    `${backendUrl}/v0/quest/${questSlug}/checkpoints${request.nextUrl.search}`,
       {
         method: 'GET',
         headers: { 'Content-Type': 'application/json' },
@@ -186,7 +186,7 @@ export default function ExperimentalProjectPage() {
       try {
         const [metadataResponse, checkpointsResponse] = await Promise.all([
           fetch(`/api/v1/experimental/quest/${projectSlug}`),
-          fetch(`/api/v1/experimental/quest/${projectSlug}/checkpoints`),
+          fetch(`/api/v1/experimental/quest/${projectSlug}/checkpoints?labId=${encodeURIComponent(labId)}`),
         ]);
 
         if (metadataResponse.ok) {
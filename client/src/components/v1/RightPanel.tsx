@@ -140,7 +140,8 @@ const CheckpointComponent: React.FC<CheckpointComponentProps> = ({
 
   // Expansion logic
   const shouldExpandByDefault = hideTestDetails
-    ? (checkpoint.status === 'in-progress') || (isFirstIncomplete && checkpoint.status !== 'completed')
+    ? (checkpoint.status === 'in-progress' || checkpoint.status === 'active' || checkpoint.status === 'failed') ||
+      (isFirstIncomplete && checkpoint.status !== 'completed' && checkpoint.status !== 'passed')
     : (isCurrentlyTesting || status === 'failed' || (status === 'pending' && index === 0));
 
   const [isExpanded, setIsExpanded] = React.useState(shouldExpandByDefault);
@@ -1,8 +1,9 @@
 // hooks/usePty.tsx
 
 import { useState, useRef, useCallback, useEffect } from 'react';
-import { buildPtyUrl } from '@/lib/pty';
+import { buildPtyUrl, getPtySessionToken, setPtySessionToken } from '@/lib/pty';
 import { dlog } from '@/utils/debug';
+import { PtyFinalTestReport, PtyJudgeReport, PtyOpenPort, PtyResourceUsage, PtyRunStatus, PtyTestProgress } from '@/types/pty';
 
 // --- Types ---
 
@@ -32,7 +33,15 @@ export interface TestResult {
 export interface TestState {
   isRunning: boolean;
   currentCheckpoint: string | null;
+  // Position in the lab's test queue while waiting, 0 once started
+  queuePosition: number | null;
+  // Events of the current run, suites and individual tests
+  progress: PtyTestProgress[];
   results: TestResult[];
+  // Latest final submission
+  finalReport: PtyFinalTestReport | null;
+  // Latest judge run, with a verdict per testcase
+  judgeReport: PtyJudgeReport | null;
   error: string | null;
 }
 
@@ -70,11 +79,22 @@ export function usePty({
     error: null
   });
 
+  // Ports the learner's app listens on
+  const [openPorts, setOpenPorts] = useState<PtyOpenPort[]>([]);
+
+  // Memory and CPU of the app container, and the last warning about them
+  const [resourceUsage, setResourceUsage] = useState<PtyResourceUsage | null>(null);
+  const [resourceWarning, setResourceWarning] = useState<string | null>(null);
+
   // Test State
   const [testState, setTestState] = useState<TestState>({
     isRunning: false,
     currentCheckpoint: null,
+    queuePosition: null,
+    progress: [],
     results: [],
+    finalReport: null,
+    judgeReport: null,
     error: null
   });
 
@@ -97,7 +117,7 @@ export function usePty({
     const url = buildPtyUrl(labId);
     dlog('usePty: Connecting to', url);
 
-    const ws = new WebSocket(url);
+    const ws = new WebSocket(buildPtyUrl(labId, getPtySessionToken(labId)));
     socketRef.current = ws;
 
     ws.onopen = () => {
@@ -105,6 +125,9 @@ export function usePty({
       setConnectionState('connected');
       // Send initial heartbeat to establish session liveness
       ws.send(JSON.stringify({ type: 'heartbeat' }));
+      // Follow the supervised run command, starting with its recent output
+      ws.send(JSON.stringify({ type: 'run_subscribe' }));
+      ws.send(JSON.stringify({ type: 'run_status' }));
     };
 
     ws.onclose = (event) => {
@@ -160,6 +183,25 @@ export function usePty({
   const handleProtocolMessage = (msg: any, ws: WebSocket) => {
     switch (msg.type) {
       // --- Run Cycle Events ---
+      case 'run_status':
+        const supervised = msg.data as PtyRunStatus;
+        dlog('usePty: Run status', supervised);
+        setRunStatus(prev => ({
+          ...prev,
+          isInstalling: supervised.state === 'installing',
+          isRunning: ['installing', 'running', 'restarting', 'stopping'].includes(supervised.state),
+          step: supervised.step || null,
+          error: ['crashed', 'failed'].includes(supervised.state)
+            ? `Command failed with code ${supervised.exitCode ?? -1}`
+            : null
+        }));
+        break;
+
+      case 'run_log':
+        // The terminal expects CRLF line endings
+        onDataRef.current?.((msg.data?.data || '').replace(/\r?\n/g, '\r\n'));
+        break;
+
       case 'run_executing':
         const step = msg.data?.step || 'unknown';
         dlog('usePty: Run executing step:', step);
@@ -193,24 +235,89 @@ export function usePty({
         onReadyRef.current?.(url);
         break;
 
+      case 'port_opened':
+        dlog('usePty: Port opened', msg.data);
+        setOpenPorts(prev => [
+          ...prev.filter(p => p.port !== msg.data?.port),
+          msg.data as PtyOpenPort
+        ].sort((a, b) => a.port - b.port));
+        break;
+
+      case 'port_closed':
+        dlog('usePty: Port closed', msg.data);
+        setOpenPorts(prev => prev.filter(p => p.port !== msg.data?.port));
+        break;
+
+      case 'resource_usage':
+        setResourceUsage(msg.data as PtyResourceUsage);
+        break;
+
+      case 'resource_warning':
+        dlog('usePty: Resource warning', msg.data);
+        setResourceWarning(msg.data?.message || null);
+        break;
+
+      case 'oom_killed':
+        console.warn('usePty: OOM kill', msg.data);
+        setResourceWarning(msg.data?.message || null);
+        // Otherwise the dev server just disappears from the terminal
+        onDataRef.current?.(`\r\n\x1b[31m${msg.data?.message}\x1b[0m\r\n`);
+        break;
+
       case 'run_error':
         setRunStatus(prev => ({ ...prev, isRunning: false, error: msg.data?.message }));
         break;
 
       // --- Test Cycle Events ---
+      case 'test_queued':
+        setTestState(prev => ({
+          ...prev,
+          isRunning: true,
+          currentCheckpoint: prev.currentCheckpoint ?? msg.data?.checkpointId,
+          queuePosition: msg.data?.position ?? null,
+          error: null
+        }));
+        break;
+
       case 'test_started':
         setTestState(prev => ({
           ...prev,
           isRunning: true,
           currentCheckpoint: msg.data?.checkpointId,
+          queuePosition: 0,
+          progress: [],
           error: null
         }));
         break;
 
+      case 'test_progress':
+        setTestState(prev => ({ ...prev, progress: [...prev.progress, msg.data as PtyTestProgress] }));
+        break;
+
+      case 'test_cancelled':
+        setTestState(prev => ({
+          ...prev,
+          isRunning: false,
+          currentCheckpoint: null,
+          queuePosition: null
+        }));
+        break;
+
       case 'test_completed':
         // The backend returns a full result object. 
         // We assume msg.data matches the structure we need or contains a 'results' array.
         const resultData = msg.data;
+
+        if (resultData?.mode === 'final') {
+          setTestState(prev => ({
+            ...prev,
+            isRunning: false,
+            currentCheckpoint: null,
+            queuePosition: null,
+            finalReport: resultData.report as PtyFinalTestReport
+          }));
+          break;
+        }
         
         // Normalize the result to append to our history
         let newResults: TestResult[] = [];
@@ -227,7 +334,9 @@ export function usePty({
           ...prev,
           isRunning: false,
           currentCheckpoint: null,
-          results: [...prev.results, ...newResults]
+          queuePosition: null,
+          results: [...prev.results, ...newResults],
+          judgeReport: resultData?.mode === 'judge' ? resultData.report as PtyJudgeReport : prev.judgeReport
         }));
         break;
         
@@ -235,10 +344,26 @@ export function usePty({
         setTestState(prev => ({
           ...prev,
           isRunning: false,
+          queuePosition: null,
           error: msg.data?.message || 'Unknown test error'
         }));
         break;
         
+      // --- Terminal Sessions ---
+      case 'session_opened':
+      case 'session_attached':
+        // Keep the shell's token to re-attach it after a reload or a dropped connection
+        if (!msg.session || msg.session === 'default') {
+          setPtySessionToken(labId, msg.data?.token ?? null);
+        }
+        break;
+
+      case 'session_closed':
+        if (!msg.session || msg.session === 'default') {
+          setPtySessionToken(labId, null);
+        }
+        break;
+
       // --- System Events ---
       case 'heartbeat':
         if (ws.readyState === WebSocket.OPEN) {
@@ -290,7 +415,7 @@ export function usePty({
   /** Resizes the PTY dimensions */
   const resize = useCallback((cols: number, rows: number) => {
     if (socketRef.current?.readyState === WebSocket.OPEN) {
-      socketRef.current.send(JSON.stringify({ type: 'resize', cols, rows }));
+      socketRef.current.send(JSON.stringify({ type: 'resize', data: { cols, rows } }));
     }
   }, []);
 
@@ -320,6 +445,20 @@ export function usePty({
     }
   }, []);
 
+  /** Stops the run command, SIGKILL after a grace period */
+  const stopProject = useCallback(() => {
+    if (socketRef.current?.readyState === WebSocket.OPEN) {
+      socketRef.current.send(JSON.stringify({ type: 'run_stop' }));
+    }
+  }, []);
+
+  /** Restarts the run command with the last init and run commands */
+  const restartProject = useCallback(() => {
+    if (socketRef.current?.readyState === WebSocket.OPEN) {
+      socketRef.current.send(JSON.stringify({ type: 'run_restart' }));
+    }
+  }, []);
+
   /** Runs tests for a specific checkpoint */
   const runTests = useCallback((checkpointId: string) => {
     if (socketRef.current?.readyState === WebSocket.OPEN) {
@@ -336,6 +475,42 @@ export function usePty({
     }
   }, [language]);
 
+  /** Submits the quest: runs every checkpoint suite and the final suite */
+  const submitFinal = useCallback(() => {
+    if (socketRef.current?.readyState === WebSocket.OPEN) {
+      setTestState(prev => ({ ...prev, isRunning: true, error: null }));
+      socketRef.current.send(JSON.stringify({
+        type: 'test',
+        data: JSON.stringify({ type: 'final', language })
+      }));
+    } else {
+        console.warn('usePty: Cannot submit, socket not open');
+    }
+  }, [language]);
+
+  /** Judges a checkpoint: runs the program once per testcase, input on stdin */
+  const runJudge = useCallback((checkpointId: string) => {
+    if (socketRef.current?.readyState === WebSocket.OPEN) {
+      setTestState(prev => ({ ...prev, isRunning: true, error: null }));
+      socketRef.current.send(JSON.stringify({
+        type: 'test',
+        data: JSON.stringify({ type: 'judge', checkpointId, language })
+      }));
+    } else {
+        console.warn('usePty: Cannot judge, socket not open');
+    }
+  }, [language]);
+
+  /** Cancels a queued or running test run, or all of them */
+  const cancelTests = useCallback((checkpointId?: string) => {
+    if (socketRef.current?.readyState === WebSocket.OPEN) {
+      socketRef.current.send(JSON.stringify({
+        type: 'test_cancel',
+        data: checkpointId ? { checkpointId } : undefined
+      }));
+    }
+  }, []);
+
   return {
     // Lifecycle
     connect,
@@ -347,10 +522,18 @@ export function usePty({
     resize,
     killProcesses,
     runProject,
+    stopProject,
+    restartProject,
     runTests,
+    submitFinal,
+    runJudge,
+    cancelTests,
     
     // State
     runStatus,
+    openPorts,
+    resourceUsage,
+    resourceWarning,
     testState
   };
 }
\ No newline at end of file
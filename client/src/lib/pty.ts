@@ -1,7 +1,32 @@
-export function buildPtyUrl(labId?: string) {
+export function buildPtyUrl(labId?: string, sessionToken?: string | null) {
   if (typeof window === 'undefined' || !labId) return '';
   const wsProtocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-  return `${wsProtocol}://${labId}.devsarena.in/pty`;
+  const url = `${wsProtocol}://${labId}.devsarena.in/pty`;
+  // Re-attach the shell of a previous connection instead of starting a new one
+  return sessionToken ? `${url}?token=${encodeURIComponent(sessionToken)}` : url;
+}
+
+const ptySessionTokenKey = (labId: string) => `ptySessionToken:${labId}`;
+
+/** Token of the lab's default terminal session, kept across reloads of the tab */
+export function getPtySessionToken(labId: string): string | null {
+  try {
+    return sessionStorage.getItem(ptySessionTokenKey(labId));
+  } catch {
+    return null;
+  }
+}
+
+export function setPtySessionToken(labId: string, token: string | null) {
+  try {
+    if (token) {
+      sessionStorage.setItem(ptySessionTokenKey(labId), token);
+    } else {
+      sessionStorage.removeItem(ptySessionTokenKey(labId));
+    }
+  } catch {
+    // best-effort
+  }
 }
 
 export function sendPtyKillUserProcesses(ws: WebSocket | null | undefined) {
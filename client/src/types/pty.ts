@@ -10,15 +10,104 @@ export type PtyMessageCategory =
 export interface PtyInputMessage {
   type: 'input';
   category: 'user_command';
+  session?: string; // Defaults to the "default" session
   data: string; // Raw terminal input (keystrokes)
 }
 
+// Named terminal sessions multiplexed over the same connection
+export interface PtyTerminalSize {
+  rows: number;
+  cols: number;
+}
+
+export interface PtySessionOpenMessage {
+  type: 'session_open';
+  category: 'control';
+  session: string;
+  data?: PtyTerminalSize; // Initial window size
+}
+
+export interface PtyResizeMessage {
+  type: 'resize';
+  category: 'control';
+  session?: string;
+  data: PtyTerminalSize;
+}
+
+// Re-attach a session that survived a dropped connection
+export interface PtySessionAttachMessage {
+  type: 'session_attach';
+  category: 'control';
+  data: {
+    token: string;
+  };
+}
+
+export interface PtySessionCloseMessage {
+  type: 'session_close';
+  category: 'control';
+  session: string;
+}
+
+// The run command is supervised in the app container; `run` is an alias of `run_start`
+export interface PtyRunSpec {
+  initCommands?: string[];
+  runCommand: string;
+  cwd?: string;
+  env?: Record<string, string>;
+  autoRestart?: boolean; // Restart after a crash, with backoff
+}
+
 export interface PtyRunMessage {
-  type: 'run';
+  type: 'run' | 'run_start';
+  category: 'system_command';
+  data: PtyRunSpec;
+}
+
+export interface PtyRunRestartMessage {
+  type: 'run_restart';
+  category: 'system_command';
+  data?: PtyRunSpec; // Defaults to the previous spec
+}
+
+// run_stop sends SIGTERM, then SIGKILL after a grace period
+export interface PtyRunControlMessage {
+  type: 'run_stop' | 'run_status' | 'run_subscribe' | 'run_unsubscribe';
+  category: 'system_command';
+}
+
+// Structured command execution, independent of the learner's shell
+export interface PtyExecMessage {
+  type: 'exec';
+  category: 'system_command';
+  data: {
+    id: string; // Correlates the exec_* replies
+    argv?: string[];
+    command?: string; // Run with `sh -c` when argv is not given
+    cwd?: string;
+    env?: Record<string, string>;
+    timeout?: number; // Seconds, defaults to 10 minutes
+    stdin?: string;
+    openStdin?: boolean; // Keep stdin open for exec_input
+  };
+}
+
+export interface PtyExecInputMessage {
+  type: 'exec_input';
   category: 'system_command';
   data: {
-    initCommands?: string[];
-    runCommand: string;
+    id: string;
+    data?: string;
+    eof?: boolean;
+  };
+}
+
+export interface PtyExecKillMessage {
+  type: 'exec_kill';
+  category: 'system_command';
+  data: {
+    id: string;
+    signal?: 'SIGTERM' | 'SIGKILL' | 'SIGINT' | 'SIGHUP' | 'SIGQUIT' | 'SIGUSR1' | 'SIGUSR2';
   };
 }
 
@@ -34,6 +123,25 @@ export interface PtyTestMessage {
     type: 'checkpoint';
     checkpointId: string;
     language: string;
+  } | {
+    // Final submission: every checkpoint suite plus the quest's final suite
+    type: 'final';
+    language: string;
+  } | {
+    // Runs the program against the checkpoint's testcases, stdin to stdout
+    type: 'judge';
+    checkpointId: string;
+    language: string;
+  };
+}
+
+// Cancels the given run, or every queued and running one without data
+export interface PtyTestCancelMessage {
+  type: 'test_cancel';
+  category: 'test_runner';
+  data?: {
+    jobId?: string;
+    checkpointId?: string;
   };
 }
 
@@ -44,18 +152,77 @@ export interface PtyHeartbeatMessage {
 
 export type PtyInboundMessage =
   | PtyInputMessage
+  | PtySessionOpenMessage
+  | PtySessionAttachMessage
+  | PtySessionCloseMessage
+  | PtyResizeMessage
   | PtyRunMessage
+  | PtyRunRestartMessage
+  | PtyRunControlMessage
+  | PtyExecMessage
+  | PtyExecInputMessage
+  | PtyExecKillMessage
   | PtyKillMessage
   | PtyTestMessage
+  | PtyTestCancelMessage
   | PtyHeartbeatMessage;
 
 
+// Output of named sessions; the default session sends raw text frames
 export interface PtyOutputMessage {
   type: 'output';
   category: 'terminal_output';
+  session?: string;
   data: string;
 }
 
+export interface PtySessionOpenedMessage {
+  type: 'session_opened';
+  category: 'control';
+  session: string;
+  data: {
+    token: string; // Reconnect with ?token=<token> or session_attach
+  };
+}
+
+// Sent on re-attach, followed by the session's scrollback as output
+export interface PtySessionAttachedMessage {
+  type: 'session_attached';
+  category: 'control';
+  session: string;
+  data: {
+    token: string;
+    replayed: number; // Bytes of scrollback that follow
+  };
+}
+
+export interface PtySessionDetachedMessage {
+  type: 'session_detached';
+  category: 'control';
+  session: string;
+  data: {
+    reason: 'attached_elsewhere';
+  };
+}
+
+export interface PtySessionClosedMessage {
+  type: 'session_closed';
+  category: 'control';
+  session: string;
+  data: {
+    reason: 'closed' | 'exited' | 'expired';
+  };
+}
+
+export interface PtySessionErrorMessage {
+  type: 'session_error';
+  category: 'control';
+  session?: string;
+  data: {
+    message: string;
+  };
+}
+
 // Progress Updates
 export type ProgressStage =
   | 'installing_dependencies'
@@ -82,32 +249,170 @@ export interface PtyTestStartedMessage {
   type: 'test_started';
   category: 'test_runner';
   data: {
+    jobId: string;
+    checkpointId: string;
+  };
+}
+
+// Test runs of the lab run one at a time; a request for a queued checkpoint joins its job
+export interface PtyTestQueuedMessage {
+  type: 'test_queued';
+  category: 'test_runner';
+  data: {
+    jobId: string;
     checkpointId: string;
+    position: number; // 0 when running or about to run
+  };
+}
+
+export interface PtyTestProgress {
+  event: 'run_started' | 'suite_started' | 'test_passed' | 'test_failed' | 'test_skipped' | 'suite_finished';
+  suites?: number; // run_started
+  file?: string;
+  name?: string; // Full test name, left out for hidden tests
+  durationMs?: number;
+  passed?: number; // suite_finished
+  failed?: number;
+  suite?: string; // Final submissions: checkpoint-<n> or final
+  verdict?: PtyJudgeVerdict; // Judge runs
+}
+
+export interface PtyTestProgressMessage {
+  type: 'test_progress';
+  category: 'test_runner';
+  data: PtyTestProgress & {
+    jobId: string;
+    checkpointId: string;
+  };
+}
+
+export interface PtyTestCancelledMessage {
+  type: 'test_cancelled';
+  category: 'test_runner';
+  data: {
+    jobId: string;
+    checkpointId: string;
+  };
+}
+
+// Statuses of the Jest reporter, and of runs the test runner killed
+export type PtyTestStatus = 'PASSED' | 'FAILED_ASSERTION' | 'FAILED_RUNTIME'
+  // The run was killed for going over a limit of its checkpoint
+  | 'TIME_LIMIT_EXCEEDED' | 'MEMORY_LIMIT_EXCEEDED';
+
+// A failed assertion as normalized by the relay: both values as text, with a line diff for
+// strings and objects and the learner's line the failure points at
+export interface PtyAssertionResult {
+  kind: 'string' | 'object' | 'value';
+  expected: string;
+  actual: string;
+  // delete: only in expected, insert: only in actual
+  diff?: { op: 'equal' | 'delete' | 'insert'; text: string }[];
+  location?: { file: string; line?: number; column?: number }; // Relative to the workspace
+  hint?: string;
+}
+
+export interface PtyTestResult {
+  checkpoint: number;
+  status: PtyTestStatus;
+  durationMs: number;
+  // Hidden tests only report counts, error then has a generic message and hint
+  hidden?: boolean;
+  tests?: { passed: number; total: number };
+  error?: {
+    scenario?: string;
+    expected?: string;
+    received?: string;
+    hint?: string;
+    message?: string;
+    assertion?: PtyAssertionResult;
   };
 }
 
+export interface PtyFinalSuiteResult extends PtyTestResult {
+  suite: string; // checkpoint-<n> or final
+  testsPassed: number;
+  testsFailed: number;
+}
+
+// The scored result of a final submission, the quest is complete when passed
+export interface PtyFinalTestReport {
+  passed: boolean;
+  score: number; // Percent of tests passed
+  testsPassed: number;
+  testsTotal: number;
+  durationMs: number;
+  timestamp: number;
+  suites: PtyFinalSuiteResult[];
+}
+
+// Accepted, wrong answer, time limit exceeded, runtime error
+export type PtyJudgeVerdict = 'AC' | 'WA' | 'TLE' | 'RE';
+
+export interface PtyJudgeCaseResult {
+  case: number;
+  verdict: PtyJudgeVerdict;
+  durationMs: number;
+  exitCode: number;
+  message?: string;
+  // Cases that were not accepted
+  input?: string;
+  expected?: string;
+  received?: string;
+  stderr?: string;
+  error?: string;
+}
+
+export interface PtyJudgeReport {
+  checkpoint: number;
+  verdict: PtyJudgeVerdict; // AC, or the verdict of the first failed case
+  passed: number;
+  total: number;
+  hidden: { passed: number; total: number }; // Hidden cases, part of passed and total
+  compare: 'exact' | 'lines' | 'tokens';
+  timeLimitMs: number;
+  durationMs: number;
+  cases: PtyJudgeCaseResult[]; // Visible cases only
+}
+
 export interface PtyTestCompletedMessage {
   type: 'test_completed';
   category: 'test_runner';
   data: {
-    checkpoint: number;
-    status: 'pass' | 'fail';
-    durationMs?: number;
-    error?: {
-      scenario?: string;
-      expected?: string;
-      received?: string;
-      hint?: string;
-      message?: string;
-    };
+    jobId: string;
+    checkpointId: string;
+    runId: string; // Id of the stored submission
+    results: PtyTestResult[];
+  } | {
+    jobId: string;
+    checkpointId: string;
+    mode: 'judge';
+    runId: string;
+    results: PtyTestResult[];
+    report: PtyJudgeReport;
+  } | {
+    jobId: string;
+    checkpointId: 'final';
+    mode: 'final';
+    report: PtyFinalTestReport;
   };
 }
 
+// The tests could not be run, as opposed to failing
 export interface PtyTestErrorMessage {
   type: 'test_error';
   category: 'test_runner';
   data: {
+    jobId?: string;
     checkpointId?: string;
+    code:
+      | 'invalid_request'
+      | 'runner_unavailable'
+      | 'timeout'
+      | 'runner_failed'
+      | 'malformed_output'
+      | 'queue_full'
+      | 'bundle_invalid';
     message: string;
   };
 }
@@ -121,11 +426,61 @@ export interface PtyRunStartedMessage {
   };
 }
 
+export type PtyRunState =
+  | 'idle'
+  | 'installing'
+  | 'running'
+  | 'restarting'
+  | 'stopping'
+  | 'stopped'
+  | 'exited'
+  | 'crashed'
+  | 'failed'; // An init command failed
+
+export interface PtyRunStatus {
+  state: PtyRunState;
+  step?: string; // init_<n> or main_run
+  pid?: number;
+  runCommand?: string;
+  exitCode?: number;
+  restarts: number;
+  autoRestart: boolean;
+  startedAt?: number; // Unix seconds
+}
+
+// Sent to every connection on each change
+export interface PtyRunStatusMessage {
+  type: 'run_status';
+  category: 'system_command';
+  data: PtyRunStatus;
+}
+
 export interface PtyRunExecutingMessage {
   type: 'run_executing';
   category: 'system_command';
   data: {
-    command: string;
+    step: string;
+  };
+}
+
+export interface PtyRunCompletedMessage {
+  type: 'run_completed';
+  category: 'system_command';
+  data: {
+    step: string;
+    status: 'success' | 'error';
+    code: string;
+  };
+}
+
+// Output of the supervised processes, after run_subscribe
+export interface PtyRunLogMessage {
+  type: 'run_log';
+  category: 'system_command';
+  data: {
+    stream: 'stdout' | 'stderr';
+    data: string;
+    replay?: boolean; // Recent output sent on subscribe
   };
 }
 
@@ -137,6 +492,135 @@ export interface PtyRunErrorMessage {
   };
 }
 
+export interface PtyExecStartedMessage {
+  type: 'exec_started';
+  category: 'system_command';
+  data: {
+    id: string;
+    pid: number;
+  };
+}
+
+export interface PtyExecOutputMessage {
+  type: 'exec_output';
+  category: 'system_command';
+  data: {
+    id: string;
+    stream: 'stdout' | 'stderr';
+    data: string;
+  };
+}
+
+export interface PtyExecExitedMessage {
+  type: 'exec_exited';
+  category: 'system_command';
+  data: {
+    id: string;
+    code: number; // -1 when killed by a signal or not started
+    signal?: string;
+    timedOut?: boolean;
+    error?: string;
+    durationMs: number;
+  };
+}
+
+export interface PtyExecErrorMessage {
+  type: 'exec_error';
+  category: 'system_command';
+  data: {
+    id: string;
+    message: string;
+  };
+}
+
+// Listening ports of the lab, detected by the relay
+export interface PtyOpenPort {
+  port: number;
+  address: string; // Bound address, e.g. "0.0.0.0" or "127.0.0.1"
+  http: boolean;   // Answered an HTTP request when detected
+  url?: string;    // Set for HTTP ports
+}
+
+export interface PtyPortOpenedMessage {
+  type: 'port_opened';
+  category: 'progress';
+  data: PtyOpenPort;
+}
+
+export interface PtyPortClosedMessage {
+  type: 'port_closed';
+  category: 'progress';
+  data: {
+    port: number;
+  };
+}
+
+// Sent with port_opened for HTTP ports
+export interface PtyServerReadyMessage {
+  type: 'server_ready';
+  category: 'progress';
+  data: string; // URL
+}
+
+// Resource usage of the app container, sampled every couple of seconds
+export interface PtyProcessUsage {
+  pid: number;
+  command: string;
+  rssBytes: number;
+  cpuPercent: number;
+}
+
+export interface PtyResourceUsage {
+  timestamp: number; // Unix milliseconds
+  memory: {
+    usageBytes: number;
+    workingSetBytes: number; // Usage without reclaimable cache
+    limitBytes: number; // 0 when unlimited
+    percent: number; // Working set of the limit
+  };
+  cpu: {
+    percent: number; // 100 is one core
+    limitCores: number; // 0 when unlimited
+    throttledPeriods: number;
+    throttledPercent: number;
+    throttledMs: number;
+  };
+  oomKills: number; // Since the container started
+  processes: PtyProcessUsage[]; // Top memory consumers
+}
+
+export interface PtyResourceUsageMessage {
+  type: 'resource_usage';
+  category: 'progress';
+  data: PtyResourceUsage;
+}
+
+// Sent once each time memory crosses a threshold of the limit
+export interface PtyResourceWarningMessage {
+  type: 'resource_warning';
+  category: 'progress';
+  data: {
+    resource: 'memory';
+    level: 'warning' | 'critical';
+    percent: number;
+    usageBytes: number;
+    limitBytes: number;
+    message: string;
+  };
+}
+
+export interface PtyOomKilledMessage {
+  type: 'oom_killed';
+  category: 'progress';
+  data: {
+    count: number;
+    total: number;
+    limitBytes: number;
+    processes: PtyProcessUsage[]; // Likely victims
+    message: string;
+  };
+}
+
 // Control
 export interface PtyHeartbeatResponseMessage {
   type: 'heartbeat' | 'heartbeat_response';
@@ -151,13 +635,34 @@ export interface PtyErrorMessage {
 
 export type PtyOutboundMessage =
   | PtyOutputMessage
+  | PtySessionOpenedMessage
+  | PtySessionAttachedMessage
+  | PtySessionDetachedMessage
+  | PtySessionClosedMessage
+  | PtySessionErrorMessage
   | PtyProgressMessage
+  | PtyTestQueuedMessage
   | PtyTestStartedMessage
+  | PtyTestProgressMessage
+  | PtyTestCancelledMessage
   | PtyTestCompletedMessage
   | PtyTestErrorMessage
   | PtyRunStartedMessage
+  | PtyRunStatusMessage
   | PtyRunExecutingMessage
+  | PtyRunCompletedMessage
+  | PtyRunLogMessage
   | PtyRunErrorMessage
+  | PtyExecStartedMessage
+  | PtyExecOutputMessage
+  | PtyExecExitedMessage
+  | PtyExecErrorMessage
+  | PtyPortOpenedMessage
+  | PtyPortClosedMessage
+  | PtyServerReadyMessage
+  | PtyResourceUsageMessage
+  | PtyResourceWarningMessage
+  | PtyOomKilledMessage
   | PtyHeartbeatResponseMessage
   | PtyErrorMessage;
 
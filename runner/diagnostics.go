@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Diagnostic severities, mirroring the levels editors usually render.
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+	SEVERITY_INFO    = "info"
+)
+
+// Position is a 1-based line/column location inside a file.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+type Diagnostic struct {
+	File     string `json:"file"`
+	Range    Range  `json:"range"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Source   string `json:"source"`
+}
+
+type DiagnosticsResponse struct {
+	Path        string       `json:"path"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// DiagnosticsProvider inspects the saved content of a file and reports problems.
+// Providers must be cheap: they run inline after every save.
+type DiagnosticsProvider func(path string, content []byte) []Diagnostic
+
+var (
+	diagnosticsProviders   = make(map[string]DiagnosticsProvider)
+	diagnosticsProvidersMu sync.RWMutex
+
+	yamlLineErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+)
+
+func init() {
+	RegisterDiagnosticsProvider(".json", jsonDiagnostics)
+	RegisterDiagnosticsProvider(".yaml", yamlDiagnostics)
+	RegisterDiagnosticsProvider(".yml", yamlDiagnostics)
+	RegisterDiagnosticsProvider(".go", goDiagnostics)
+}
+
+// RegisterDiagnosticsProvider hooks a provider up to a file extension (including the dot).
+// Registering an extension twice replaces the previous provider.
+func RegisterDiagnosticsProvider(ext string, provider DiagnosticsProvider) {
+	diagnosticsProvidersMu.Lock()
+	defer diagnosticsProvidersMu.Unlock()
+	diagnosticsProviders[strings.ToLower(ext)] = provider
+}
+
+// Collect diagnostics for a file, reporting ok=false when no provider handles it
+func collectDiagnostics(path string, content []byte) ([]Diagnostic, bool) {
+	diagnosticsProvidersMu.RLock()
+	provider, exists := diagnosticsProviders[strings.ToLower(filepath.Ext(path))]
+	diagnosticsProvidersMu.RUnlock()
+
+	if !exists {
+		return nil, false
+	}
+
+	diagnostics := provider(path, content)
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	return diagnostics, true
+}
+
+// Push diagnostics for a saved file. An empty list is still sent so the IDE can clear old markers.
+func publishDiagnostics(client *Client, path string, content []byte) error {
+	diagnostics, ok := collectDiagnostics(path, content)
+	if !ok {
+		return nil
+	}
+
+	return client.SendBroadcast(RESPONSE_DIAGNOSTICS, "diagnostics:"+path, DiagnosticsResponse{
+		Path:        path,
+		Diagnostics: diagnostics,
+	})
+}
+
+func jsonDiagnostics(path string, content []byte) []Diagnostic {
+	var value interface{}
+	err := json.Unmarshal(content, &value)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return []Diagnostic{newDiagnostic(path, Position{Line: 1, Column: 1}, err.Error(), "json")}
+	}
+
+	// Offset points just past the offending byte
+	offset := syntaxErr.Offset - 1
+	if offset < 0 {
+		offset = 0
+	}
+	return []Diagnostic{newDiagnostic(path, offsetToPosition(content, offset), syntaxErr.Error(), "json")}
+}
+
+func yamlDiagnostics(path string, content []byte) []Diagnostic {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		message := err.Error()
+		position := Position{Line: 1, Column: 1}
+		if matches := yamlLineErrorPattern.FindStringSubmatch(message); matches != nil {
+			if line, convErr := strconv.Atoi(matches[1]); convErr == nil {
+				position.Line = line
+			}
+			message = matches[2]
+		} else {
+			message = strings.TrimPrefix(message, "yaml: ")
+		}
+		return []Diagnostic{newDiagnostic(path, position, message, "yaml")}
+	}
+}
+
+func goDiagnostics(path string, content []byte) []Diagnostic {
+	fileSet := token.NewFileSet()
+	_, err := parser.ParseFile(fileSet, path, content, parser.AllErrors)
+	if err == nil {
+		return nil
+	}
+
+	var errorList scanner.ErrorList
+	if !errors.As(err, &errorList) {
+		return []Diagnostic{newDiagnostic(path, Position{Line: 1, Column: 1}, err.Error(), "go")}
+	}
+
+	// The parser tends to cascade; one report per line is plenty for beginners
+	errorList.RemoveMultiples()
+	diagnostics := make([]Diagnostic, 0, len(errorList))
+	for _, e := range errorList {
+		position := Position{Line: e.Pos.Line, Column: e.Pos.Column}
+		diagnostics = append(diagnostics, newDiagnostic(path, position, e.Msg, "go"))
+	}
+	return diagnostics
+}
+
+func newDiagnostic(path string, position Position, message, source string) Diagnostic {
+	return Diagnostic{
+		File:     path,
+		Range:    Range{Start: position, End: position},
+		Severity: SEVERITY_ERROR,
+		Message:  message,
+		Source:   source,
+	}
+}
+
+// Convert a byte offset into a 1-based line/column position
+func offsetToPosition(content []byte, offset int64) Position {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+
+	position := Position{Line: 1, Column: 1}
+	for _, b := range content[:offset] {
+		if b == '\n' {
+			position.Line++
+			position.Column = 1
+			continue
+		}
+		position.Column++
+	}
+	return position
+}
@@ -11,6 +11,7 @@ var (
 	FS_EDIT_FILE_META      = "fs_edit_file_meta"
 	FS_FETCH_QUEST_META    = "fs_fetch_quest_meta"
 	FS_INITIALIZE_CLIENT   = "fs_initialize_client"
+	FS_TIMELINE            = "fs_timeline"
 )
 
 type InitializeClient struct {
@@ -56,6 +57,11 @@ type FetchQuestMetaPayload struct {
 	Path string `json:"path"`
 }
 
+type TimelinePayload struct {
+	At     int64 `json:"at,omitempty"` // unix ms, defaults to now
+	Export bool  `json:"export,omitempty"`
+}
+
 // Response structures
 type FileInfo struct {
 	Name    string `json:"name"`
@@ -110,4 +116,7 @@ const (
 	RESPONSE_CONNECTION   = "connection"
 	RESPONSE_HEARTBEAT    = "heartbeat"
 	RESPONSE_INFO         = "info"
+	RESPONSE_DIAGNOSTICS  = "diagnostics"
+	RESPONSE_TIMELINE     = "timeline"
+	RESPONSE_FLOW_CONTROL = "flow_control"
 )
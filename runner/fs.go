@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -55,12 +56,28 @@ func InitWorkspaceDir() error {
 }
 
 // Safely join path components to prevent directory traversal
-func safeJoinPath(basePath, userPath string) string {
-
-	// Join with base path
+func safeJoinPath(basePath, userPath string) (string, error) {
+	// Join with base path, which also cleans any ".." segments
 	fullPath := filepath.Join(basePath, userPath)
 
-	return fullPath
+	relPath, err := filepath.Rel(basePath, fullPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside the workspace", userPath)
+	}
+
+	return fullPath, nil
+}
+
+// Resolve a path that must point below the workspace root, never at the root itself
+func safeJoinEntryPath(basePath, userPath string) (string, error) {
+	fullPath, err := safeJoinPath(basePath, userPath)
+	if err != nil {
+		return "", err
+	}
+	if fullPath == filepath.Clean(basePath) {
+		return "", fmt.Errorf("path %q refers to the workspace root", userPath)
+	}
+	return fullPath, nil
 }
 
 // Load directory contents
@@ -71,7 +88,10 @@ func LoadDirHandler(ctx context.Context, payload json.RawMessage, client *Client
 	}
 
 	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	targetPath, err := safeJoinPath(workspaceDir, req.Path)
+	if err != nil {
+		return err
+	}
 
 	files, err := os.ReadDir(targetPath)
 	if err != nil {
@@ -112,7 +132,10 @@ func FetchFileContentHandler(ctx context.Context, payload json.RawMessage, clien
 	}
 
 	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	targetPath, err := safeJoinPath(workspaceDir, req.Path)
+	if err != nil {
+		return err
+	}
 
 	content, err := os.ReadFile(targetPath)
 	if err != nil {
@@ -135,7 +158,10 @@ func FileContentUpdateHandler(ctx context.Context, payload json.RawMessage, clie
 		return fmt.Errorf("failed to unmarshal file content update payload: %w", err)
 	}
 	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	targetPath, err := safeJoinEntryPath(workspaceDir, req.Path)
+	if err != nil {
+		return err
+	}
 	log.Printf("Updating file at path: %s", targetPath)
 	// Ensure parent directory exists
 	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
@@ -145,14 +171,19 @@ func FileContentUpdateHandler(ctx context.Context, payload json.RawMessage, clie
 	if err := os.WriteFile(targetPath, []byte(req.Content), 0644); err != nil {
 		return fmt.Errorf("failed to write file %s: %w", targetPath, err)
 	}
+	recordTimelineEvent(TIMELINE_OP_UPDATE, req.Path, "", false, &req.Content)
 
 	fileUpdatePath := fmt.Sprintf("code/%s/%s/%s", LANGUAGE, LAB_ID, req.Path)
 	log.Printf("FILE PATH: %s", fileUpdatePath)
 
-	return client.SendResponse(RESPONSE_FILE_UPDATED, map[string]interface{}{
+	if err := client.SendResponse(RESPONSE_FILE_UPDATED, map[string]interface{}{
 		"path":    req.Path,
 		"success": true,
-	})
+	}); err != nil {
+		return err
+	}
+
+	return publishDiagnostics(client, req.Path, []byte(req.Content))
 }
 
 // Create new file or directory
@@ -163,7 +194,10 @@ func NewFileHandler(ctx context.Context, payload json.RawMessage, client *Client
 	}
 
 	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	targetPath, err := safeJoinEntryPath(workspaceDir, req.Path)
+	if err != nil {
+		return err
+	}
 
 	// Ensure parent directory exists
 	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
@@ -174,7 +208,7 @@ func NewFileHandler(ctx context.Context, payload json.RawMessage, client *Client
 		if err := os.MkdirAll(targetPath, 0755); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
 		}
-
+		recordTimelineEvent(TIMELINE_OP_CREATE, req.Path, "", true, nil)
 	} else {
 		content := req.Content
 		if content == "" {
@@ -183,7 +217,7 @@ func NewFileHandler(ctx context.Context, payload json.RawMessage, client *Client
 		if err := os.WriteFile(targetPath, []byte(content), 0644); err != nil {
 			return fmt.Errorf("failed to create file %s: %w", targetPath, err)
 		}
-
+		recordTimelineEvent(TIMELINE_OP_CREATE, req.Path, "", false, &content)
 	}
 
 	return client.SendResponse(RESPONSE_FILE_CREATED, map[string]interface{}{
@@ -201,10 +235,13 @@ func DeleteFileHandler(ctx context.Context, payload json.RawMessage, client *Cli
 	}
 
 	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	targetPath, err := safeJoinEntryPath(workspaceDir, req.Path)
+	if err != nil {
+		return err
+	}
 
 	// Check if file/directory exists
-	_, err := os.Stat(targetPath)
+	info, err := os.Stat(targetPath)
 	if err != nil {
 		return fmt.Errorf("failed to stat %s: %w", targetPath, err)
 	}
@@ -212,6 +249,7 @@ func DeleteFileHandler(ctx context.Context, payload json.RawMessage, client *Cli
 	if err := os.RemoveAll(targetPath); err != nil {
 		return fmt.Errorf("failed to delete %s: %w", targetPath, err)
 	}
+	recordTimelineEvent(TIMELINE_OP_DELETE, req.Path, "", info.IsDir(), nil)
 
 	return client.SendResponse(RESPONSE_FILE_DELETED, map[string]interface{}{
 		"path":    req.Path,
@@ -227,8 +265,14 @@ func EditFileMetaHandler(ctx context.Context, payload json.RawMessage, client *C
 	}
 
 	workspaceDir := getWorkspaceDir()
-	oldPath := safeJoinPath(workspaceDir, req.OldPath)
-	newPath := safeJoinPath(workspaceDir, req.NewPath)
+	oldPath, err := safeJoinEntryPath(workspaceDir, req.OldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err := safeJoinEntryPath(workspaceDir, req.NewPath)
+	if err != nil {
+		return err
+	}
 
 	// Ensure parent directory exists for new path
 	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
@@ -238,6 +282,7 @@ func EditFileMetaHandler(ctx context.Context, payload json.RawMessage, client *C
 	if err := os.Rename(oldPath, newPath); err != nil {
 		return fmt.Errorf("failed to rename %s to %s: %w", oldPath, newPath, err)
 	}
+	recordRenameInTimeline(req.OldPath, req.NewPath, newPath)
 
 	return client.SendResponse(RESPONSE_FILE_RENAMED, map[string]interface{}{
 		"oldPath": req.OldPath,
@@ -254,10 +299,13 @@ func FetchQuestMetaHandler(ctx context.Context, payload json.RawMessage, client
 	}
 
 	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	targetPath, err := safeJoinPath(workspaceDir, req.Path)
+	if err != nil {
+		return err
+	}
 
 	var fileInfos []FileInfo
-	err := filepath.WalkDir(targetPath, func(path string, d fs.DirEntry, err error) error {
+	err = filepath.WalkDir(targetPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
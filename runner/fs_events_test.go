@@ -0,0 +1,302 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestInitializeClient(t *testing.T) {
+	h := newTestHarness(t)
+	client := h.connect()
+
+	response := client.call(FS_INITIALIZE_CLIENT, InitializeClient{LabID: "lab-1", Language: "react"}, RESPONSE_INFO)
+	data := decodeData[map[string]string](t, response)
+	if data["labId"] != "lab-1" || data["language"] != "react" {
+		t.Errorf("expected lab-1/react; got %v", data)
+	}
+	if LAB_ID != "lab-1" || LANGUAGE != "react" {
+		t.Errorf("expected globals to be set; got %q/%q", LAB_ID, LANGUAGE)
+	}
+
+	// Every routed event after initialization counts as lab activity
+	client.call(FS_LOAD_DIR, LoadDirPayload{Path: ""}, RESPONSE_DIR_CONTENT)
+	if _, ok := h.reporter.MonitorEntry("lab-1"); !ok {
+		t.Errorf("expected lab activity to be reported")
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	h := newTestHarness(t)
+	h.writeFile("src/App.jsx", "export default function App() {}")
+	h.writeFile("package.json", "{}")
+	client := h.connectToLab("lab-1", "react")
+
+	response := client.call(FS_LOAD_DIR, LoadDirPayload{Path: ""}, RESPONSE_DIR_CONTENT)
+	dir := decodeData[DirContentResponse](t, response)
+	if got := fileNames(dir.Files); strings.Join(got, ",") != "package.json,src" {
+		t.Errorf("expected package.json,src; got %v", got)
+	}
+
+	response = client.call(FS_LOAD_DIR, LoadDirPayload{Path: "src"}, RESPONSE_DIR_CONTENT)
+	dir = decodeData[DirContentResponse](t, response)
+	if len(dir.Files) != 1 || dir.Files[0].Path != filepath.Join("src", "App.jsx") || dir.Files[0].IsDir {
+		t.Errorf("expected src/App.jsx; got %+v", dir.Files)
+	}
+
+	if details := client.callError(FS_LOAD_DIR, LoadDirPayload{Path: "missing"}); !strings.Contains(details, "failed to read directory") {
+		t.Errorf("expected read error; got %q", details)
+	}
+}
+
+func TestFetchFileContent(t *testing.T) {
+	h := newTestHarness(t)
+	h.writeFile("src/index.js", "console.log('hi')")
+	client := h.connectToLab("lab-1", "react")
+
+	response := client.call(FS_FETCH_FILE_CONTENT, FetchFileContentPayload{Path: "src/index.js"}, RESPONSE_FILE_CONTENT)
+	file := decodeData[FileContentResponse](t, response)
+	if file.Path != "src/index.js" || file.Content != "console.log('hi')" {
+		t.Errorf("unexpected file content response %+v", file)
+	}
+
+	if details := client.callError(FS_FETCH_FILE_CONTENT, FetchFileContentPayload{Path: "src/missing.js"}); !strings.Contains(details, "failed to read file") {
+		t.Errorf("expected read error; got %q", details)
+	}
+}
+
+func TestFileContentUpdate(t *testing.T) {
+	h := newTestHarness(t)
+	client := h.connectToLab("lab-1", "react")
+
+	response := client.call(FS_FILE_CONTENT_UPDATE, FileContentUpdatePayload{Path: "src/new/App.jsx", Content: "v1"}, RESPONSE_FILE_UPDATED)
+	if data := decodeData[map[string]interface{}](t, response); data["path"] != "src/new/App.jsx" || data["success"] != true {
+		t.Errorf("unexpected update response %v", data)
+	}
+	if content, ok := h.readFile("src/new/App.jsx"); !ok || content != "v1" {
+		t.Errorf("expected file to contain v1; got %q (exists: %v)", content, ok)
+	}
+
+	// Files with a diagnostics provider get a diagnostics push after the reply
+	client.call(FS_FILE_CONTENT_UPDATE, FileContentUpdatePayload{Path: "config.json", Content: "{\n  \"a\": }"}, RESPONSE_FILE_UPDATED)
+	diagnostics := decodeData[DiagnosticsResponse](t, client.await(RESPONSE_DIAGNOSTICS))
+	if diagnostics.Path != "config.json" || len(diagnostics.Diagnostics) != 1 {
+		t.Fatalf("expected one diagnostic for config.json; got %+v", diagnostics)
+	}
+	if start := diagnostics.Diagnostics[0].Range.Start; start.Line != 2 {
+		t.Errorf("expected diagnostic on line 2; got %+v", start)
+	}
+
+	client.call(FS_FILE_CONTENT_UPDATE, FileContentUpdatePayload{Path: "config.json", Content: "{}"}, RESPONSE_FILE_UPDATED)
+	diagnostics = decodeData[DiagnosticsResponse](t, client.await(RESPONSE_DIAGNOSTICS))
+	if len(diagnostics.Diagnostics) != 0 {
+		t.Errorf("expected diagnostics to be cleared; got %+v", diagnostics.Diagnostics)
+	}
+
+	if details := client.callError(FS_FILE_CONTENT_UPDATE, FileContentUpdatePayload{Path: "", Content: "x"}); !strings.Contains(details, "workspace root") {
+		t.Errorf("expected workspace root error; got %q", details)
+	}
+}
+
+func TestNewFile(t *testing.T) {
+	h := newTestHarness(t)
+	client := h.connectToLab("lab-1", "react")
+
+	response := client.call(FS_NEW_FILE, NewFilePayload{Path: "src/components/Button.jsx", Content: "button"}, RESPONSE_FILE_CREATED)
+	if data := decodeData[map[string]interface{}](t, response); data["isDir"] != false || data["success"] != true {
+		t.Errorf("unexpected create response %v", data)
+	}
+	if content, ok := h.readFile("src/components/Button.jsx"); !ok || content != "button" {
+		t.Errorf("expected file to contain button; got %q (exists: %v)", content, ok)
+	}
+
+	client.call(FS_NEW_FILE, NewFilePayload{Path: "src/hooks", IsDir: true}, RESPONSE_FILE_CREATED)
+	if info, err := os.Stat(filepath.Join(h.workspace, "src/hooks")); err != nil || !info.IsDir() {
+		t.Errorf("expected src/hooks to be a directory; got %v", err)
+	}
+
+	client.call(FS_NEW_FILE, NewFilePayload{Path: "empty.txt"}, RESPONSE_FILE_CREATED)
+	if content, ok := h.readFile("empty.txt"); !ok || content != "" {
+		t.Errorf("expected empty file; got %q (exists: %v)", content, ok)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	h := newTestHarness(t)
+	h.writeFile("src/App.jsx", "app")
+	h.writeFile("src/utils/math.js", "math")
+	client := h.connectToLab("lab-1", "react")
+
+	client.call(FS_DELETE_FILE, DeleteFilePayload{Path: "src/App.jsx"}, RESPONSE_FILE_DELETED)
+	if _, ok := h.readFile("src/App.jsx"); ok {
+		t.Errorf("expected src/App.jsx to be deleted")
+	}
+
+	client.call(FS_DELETE_FILE, DeleteFilePayload{Path: "src/utils"}, RESPONSE_FILE_DELETED)
+	if _, err := os.Stat(filepath.Join(h.workspace, "src/utils")); !os.IsNotExist(err) {
+		t.Errorf("expected src/utils to be deleted; got %v", err)
+	}
+
+	if details := client.callError(FS_DELETE_FILE, DeleteFilePayload{Path: "src/App.jsx"}); !strings.Contains(details, "failed to stat") {
+		t.Errorf("expected stat error; got %q", details)
+	}
+
+	for _, path := range []string{"", ".", "/", "src/.."} {
+		if details := client.callError(FS_DELETE_FILE, DeleteFilePayload{Path: path}); !strings.Contains(details, "workspace root") {
+			t.Errorf("expected deleting %q to be refused; got %q", path, details)
+		}
+	}
+	if _, err := os.Stat(h.workspace); err != nil {
+		t.Fatalf("expected workspace to survive; got %v", err)
+	}
+}
+
+func TestEditFileMeta(t *testing.T) {
+	h := newTestHarness(t)
+	h.writeFile("src/App.jsx", "app")
+	client := h.connectToLab("lab-1", "react")
+
+	response := client.call(FS_EDIT_FILE_META, EditFileMetaPayload{OldPath: "src/App.jsx", NewPath: "src/pages/Home.jsx"}, RESPONSE_FILE_RENAMED)
+	if data := decodeData[map[string]interface{}](t, response); data["oldPath"] != "src/App.jsx" || data["newPath"] != "src/pages/Home.jsx" {
+		t.Errorf("unexpected rename response %v", data)
+	}
+	if _, ok := h.readFile("src/App.jsx"); ok {
+		t.Errorf("expected src/App.jsx to be moved")
+	}
+	if content, ok := h.readFile("src/pages/Home.jsx"); !ok || content != "app" {
+		t.Errorf("expected moved file to contain app; got %q (exists: %v)", content, ok)
+	}
+
+	if details := client.callError(FS_EDIT_FILE_META, EditFileMetaPayload{OldPath: "src/missing.jsx", NewPath: "src/other.jsx"}); !strings.Contains(details, "failed to rename") {
+		t.Errorf("expected rename error; got %q", details)
+	}
+	if details := client.callError(FS_EDIT_FILE_META, EditFileMetaPayload{OldPath: "", NewPath: "moved"}); !strings.Contains(details, "workspace root") {
+		t.Errorf("expected workspace root error; got %q", details)
+	}
+}
+
+func TestFetchQuestMeta(t *testing.T) {
+	h := newTestHarness(t)
+	h.writeFile("src/App.jsx", "app")
+	h.writeFile("package.json", "{}")
+	client := h.connectToLab("lab-1", "react")
+
+	response := client.call(FS_FETCH_QUEST_META, FetchQuestMetaPayload{Path: ""}, RESPONSE_QUEST_META)
+	meta := decodeData[QuestMetaResponse](t, response)
+
+	var paths []string
+	for _, file := range meta.Files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	if got := strings.Join(paths, ","); got != ".,package.json,src,src/App.jsx" {
+		t.Errorf("expected the whole tree; got %v", got)
+	}
+
+	if details := client.callError(FS_FETCH_QUEST_META, FetchQuestMetaPayload{Path: "missing"}); !strings.Contains(details, "failed to walk directory") {
+		t.Errorf("expected walk error; got %q", details)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	h := newTestHarness(t)
+	client := h.connectToLab("lab-1", "react")
+
+	client.call(FS_NEW_FILE, NewFilePayload{Path: "notes.txt", Content: "v1"}, RESPONSE_FILE_CREATED)
+	client.call(FS_FILE_CONTENT_UPDATE, FileContentUpdatePayload{Path: "notes.txt", Content: "v2"}, RESPONSE_FILE_UPDATED)
+	client.call(FS_EDIT_FILE_META, EditFileMetaPayload{OldPath: "notes.txt", NewPath: "docs/notes.txt"}, RESPONSE_FILE_RENAMED)
+
+	export := decodeData[TimelineExport](t, client.call(FS_TIMELINE, TimelinePayload{Export: true}, RESPONSE_TIMELINE))
+	if export.Format != TIMELINE_FORMAT || export.LabID != "lab-1" {
+		t.Errorf("unexpected export header %+v", export)
+	}
+	var ops []string
+	for _, entry := range export.Entries {
+		ops = append(ops, entry.Op)
+	}
+	if got := strings.Join(ops, ","); got != "create,update,rename" {
+		t.Errorf("expected create,update,rename; got %v", got)
+	}
+
+	snapshot := decodeData[TimelineSnapshot](t, client.call(FS_TIMELINE, TimelinePayload{}, RESPONSE_TIMELINE))
+	if file := snapshot.Files["docs/notes.txt"]; file.Content != "v2" || file.Deleted {
+		t.Errorf("expected docs/notes.txt to contain v2; got %+v", file)
+	}
+	if file := snapshot.Files["notes.txt"]; !file.Deleted {
+		t.Errorf("expected notes.txt to be a tombstone; got %+v", file)
+	}
+}
+
+func TestPathTraversalIsRejected(t *testing.T) {
+	h := newTestHarness(t)
+	client := h.connectToLab("lab-1", "react")
+
+	// The parent of the workspace is private to this test, so it is safe to probe
+	outside := filepath.Join(filepath.Dir(h.workspace), "outside.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatalf("error writing sentinel. Err: %v", err)
+	}
+
+	for _, path := range []string{"../outside.txt", "src/../../outside.txt", "/../outside.txt", "..", "../../../../etc/passwd"} {
+		events := []struct {
+			eventType string
+			payload   interface{}
+		}{
+			{FS_LOAD_DIR, LoadDirPayload{Path: path}},
+			{FS_FETCH_FILE_CONTENT, FetchFileContentPayload{Path: path}},
+			{FS_FILE_CONTENT_UPDATE, FileContentUpdatePayload{Path: path, Content: "pwned"}},
+			{FS_NEW_FILE, NewFilePayload{Path: path, Content: "pwned"}},
+			{FS_DELETE_FILE, DeleteFilePayload{Path: path}},
+			{FS_EDIT_FILE_META, EditFileMetaPayload{OldPath: path, NewPath: "stolen.txt"}},
+			{FS_EDIT_FILE_META, EditFileMetaPayload{OldPath: "stolen.txt", NewPath: path}},
+			{FS_FETCH_QUEST_META, FetchQuestMetaPayload{Path: path}},
+		}
+		for _, event := range events {
+			if details := client.callError(event.eventType, event.payload); !strings.Contains(details, "outside the workspace") {
+				t.Errorf("%s with %q: expected traversal error; got %q", event.eventType, path, details)
+			}
+		}
+	}
+
+	content, err := os.ReadFile(outside)
+	if err != nil || string(content) != "secret" {
+		t.Errorf("expected sentinel to be untouched; got %q, %v", content, err)
+	}
+	if _, ok := h.readFile("stolen.txt"); ok {
+		t.Errorf("expected nothing to be moved into the workspace")
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	h := newTestHarness(t)
+	client := h.connect()
+
+	client.sendRaw([]byte("{not json"))
+	if response := client.await(RESPONSE_ERROR); response.Message != "Invalid JSON format" {
+		t.Errorf("expected invalid JSON error; got %+v", response)
+	}
+
+	client.send("fs_unknown", map[string]string{})
+	if response := client.await(RESPONSE_ERROR); response.Message != "Unknown event type" {
+		t.Errorf("expected unknown event error; got %+v", response)
+	}
+
+	client.sendRaw(Event{Type: FS_LOAD_DIR, Payload: []byte(`"not an object"`)})
+	if response := client.await(RESPONSE_ERROR); response.Message != "Handler execution failed" {
+		t.Errorf("expected handler error; got %+v", response)
+	}
+
+	// The connection stays usable after errors
+	client.call(FS_LOAD_DIR, LoadDirPayload{Path: ""}, RESPONSE_DIR_CONTENT)
+}
+
+func fileNames(files []FileInfo) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -5,6 +5,7 @@ go 1.24.5
 require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/redis/go-redis/v9 v9.12.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Test harness
+//
+// newTestHarness boots a WSManager behind an httptest server, pointed at a temporary
+// workspace and an in-memory status reporter. Clients connected through the harness
+// speak the real WebSocket protocol, so tests exercise the same path as the IDE.
+
+const testResponseTimeout = 5 * time.Second
+
+type testHarness struct {
+	t         *testing.T
+	server    *httptest.Server
+	manager   *WSManager
+	reporter  *MemoryStatusReporter
+	workspace string
+}
+
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func newTestHarness(t *testing.T) *testHarness {
+	t.Helper()
+
+	workspace := t.TempDir()
+	t.Setenv("WORKSPACE_DIR", workspace)
+
+	// Handlers read and write package state, reset it around every test
+	previousReporter := Reporter
+	reporter := NewMemoryStatusReporter()
+	Reporter = reporter
+	timelinesMu.Lock()
+	timelines = make(map[string]*Timeline)
+	timelinesMu.Unlock()
+	t.Cleanup(func() {
+		Reporter = previousReporter
+		LAB_ID = ""
+		LANGUAGE = ""
+	})
+
+	manager := NewFSManager(context.Background())
+	manager.setupHandlers()
+	server := httptest.NewServer(http.HandlerFunc(manager.serveFS))
+	t.Cleanup(server.Close)
+
+	return &testHarness{
+		t:         t,
+		server:    server,
+		manager:   manager,
+		reporter:  reporter,
+		workspace: workspace,
+	}
+}
+
+// Open a connection and consume the greeting sent by the server
+func (h *testHarness) connect() *testClient {
+	h.t.Helper()
+
+	url := "ws" + strings.TrimPrefix(h.server.URL, "http") + "/fs"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		h.t.Fatalf("error connecting to runner. Err: %v", err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+
+	client := &testClient{t: h.t, conn: conn}
+	greeting := client.next()
+	if greeting.Type != RESPONSE_INFO || greeting.Message != "Connection established" {
+		h.t.Fatalf("expected connection greeting; got %+v", greeting)
+	}
+	return client
+}
+
+// Connect and initialize the client for a lab, as the IDE does on load
+func (h *testHarness) connectToLab(labID, language string) *testClient {
+	h.t.Helper()
+
+	client := h.connect()
+	client.call(FS_INITIALIZE_CLIENT, InitializeClient{LabID: labID, Language: language}, RESPONSE_INFO)
+	return client
+}
+
+// Create a file in the workspace directly, bypassing the protocol
+func (h *testHarness) writeFile(path, content string) {
+	h.t.Helper()
+
+	fullPath := filepath.Join(h.workspace, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		h.t.Fatalf("error creating %s. Err: %v", path, err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+		h.t.Fatalf("error writing %s. Err: %v", path, err)
+	}
+}
+
+// Read a workspace file, reporting ok=false when it does not exist
+func (h *testHarness) readFile(path string) (string, bool) {
+	h.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(h.workspace, path))
+	if os.IsNotExist(err) {
+		return "", false
+	}
+	if err != nil {
+		h.t.Fatalf("error reading %s. Err: %v", path, err)
+	}
+	return string(content), true
+}
+
+func (c *testClient) send(eventType string, payload interface{}) {
+	c.t.Helper()
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		c.t.Fatalf("error marshalling %s payload. Err: %v", eventType, err)
+	}
+	c.sendRaw(Event{Type: eventType, Payload: raw})
+}
+
+func (c *testClient) sendRaw(event interface{}) {
+	c.t.Helper()
+
+	var data []byte
+	switch value := event.(type) {
+	case []byte:
+		data = value
+	default:
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			c.t.Fatalf("error marshalling event. Err: %v", err)
+		}
+	}
+
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("error sending event. Err: %v", err)
+	}
+}
+
+// Read the next response, whatever its type
+func (c *testClient) next() WSResponse {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(testResponseTimeout))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("error reading response. Err: %v", err)
+	}
+
+	var response WSResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		c.t.Fatalf("error unmarshalling response %s. Err: %v", data, err)
+	}
+	return response
+}
+
+// Wait for a response of the given type. Pushed notifications are skipped; any other
+// response (an error in particular) fails the test.
+func (c *testClient) await(responseType string) WSResponse {
+	c.t.Helper()
+
+	for {
+		response := c.next()
+		if response.Type == responseType {
+			return response
+		}
+		if response.Type == RESPONSE_DIAGNOSTICS || response.Type == RESPONSE_FLOW_CONTROL {
+			continue
+		}
+		c.t.Fatalf("expected %s response; got %s (%s: %v)", responseType, response.Type, response.Message, response.Data)
+	}
+}
+
+// Send an event and wait for its reply
+func (c *testClient) call(eventType string, payload interface{}, responseType string) WSResponse {
+	c.t.Helper()
+
+	c.send(eventType, payload)
+	return c.await(responseType)
+}
+
+// Send an event that must fail, returning the error details
+func (c *testClient) callError(eventType string, payload interface{}) string {
+	c.t.Helper()
+
+	response := c.call(eventType, payload, RESPONSE_ERROR)
+	if response.Status != STATUS_ERROR {
+		c.t.Fatalf("expected error status; got %s", response.Status)
+	}
+	return decodeData[map[string]string](c.t, response)["details"]
+}
+
+// Decode the data of a response into its typed form
+func decodeData[T any](t *testing.T, response WSResponse) T {
+	t.Helper()
+
+	var data T
+	raw, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatalf("error marshalling %s data. Err: %v", response.Type, err)
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatalf("error decoding %s data %s. Err: %v", response.Type, raw, err)
+	}
+	return data
+}
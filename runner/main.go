@@ -14,13 +14,21 @@ var (
 	PING_INTERVAL        = 10 * time.Second
 	PONG_WAIT_DURATION   = (PING_INTERVAL * 9) / 10
 	READ_LIMIT           = int64(1024 * 1024 * 5) // 5 MB
+	TIMELINE_MAX_ENTRIES = 5000
+	TIMELINE_MAX_BYTES   = 8 * 1024 * 1024 // 8 MB of recorded content per lab
+	CLIENT_QUEUE_SIZE    = 256
+	SLOW_CLIENT_POLICY   = SLOW_CLIENT_POLICY_DISCONNECT
+	SLOW_CLIENT_TIMEOUT  = 30 * time.Second
 )
 
 func main() {
 	ctx := context.Background()
 
-	// Initialize Redis first
-	InitRedis()
+	// Initialize the status reporter first
+	if err := InitStatusReporter(); err != nil {
+		log.Fatal("Failed to initialize status reporter: ", err)
+	}
+	loadFlowControlConfig()
 
 	if err := InitWorkspaceDir(); err != nil {
 		log.Fatal("Failed to initialize workspace:", err)
@@ -37,7 +45,7 @@ func main() {
 
 	log.Println("File system service starting on :8081")
 	labId := os.Getenv("LAB_ID")
-	UpdateLabInstanceProgress(labId, LabProgressEntry{
+	Reporter.UpdateLabInstanceProgress(labId, LabProgressEntry{
 		Timestamp:   time.Now().Unix(),
 		Status:      Active,
 		Message:     "File System Service Started",
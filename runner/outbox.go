@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Flow control
+//
+// Every client owns a bounded outbox instead of a bare channel. Replies (responses to a
+// request and errors) are always written before broadcasts (pushed notifications such as
+// diagnostics). Broadcasts carrying a coalesce key replace any queued broadcast with the
+// same key, so only the latest state is delivered. When the outbox is full, broadcasts
+// are evicted to make room for replies; anything else is dropped and counted. Drops are
+// reported to the client with a `flow_control` message once the queue drains, and a client
+// that stays full for longer than SLOW_CLIENT_TIMEOUT is disconnected when
+// SLOW_CLIENT_POLICY is "disconnect".
+
+type sendPriority int
+
+const (
+	PRIORITY_REPLY sendPriority = iota
+	PRIORITY_BROADCAST
+)
+
+const (
+	SLOW_CLIENT_POLICY_DROP       = "drop"
+	SLOW_CLIENT_POLICY_DISCONNECT = "disconnect"
+)
+
+var (
+	ErrSendQueueFull = errors.New("client send queue is full")
+	ErrClientClosed  = errors.New("client connection is closed")
+)
+
+type queuedResponse struct {
+	response    WSResponse
+	coalesceKey string
+}
+
+type FlowControlStats struct {
+	Dropped         uint64 `json:"dropped"`
+	DroppedSinceAck uint64 `json:"droppedSinceLastReport"`
+	Coalesced       uint64 `json:"coalesced"`
+	Queued          int    `json:"queued"`
+	Capacity        int    `json:"capacity"`
+}
+
+type outbox struct {
+	replies    []queuedResponse
+	broadcasts []queuedResponse
+	capacity   int
+	// Signals the writer that something was queued or the outbox was closed
+	ready         chan struct{}
+	dropped       uint64
+	reportedDrops uint64
+	coalesced     uint64
+	fullSince     time.Time
+	closed        bool
+	mu            sync.Mutex
+}
+
+func newOutbox(capacity int) *outbox {
+	return &outbox{
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) push(response WSResponse, priority sendPriority, coalesceKey string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ErrClientClosed
+	}
+
+	if priority == PRIORITY_BROADCAST && coalesceKey != "" {
+		for i := range o.broadcasts {
+			if o.broadcasts[i].coalesceKey == coalesceKey {
+				o.broadcasts[i].response = response
+				o.coalesced++
+				return nil
+			}
+		}
+	}
+
+	if o.length() >= o.capacity {
+		if priority == PRIORITY_REPLY && len(o.broadcasts) > 0 {
+			// Replies win over broadcasts: evict the oldest broadcast
+			o.broadcasts = o.broadcasts[1:]
+			o.dropped++
+		} else {
+			o.dropped++
+			if o.fullSince.IsZero() {
+				o.fullSince = time.Now()
+			}
+			return ErrSendQueueFull
+		}
+	}
+
+	queued := queuedResponse{response: response, coalesceKey: coalesceKey}
+	if priority == PRIORITY_REPLY {
+		o.replies = append(o.replies, queued)
+	} else {
+		o.broadcasts = append(o.broadcasts, queued)
+	}
+	o.signal()
+	return nil
+}
+
+// Take the next message to write, replies first
+func (o *outbox) pop() (WSResponse, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var next queuedResponse
+	switch {
+	case len(o.replies) > 0:
+		next, o.replies = o.replies[0], o.replies[1:]
+	case len(o.broadcasts) > 0:
+		next, o.broadcasts = o.broadcasts[0], o.broadcasts[1:]
+	default:
+		return WSResponse{}, false
+	}
+
+	if o.length() < o.capacity/2 {
+		o.fullSince = time.Time{}
+	}
+	return next.response, true
+}
+
+// Report drops that the client has not been told about yet
+func (o *outbox) takeDropReport() (FlowControlStats, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.dropped == o.reportedDrops {
+		return FlowControlStats{}, false
+	}
+
+	stats := FlowControlStats{
+		Dropped:         o.dropped,
+		DroppedSinceAck: o.dropped - o.reportedDrops,
+		Coalesced:       o.coalesced,
+		Queued:          o.length(),
+		Capacity:        o.capacity,
+	}
+	o.reportedDrops = o.dropped
+	return stats, true
+}
+
+// How long the outbox has been saturated, zero when it is keeping up
+func (o *outbox) slowFor() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.fullSince.IsZero() {
+		return 0
+	}
+	return time.Since(o.fullSince)
+}
+
+func (o *outbox) isDrained() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closed && o.length() == 0
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.signal()
+}
+
+func (o *outbox) length() int {
+	return len(o.replies) + len(o.broadcasts)
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Read flow control overrides from the environment
+func loadFlowControlConfig() {
+	if policy := os.Getenv("SLOW_CLIENT_POLICY"); policy != "" {
+		if policy != SLOW_CLIENT_POLICY_DROP && policy != SLOW_CLIENT_POLICY_DISCONNECT {
+			log.Printf("Unknown SLOW_CLIENT_POLICY %q, keeping %q", policy, SLOW_CLIENT_POLICY)
+		} else {
+			SLOW_CLIENT_POLICY = policy
+		}
+	}
+
+	if size := os.Getenv("CLIENT_QUEUE_SIZE"); size != "" {
+		if parsed, err := strconv.Atoi(size); err == nil && parsed > 0 {
+			CLIENT_QUEUE_SIZE = parsed
+		} else {
+			log.Printf("Invalid CLIENT_QUEUE_SIZE %q", size)
+		}
+	}
+
+	if timeout := os.Getenv("SLOW_CLIENT_TIMEOUT"); timeout != "" {
+		if duration, err := time.ParseDuration(timeout); err == nil {
+			SLOW_CLIENT_TIMEOUT = duration
+		} else {
+			log.Printf("Invalid SLOW_CLIENT_TIMEOUT %q: %v", timeout, err)
+		}
+	}
+}
@@ -3,18 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	RedisClient *redis.Client
-	Context     context.Context
-)
-
 type LabProgressEntry struct {
 	Timestamp   int64
 	Status      LabStatus
@@ -59,33 +54,34 @@ type LabMonitoringEntry struct {
 	CreatedAt     int64
 }
 
-func InitRedis() {
-	redisURI := os.Getenv("REDIS_URI")
+// RedisStatusReporter reports lab status to the shared Redis instance used by the API server
+type RedisStatusReporter struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+func NewRedisStatusReporter(redisURI string) (*RedisStatusReporter, error) {
 	log.Printf("Connecting to Redis at: %s", redisURI)
 	opt, err := redis.ParseURL(redisURI)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid REDIS_URI: %w", err)
 	}
 
-	RedisClient = redis.NewClient(opt)
-	Context = context.Background()
+	client := redis.NewClient(opt)
+	ctx := context.Background()
 
 	// Test connection
-	_, err = RedisClient.Ping(Context).Result()
-	if err != nil {
-		panic(err)
+	if _, err := client.Ping(ctx).Result(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
 	}
 
 	log.Println("Redis connection established")
+	return &RedisStatusReporter{client: client, ctx: ctx}, nil
 }
 
-func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
-	if RedisClient == nil {
-		log.Fatalf("Redis client is not initialized")
-	}
-
+func (r *RedisStatusReporter) UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
 	// Get existing instance
-	data, err := RedisClient.HGet(Context, "lab_instances", labID).Result()
+	data, err := r.client.HGet(r.ctx, "lab_instances", labID).Result()
 	if err != nil {
 		log.Printf("Failed to fetch lab instance %s: %v", labID, err)
 		return
@@ -98,9 +94,8 @@ func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
 		return
 	}
 
-	// Update progress logs and status
-	instance.ProgressLogs = append(instance.ProgressLogs, progress)
-	instance.LastUpdatedAt = progress.Timestamp
+	// Update progress logs
+	applyProgress(&instance, progress)
 
 	updatedData, err := json.Marshal(instance)
 	if err != nil {
@@ -108,7 +103,7 @@ func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
 		return
 	}
 
-	err = RedisClient.HSet(Context, "lab_instances", labID, updatedData).Err()
+	err = r.client.HSet(r.ctx, "lab_instances", labID, updatedData).Err()
 	if err != nil {
 		log.Printf("Failed to update lab instance %s: %v", labID, err)
 		return
@@ -118,16 +113,11 @@ func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
 }
 
 // UpdateLabMonitorQueue updates the updatedAt field for a lab in the lab_monitor queue
-func UpdateLabMonitorQueue(labID string) {
-	if RedisClient == nil {
-		log.Printf("Redis client not initialized, skipping lab monitor update")
-		return
-	}
-
+func (r *RedisStatusReporter) UpdateLabMonitorQueue(labID string) {
 	currentTime := time.Now().Unix()
 
 	// Get all items from the lab_monitor queue
-	monitorItems, err := RedisClient.LRange(Context, "labs_monitor", 0, -1).Result()
+	monitorItems, err := r.client.LRange(r.ctx, "labs_monitor", 0, -1).Result()
 	if err != nil {
 		log.Printf("Failed to get lab monitor queue: %v", err)
 		return
@@ -154,7 +144,7 @@ func UpdateLabMonitorQueue(labID string) {
 			}
 
 			// Update the list item
-			err = RedisClient.LSet(Context, "labs_monitor", int64(i), updatedData).Err()
+			err = r.client.LSet(r.ctx, "labs_monitor", int64(i), updatedData).Err()
 			if err != nil {
 				log.Printf("Failed to update lab monitor entry for %s: %v", labID, err)
 			} else {
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatusReporter publishes lab lifecycle updates (progress logs and activity pings) to the
+// control plane. The implementation is picked by STATUS_REPORTER:
+//
+//	redis  - the shared Redis instance at REDIS_URI (used in the cluster)
+//	memory - kept in-process, handy for tests and local debugging
+//	none   - discarded
+//
+// When STATUS_REPORTER is unset, "redis" is used if REDIS_URI is set and "none" otherwise,
+// so the runner can boot on a laptop against a local WORKSPACE_DIR.
+type StatusReporter interface {
+	UpdateLabInstanceProgress(labID string, progress LabProgressEntry)
+	UpdateLabMonitorQueue(labID string)
+}
+
+const (
+	STATUS_REPORTER_REDIS  = "redis"
+	STATUS_REPORTER_MEMORY = "memory"
+	STATUS_REPORTER_NONE   = "none"
+)
+
+var Reporter StatusReporter = NoopStatusReporter{}
+
+func InitStatusReporter() error {
+	kind := os.Getenv("STATUS_REPORTER")
+	if kind == "" {
+		kind = STATUS_REPORTER_NONE
+		if os.Getenv("REDIS_URI") != "" {
+			kind = STATUS_REPORTER_REDIS
+		}
+	}
+
+	switch kind {
+	case STATUS_REPORTER_REDIS:
+		redisURI := os.Getenv("REDIS_URI")
+		if redisURI == "" {
+			return fmt.Errorf("STATUS_REPORTER is %q but REDIS_URI is not set", kind)
+		}
+		reporter, err := NewRedisStatusReporter(redisURI)
+		if err != nil {
+			return err
+		}
+		Reporter = reporter
+	case STATUS_REPORTER_MEMORY:
+		Reporter = NewMemoryStatusReporter()
+	case STATUS_REPORTER_NONE:
+		Reporter = NoopStatusReporter{}
+	default:
+		return fmt.Errorf("unknown STATUS_REPORTER %q", kind)
+	}
+
+	log.Printf("Lab status reporter: %s", kind)
+	return nil
+}
+
+// NoopStatusReporter drops every update
+type NoopStatusReporter struct{}
+
+func (NoopStatusReporter) UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {}
+
+func (NoopStatusReporter) UpdateLabMonitorQueue(labID string) {}
+
+// MemoryStatusReporter keeps lab state in-process with the same semantics as Redis
+type MemoryStatusReporter struct {
+	instances map[string]*LabInstanceEntry
+	monitor   map[string]LabMonitoringEntry
+	mu        sync.Mutex
+}
+
+func NewMemoryStatusReporter() *MemoryStatusReporter {
+	return &MemoryStatusReporter{
+		instances: make(map[string]*LabInstanceEntry),
+		monitor:   make(map[string]LabMonitoringEntry),
+	}
+}
+
+func (m *MemoryStatusReporter) UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	applyProgress(m.instance(labID), progress)
+}
+
+func (m *MemoryStatusReporter) UpdateLabMonitorQueue(labID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.monitor[labID]
+	entry.LabID = labID
+	entry.Status = Active
+	entry.LastUpdatedAt = time.Now().Unix()
+	m.monitor[labID] = entry
+}
+
+// LabInstance returns a copy of the recorded state of a lab
+func (m *MemoryStatusReporter) LabInstance(labID string) (LabInstanceEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instance, exists := m.instances[labID]
+	if !exists {
+		return LabInstanceEntry{}, false
+	}
+	copied := *instance
+	copied.ProgressLogs = append([]LabProgressEntry(nil), instance.ProgressLogs...)
+	return copied, true
+}
+
+// MonitorEntry returns the activity entry of a lab, if it has been touched
+func (m *MemoryStatusReporter) MonitorEntry(labID string) (LabMonitoringEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, exists := m.monitor[labID]
+	return entry, exists
+}
+
+func (m *MemoryStatusReporter) instance(labID string) *LabInstanceEntry {
+	instance, exists := m.instances[labID]
+	if !exists {
+		now := time.Now().Unix()
+		instance = &LabInstanceEntry{
+			LabID:         labID,
+			CreatedAt:     now,
+			Status:        Active,
+			LastUpdatedAt: now,
+		}
+		m.instances[labID] = instance
+	}
+	return instance
+}
+
+// Record a progress entry in the lab's logs. Unlike the PTY relay the runner leaves the
+// lab's status alone: it reports itself started before the lab is ready.
+func applyProgress(instance *LabInstanceEntry, progress LabProgressEntry) {
+	instance.ProgressLogs = append(instance.ProgressLogs, progress)
+	instance.LastUpdatedAt = progress.Timestamp
+}
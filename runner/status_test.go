@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestProgressLeavesTheLabStatus(t *testing.T) {
+	reporter := NewMemoryStatusReporter()
+	reporter.instances["lab-1"] = &LabInstanceEntry{LabID: "lab-1", Status: Booting}
+
+	reporter.UpdateLabInstanceProgress("lab-1", LabProgressEntry{
+		Timestamp:   42,
+		Status:      Active,
+		Message:     "File System Service Started",
+		ServiceName: FILE_SYSTEM_SERVICE,
+	})
+
+	instance, _ := reporter.LabInstance("lab-1")
+	if instance.Status != Booting {
+		t.Errorf("expected the lab to stay %s; got %s", Booting, instance.Status)
+	}
+	if len(instance.ProgressLogs) != 1 || instance.LastUpdatedAt != 42 {
+		t.Errorf("expected the progress to be logged at 42; got %+v", instance)
+	}
+}
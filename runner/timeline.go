@@ -0,0 +1,352 @@
+package main
+
+// Edit timeline
+//
+// Every file mutation the runner handles is appended to a per-lab timeline so that
+// reviewers can replay how a learner arrived at a solution. `fs_timeline` exports the
+// raw log or reconstructs the workspace at a point in time.
+//
+// Export format (TIMELINE_FORMAT):
+//
+//	{
+//	  "format":    "devsarena.timeline/v1",
+//	  "labId":     "<lab id>",
+//	  "baseTime":  1718000000000,   // unix ms; entries older than this were compacted into "base"
+//	  "base":      { "<path>": <TimelineFile>, ... },
+//	  "entries":   [ <TimelineEntry>, ... ],
+//	  "compacted": 12               // number of entries folded into "base" to respect the caps
+//	}
+//
+// TimelineEntry: {"seq": 3, "ts": 1718000000123, "op": "create|update|rename|delete",
+// "path": "src/App.jsx", "newPath": "...", "isDir": false, "content": "..."}.
+// "newPath" is only set for renames, "content" only for files that were created, updated
+// or renamed.
+//
+// TimelineFile: {"isDir": false, "content": "...", "from": "...", "deleted": false}.
+// "from" means the item is a moved copy of a path from the original boilerplate whose
+// content was never recorded; "deleted" marks a tombstone.
+//
+// Applying "base" and then every entry with ts <= T yields the state of every path the
+// learner touched at time T. Paths that never appear keep their boilerplate content.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TIMELINE_FORMAT = "devsarena.timeline/v1"
+
+const (
+	TIMELINE_OP_CREATE = "create"
+	TIMELINE_OP_UPDATE = "update"
+	TIMELINE_OP_RENAME = "rename"
+	TIMELINE_OP_DELETE = "delete"
+)
+
+type TimelineEntry struct {
+	Seq       int64   `json:"seq"`
+	Timestamp int64   `json:"ts"`
+	Op        string  `json:"op"`
+	Path      string  `json:"path"`
+	NewPath   string  `json:"newPath,omitempty"`
+	IsDir     bool    `json:"isDir,omitempty"`
+	Content   *string `json:"content,omitempty"`
+}
+
+type TimelineFile struct {
+	IsDir   bool   `json:"isDir,omitempty"`
+	Content string `json:"content,omitempty"`
+	From    string `json:"from,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type TimelineExport struct {
+	Format    string                  `json:"format"`
+	LabID     string                  `json:"labId"`
+	BaseTime  int64                   `json:"baseTime"`
+	Base      map[string]TimelineFile `json:"base"`
+	Entries   []TimelineEntry         `json:"entries"`
+	Compacted int                     `json:"compacted"`
+}
+
+type TimelineSnapshot struct {
+	LabID string                  `json:"labId"`
+	At    int64                   `json:"at"`
+	Seq   int64                   `json:"seq"`
+	Files map[string]TimelineFile `json:"files"`
+}
+
+type Timeline struct {
+	labID     string
+	entries   []TimelineEntry
+	bytes     int
+	base      map[string]TimelineFile
+	baseTime  int64
+	compacted int
+	seq       int64
+	// Content hash of the last recorded version of each file, used to skip no-op saves
+	lastHash map[string]uint64
+	mu       sync.Mutex
+}
+
+var (
+	timelines   = make(map[string]*Timeline)
+	timelinesMu sync.Mutex
+)
+
+// Get (or lazily create) the timeline of a lab
+func getTimeline(labID string) *Timeline {
+	timelinesMu.Lock()
+	defer timelinesMu.Unlock()
+
+	timeline, exists := timelines[labID]
+	if !exists {
+		timeline = &Timeline{
+			labID:    labID,
+			base:     make(map[string]TimelineFile),
+			lastHash: make(map[string]uint64),
+		}
+		timelines[labID] = timeline
+	}
+	return timeline
+}
+
+// Record a mutation on the current lab's timeline
+func recordTimelineEvent(op, filePath, newPath string, isDir bool, content *string) {
+	if newPath != "" {
+		newPath = normalizeTimelinePath(newPath)
+	}
+	getTimeline(LAB_ID).Record(op, normalizeTimelinePath(filePath), newPath, isDir, content)
+}
+
+func (t *Timeline) Record(op, path, newPath string, isDir bool, content *string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if op == TIMELINE_OP_UPDATE && content != nil {
+		hash := hashContent(*content)
+		if last, exists := t.lastHash[path]; exists && last == hash {
+			return
+		}
+		t.lastHash[path] = hash
+	}
+
+	switch op {
+	case TIMELINE_OP_CREATE:
+		if content != nil {
+			t.lastHash[path] = hashContent(*content)
+		}
+	case TIMELINE_OP_RENAME:
+		t.lastHash = renameHashes(t.lastHash, path, newPath)
+	case TIMELINE_OP_DELETE:
+		for key := range t.lastHash {
+			if isSameOrChildPath(key, path) {
+				delete(t.lastHash, key)
+			}
+		}
+	}
+
+	t.seq++
+	entry := TimelineEntry{
+		Seq:       t.seq,
+		Timestamp: time.Now().UnixMilli(),
+		Op:        op,
+		Path:      path,
+		NewPath:   newPath,
+		IsDir:     isDir,
+		Content:   content,
+	}
+	t.entries = append(t.entries, entry)
+	t.bytes += entrySize(entry)
+
+	t.compact()
+}
+
+// Fold the oldest entries into the base snapshot until the timeline fits its caps
+func (t *Timeline) compact() {
+	folded := 0
+	for folded < len(t.entries) && (len(t.entries)-folded > TIMELINE_MAX_ENTRIES || t.bytes > TIMELINE_MAX_BYTES) {
+		entry := t.entries[folded]
+		applyTimelineEntry(t.base, entry)
+		t.baseTime = entry.Timestamp
+		t.bytes -= entrySize(entry)
+		folded++
+	}
+
+	if folded > 0 {
+		t.entries = append([]TimelineEntry(nil), t.entries[folded:]...)
+		t.compacted += folded
+	}
+}
+
+func (t *Timeline) Export() TimelineExport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return TimelineExport{
+		Format:    TIMELINE_FORMAT,
+		LabID:     t.labID,
+		BaseTime:  t.baseTime,
+		Base:      copyTimelineFiles(t.base),
+		Entries:   append([]TimelineEntry{}, t.entries...),
+		Compacted: t.compacted,
+	}
+}
+
+// Reconstruct the touched files as they were at the given unix millisecond timestamp
+func (t *Timeline) SnapshotAt(at int64) (TimelineSnapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.compacted > 0 && at < t.baseTime {
+		return TimelineSnapshot{}, fmt.Errorf("timeline before %d has been compacted", t.baseTime)
+	}
+
+	snapshot := TimelineSnapshot{
+		LabID: t.labID,
+		At:    at,
+		Files: copyTimelineFiles(t.base),
+	}
+	for _, entry := range t.entries {
+		if entry.Timestamp > at {
+			break
+		}
+		applyTimelineEntry(snapshot.Files, entry)
+		snapshot.Seq = entry.Seq
+	}
+	return snapshot, nil
+}
+
+func applyTimelineEntry(files map[string]TimelineFile, entry TimelineEntry) {
+	switch entry.Op {
+	case TIMELINE_OP_CREATE, TIMELINE_OP_UPDATE:
+		file := TimelineFile{IsDir: entry.IsDir}
+		if entry.Content != nil {
+			file.Content = *entry.Content
+		}
+		files[entry.Path] = file
+
+	case TIMELINE_OP_DELETE:
+		for path := range files {
+			if isSameOrChildPath(path, entry.Path) {
+				files[path] = TimelineFile{Deleted: true}
+			}
+		}
+		files[entry.Path] = TimelineFile{Deleted: true}
+
+	case TIMELINE_OP_RENAME:
+		moved, tracked := files[entry.Path]
+		for path, file := range files {
+			if path != entry.Path && isSameOrChildPath(path, entry.Path) && !file.Deleted {
+				files[entry.NewPath+strings.TrimPrefix(path, entry.Path)] = file
+				files[path] = TimelineFile{Deleted: true}
+			}
+		}
+
+		switch {
+		case entry.Content != nil:
+			moved = TimelineFile{Content: *entry.Content}
+		case !tracked || moved.Deleted:
+			moved = TimelineFile{IsDir: entry.IsDir, From: entry.Path}
+		}
+		files[entry.NewPath] = moved
+		files[entry.Path] = TimelineFile{Deleted: true}
+	}
+}
+
+// Query or export the edit timeline of the current lab
+func TimelineHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req TimelinePayload
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to unmarshal timeline payload: %w", err)
+		}
+	}
+
+	timeline := getTimeline(LAB_ID)
+	if req.Export {
+		return client.SendResponse(RESPONSE_TIMELINE, timeline.Export())
+	}
+
+	at := req.At
+	if at == 0 {
+		at = time.Now().UnixMilli()
+	}
+
+	snapshot, err := timeline.SnapshotAt(at)
+	if err != nil {
+		return fmt.Errorf("failed to reconstruct workspace: %w", err)
+	}
+
+	return client.SendResponse(RESPONSE_TIMELINE, snapshot)
+}
+
+// Timeline paths are slash separated and relative to the workspace root
+func normalizeTimelinePath(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(filePath)), "/")
+}
+
+func isSameOrChildPath(path, parent string) bool {
+	return path == parent || strings.HasPrefix(path, parent+"/")
+}
+
+func renameHashes(hashes map[string]uint64, oldPath, newPath string) map[string]uint64 {
+	renamed := make(map[string]uint64, len(hashes))
+	for path, hash := range hashes {
+		if isSameOrChildPath(path, oldPath) {
+			path = newPath + strings.TrimPrefix(path, oldPath)
+		}
+		renamed[path] = hash
+	}
+	return renamed
+}
+
+func copyTimelineFiles(files map[string]TimelineFile) map[string]TimelineFile {
+	copied := make(map[string]TimelineFile, len(files))
+	for path, file := range files {
+		copied[path] = file
+	}
+	return copied
+}
+
+func entrySize(entry TimelineEntry) int {
+	size := len(entry.Path) + len(entry.NewPath)
+	if entry.Content != nil {
+		size += len(*entry.Content)
+	}
+	return size
+}
+
+func hashContent(content string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(content))
+	return hash.Sum64()
+}
+
+// Record a rename, capturing file content so the move survives replay even when the
+// original file was never recorded
+func recordRenameInTimeline(oldPath, newPath, targetPath string) {
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		log.Printf("Error getting file info for %s: %v", targetPath, err)
+		return
+	}
+
+	var content *string
+	if !info.IsDir() && info.Size() <= int64(TIMELINE_MAX_BYTES) {
+		if data, err := os.ReadFile(targetPath); err == nil {
+			text := string(data)
+			content = &text
+		}
+	}
+	recordTimelineEvent(TIMELINE_OP_RENAME, oldPath, newPath, info.IsDir(), content)
+}
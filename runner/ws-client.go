@@ -11,7 +11,7 @@ import (
 type Client struct {
 	conn    *websocket.Conn
 	handler *WSManager
-	send    chan WSResponse
+	outbox  *outbox
 	done    chan struct{}
 }
 
@@ -19,7 +19,7 @@ func NewClient(conn *websocket.Conn, handler *WSManager) *Client {
 	return &Client{
 		conn:    conn,
 		handler: handler,
-		send:    make(chan WSResponse, 256),
+		outbox:  newOutbox(CLIENT_QUEUE_SIZE),
 		done:    make(chan struct{}),
 	}
 }
@@ -60,30 +60,53 @@ func (c *Client) readMessages() {
 func (c *Client) writeMessages() {
 	ticker := time.NewTicker(PING_INTERVAL)
 	defer ticker.Stop()
+	// A writer that gives up (write timeout, slow client) takes the reader down with it
+	defer c.conn.Close()
 
 	for {
 		select {
-		case response, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
+		case <-c.outbox.ready:
+			for {
+				response, ok := c.outbox.pop()
+				if !ok {
+					break
+				}
+				if err := c.writeResponse(response); err != nil {
+					log.Printf("Error writing message: %v", err)
+					return
+				}
+			}
+
+			if c.outbox.isDrained() {
+				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			// Marshal the response to JSON
-			data, err := json.Marshal(response)
-			if err != nil {
-				log.Printf("Error marshaling response: %v", err)
-				continue
+			// Let the client know what it missed once it has caught up
+			if stats, dropped := c.outbox.takeDropReport(); dropped {
+				log.Printf("Client dropped %d messages (%d total)", stats.DroppedSinceAck, stats.Dropped)
+				if err := c.writeResponse(WSResponse{
+					Type:      RESPONSE_FLOW_CONTROL,
+					Status:    STATUS_INFO,
+					Message:   "Some messages were dropped because the connection was too slow",
+					Data:      stats,
+					Timestamp: time.Now().Format(time.RFC3339),
+				}); err != nil {
+					log.Printf("Error writing message: %v", err)
+					return
+				}
 			}
 
-			// Send the message
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				log.Printf("Error writing message: %v", err)
+		case <-ticker.C:
+			if SLOW_CLIENT_POLICY == SLOW_CLIENT_POLICY_DISCONNECT && c.outbox.slowFor() > SLOW_CLIENT_TIMEOUT {
+				log.Printf("Disconnecting slow client, send queue full for %v", c.outbox.slowFor())
+				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"))
 				return
 			}
 
-		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Printf("Error sending ping: %v", err)
@@ -96,6 +119,19 @@ func (c *Client) writeMessages() {
 	}
 }
 
+func (c *Client) writeResponse(response WSResponse) error {
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	// Marshal the response to JSON
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		return nil
+	}
+
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
 // SendResponse sends a standardized success response
 func (c *Client) SendResponse(responseType string, data interface{}) error {
 	response := WSResponse{
@@ -105,12 +141,20 @@ func (c *Client) SendResponse(responseType string, data interface{}) error {
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 
-	select {
-	case c.send <- response:
-		return nil
-	default:
-		return log.Output(1, "Send channel is full")
+	return c.outbox.push(response, PRIORITY_REPLY, "")
+}
+
+// SendBroadcast queues a pushed notification. Broadcasts sharing a coalesce key replace each
+// other while queued, and are sent after any pending replies.
+func (c *Client) SendBroadcast(responseType, coalesceKey string, data interface{}) error {
+	response := WSResponse{
+		Type:      responseType,
+		Status:    STATUS_SUCCESS,
+		Data:      data,
+		Timestamp: time.Now().Format(time.RFC3339),
 	}
+
+	return c.outbox.push(response, PRIORITY_BROADCAST, coalesceKey)
 }
 
 // SendError sends a standardized error response
@@ -123,12 +167,7 @@ func (c *Client) SendError(message, details string) error {
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 
-	select {
-	case c.send <- response:
-		return nil
-	default:
-		return log.Output(1, "Send channel is full")
-	}
+	return c.outbox.push(response, PRIORITY_REPLY, "")
 }
 
 // SendInfo sends a standardized info response
@@ -141,17 +180,12 @@ func (c *Client) SendInfo(message string, data interface{}) error {
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 
-	select {
-	case c.send <- response:
-		return nil
-	default:
-		return log.Output(1, "Send channel is full")
-	}
+	return c.outbox.push(response, PRIORITY_REPLY, "")
 }
 
 // Close gracefully closes the client connection
 func (c *Client) Close() {
-	close(c.send)
+	c.outbox.close()
 }
 
 func (c *Client) pongHandler(pongMsg string) error {
@@ -79,6 +79,7 @@ func (m *WSManager) setupHandlers() {
 	m.fsHandlers[FS_EDIT_FILE_META] = EditFileMetaHandler
 	m.fsHandlers[FS_FETCH_QUEST_META] = FetchQuestMetaHandler
 	m.fsHandlers[FS_INITIALIZE_CLIENT] = InitializeClientHandler
+	m.fsHandlers[FS_TIMELINE] = TimelineHandler
 }
 
 func (m *WSManager) routeEvent(event Event, client *Client) error {
@@ -93,7 +94,7 @@ func (m *WSManager) routeEvent(event Event, client *Client) error {
 
 	// Update lab monitor queue with user interaction
 	if LAB_ID != "" {
-		UpdateLabMonitorQueue(LAB_ID)
+		Reporter.UpdateLabMonitorQueue(LAB_ID)
 	}
 
 	// Create a context for the handler
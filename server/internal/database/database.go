@@ -33,6 +33,10 @@ type Service interface {
 	// Quest management
 	AddQuest(req AddQuestRequest) (string, error)
 	DeleteQuest(slug string) error
+
+	// Submissions
+	CreateSubmission(submission *Submission) (bool, error)
+	GetSubmissions(filter SubmissionFilter) ([]Submission, error)
 }
 
 // service implements the Service interface using GORM
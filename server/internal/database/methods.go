@@ -330,6 +330,10 @@ func (s *service) AddQuest(req AddQuestRequest) (string, error) {
 			Description:     cp.Description,
 			Requirements:    pq.StringArray(cp.Requirements),
 			TestingCode:     cp.TestFileUrl,
+			TimeLimitMs:     cp.TimeLimitMs,
+			CPULimitMs:      cp.CPULimitMs,
+			MemoryLimitMB:   cp.MemoryLimitMB,
+			HiddenTests:     cp.HiddenTests,
 			OrderIndex:      &order,
 			BoilerPlateCode: "", // Empty for now
 			QuestID:         questID,
@@ -35,6 +35,12 @@ type CheckpointRequest struct {
 	Description  string   `json:"description"`
 	TestFileUrl  string   `json:"testFileUrl"`
 	Requirements []string `json:"requirements"`
+	// Limits of a test run, 0 for the runner's defaults
+	TimeLimitMs   int `json:"timeLimitMs,omitempty"`
+	CPULimitMs    int `json:"cpuLimitMs,omitempty"`
+	MemoryLimitMB int `json:"memoryLimitMb,omitempty"`
+	// Report only pass/fail counts of the checkpoint's tests
+	HiddenTests bool `json:"hiddenTests,omitempty"`
 }
 
 // Quest represents a quest entity.
@@ -57,6 +63,9 @@ type Quest struct {
 	Checkpoints     []Checkpoint   `json:"checkpoints,omitempty" gorm:"foreignKey:QuestID"`
 	CreatedAt       time.Time      `json:"created_at"`
 	UpdatedAt       time.Time      `json:"updated_at"`
+
+	// Privacy flag: whether terminal sessions of this quest's labs are recorded
+	RecordTerminalSessions bool `json:"record_terminal_sessions" gorm:"default:false"`
 }
 
 // QuestMeta represents quest metadata for listing (without heavy data)
@@ -128,6 +137,14 @@ type Checkpoint struct {
 	QuestID         uuid.UUID      `json:"quest_id"`
 	CreatedAt       time.Time      `json:"created_at"`
 	UpdatedAt       time.Time      `json:"updated_at"`
+
+	// Limits of a test run of the checkpoint, 0 for the runner's defaults
+	TimeLimitMs   int `json:"time_limit_ms,omitempty"`   // Wall-clock
+	CPULimitMs    int `json:"cpu_limit_ms,omitempty"`    // CPU time of the test processes
+	MemoryLimitMB int `json:"memory_limit_mb,omitempty"` // Resident memory of the test processes
+
+	// Results of the checkpoint's test suite only tell how many tests passed
+	HiddenTests bool `json:"hidden_tests" gorm:"default:false"`
 }
 
 // Hint represents a hint entity.
@@ -158,8 +175,24 @@ type Submission struct {
 	IsSuccess       bool      `json:"is_success"`
 	TestcasesPassed int       `json:"testcases_passed"`
 	TestcasesTotal  int       `json:"testcases_total"`
-	CheckpointID    uuid.UUID `json:"checkpoint_id"`
-	UserID          uuid.UUID `json:"user_id"`
+	CheckpointID    uuid.UUID `json:"checkpoint_id" gorm:"type:uuid;index"`
+	UserID          uuid.UUID `json:"user_id" gorm:"type:uuid;index"`
+
+	// Checkpoint test runs reported by the PTY relay of a lab
+	RunID      string `json:"run_id" gorm:"uniqueIndex"`
+	LabID      string `json:"lab_id" gorm:"index"`
+	Checkpoint int    `json:"checkpoint"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Hidden     bool   `json:"hidden"` // The run had hidden tests, Message has no details
+}
+
+// SubmissionFilter selects submissions, empty fields match everything
+type SubmissionFilter struct {
+	UserID       *uuid.UUID
+	CheckpointID *uuid.UUID
+	LabID        string
+	Limit        int
 }
 
 // Testcase represents a testcase entity.
@@ -169,12 +202,34 @@ type Testcase struct {
 	Output       string    `json:"output"`
 	Message      string    `json:"message"`
 	IsPassed     bool      `json:"is_passed"`
+	Hidden       bool      `json:"hidden" gorm:"default:false"` // Only counted in results
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	CheckpointID uuid.UUID `json:"checkpoint_id"`
 	QuestID      uuid.UUID `json:"quest_id"`
 }
 
+// RedactHiddenTests blanks what learners may not see, for responses they can: the input,
+// output and message of hidden testcases, the test code of checkpoints with hidden tests and
+// the final suite, which only the lab's grader runs
+func (q *Quest) RedactHiddenTests() {
+	redact := func(testcases []Testcase) {
+		for i := range testcases {
+			if testcases[i].Hidden {
+				testcases[i].Input, testcases[i].Output, testcases[i].Message = "", "", ""
+			}
+		}
+	}
+	redact(q.FinalTestCases)
+	q.FinalTestCode = ""
+	for i := range q.Checkpoints {
+		redact(q.Checkpoints[i].Testcases)
+		if q.Checkpoints[i].HiddenTests {
+			q.Checkpoints[i].TestingCode = ""
+		}
+	}
+}
+
 func Init() error {
 	database := dbInstance.db
 	err := database.AutoMigrate(
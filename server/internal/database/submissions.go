@@ -0,0 +1,66 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxSubmissionsPerQuery = 500
+
+// CreateSubmission stores a submission once per RunID. It reports whether the row was
+// created; for a RunID seen before, submission is replaced by the stored row.
+func (s *service) CreateSubmission(submission *Submission) (bool, error) {
+	if submission.ID == uuid.Nil {
+		submission.ID = uuid.New()
+	}
+	if submission.SubmittedOn.IsZero() {
+		submission.SubmittedOn = time.Now()
+	}
+
+	result := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "run_id"}},
+		DoNothing: true,
+	}).Create(submission)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	if err := s.db.First(submission, "run_id = ?", submission.RunID).Error; err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// GetSubmissions returns the matching submissions, newest first
+func (s *service) GetSubmissions(filter SubmissionFilter) ([]Submission, error) {
+	return QuerySubmissions(s.db, filter)
+}
+
+// QuerySubmissions is GetSubmissions for callers with their own connection
+func QuerySubmissions(db *gorm.DB, filter SubmissionFilter) ([]Submission, error) {
+	query := db.Model(&Submission{})
+	if filter.UserID != nil {
+		query = query.Where("user_id = ?", *filter.UserID)
+	}
+	if filter.CheckpointID != nil {
+		query = query.Where("checkpoint_id = ?", *filter.CheckpointID)
+	}
+	if filter.LabID != "" {
+		query = query.Where("lab_id = ?", filter.LabID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > maxSubmissionsPerQuery {
+		limit = maxSubmissionsPerQuery
+	}
+
+	submissions := []Submission{}
+	err := query.Order("submitted_on DESC").Limit(limit).Find(&submissions).Error
+	return submissions, err
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+
+	"lms_v0/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Terminal session recordings are asciicast v2 files uploaded by the PTY relay of labs
+// whose quest has RecordTerminalSessions set. They live under recordings/<labId>/. They hold
+// every keystroke, typed secrets included, so every endpoint takes the lab's API secret.
+
+const (
+	recordingContentType = "application/x-asciicast"
+	// The relay stops recording a session at 20 MB of events, the header and the last event
+	// may go over
+	maxRecordingBytes = 24 * 1024 * 1024
+)
+
+var (
+	recordingLabIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+	recordingNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}\.cast$`)
+)
+
+type Recording struct {
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	LastModified int64  `json:"lastModified"`
+}
+
+func recordingKey(labID, name string) string {
+	return fmt.Sprintf("recordings/%s/%s", labID, name)
+}
+
+func writeRecordingError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   message,
+	})
+}
+
+// CreateRecordingUploadUrl issues a presigned PUT URL for a recording of a running lab
+func (s *Server) CreateRecordingUploadUrl(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	labID := httprouter.ParamsFromContext(r.Context()).ByName("labId")
+	if !recordingLabIDPattern.MatchString(labID) {
+		writeRecordingError(w, http.StatusBadRequest, "Invalid labId")
+		return
+	}
+	if !authorizeLab(r, labID) {
+		writeRecordingError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"` // Bytes, the upload URL only takes exactly this many
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*1024)).Decode(&req); err != nil || !recordingNamePattern.MatchString(req.Name) {
+		writeRecordingError(w, http.StatusBadRequest, "Invalid recording name")
+		return
+	}
+	if req.Size < 1 || req.Size > maxRecordingBytes {
+		writeRecordingError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Recording size must be between 1 and %d bytes", maxRecordingBytes))
+		return
+	}
+
+	// Only labs that are still known may upload
+	if _, err := utils.RedisUtilsInstance.GetLabInstance(labID); err != nil {
+		writeRecordingError(w, http.StatusNotFound, "Lab not found")
+		return
+	}
+
+	key := recordingKey(labID, req.Name)
+	url, err := utils.GeneratePresignedUploadUrl(os.Getenv("AWS_S3_BUCKET_NAME"), key, recordingContentType, req.Size)
+	if err != nil {
+		log.Printf("Failed to presign recording upload %s: %v", key, err)
+		writeRecordingError(w, http.StatusInternalServerError, "Failed to create upload URL")
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"url":     url,
+		"key":     key,
+	})
+}
+
+// ListRecordings returns the recordings of a lab, newest first
+func (s *Server) ListRecordings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	labID := httprouter.ParamsFromContext(r.Context()).ByName("labId")
+	if !recordingLabIDPattern.MatchString(labID) {
+		writeRecordingError(w, http.StatusBadRequest, "Invalid labId")
+		return
+	}
+	if !authorizeLab(r, labID) {
+		writeRecordingError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	objects, err := utils.ListS3Objects(os.Getenv("AWS_S3_BUCKET_NAME"), recordingKey(labID, ""))
+	if err != nil {
+		log.Printf("Failed to list recordings for lab %s: %v", labID, err)
+		writeRecordingError(w, http.StatusInternalServerError, "Failed to list recordings")
+		return
+	}
+
+	recordings := make([]Recording, 0, len(objects))
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if !recordingNamePattern.MatchString(name) {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			Name:         name,
+			Size:         object.Size,
+			LastModified: object.LastModified.Unix(),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].LastModified > recordings[j].LastModified
+	})
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"labId":      labID,
+		"recordings": recordings,
+	})
+}
+
+// GetRecording redirects to a presigned URL of the recording, so players can load it directly
+func (s *Server) GetRecording(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	labID := params.ByName("labId")
+	name := params.ByName("name")
+	if !recordingLabIDPattern.MatchString(labID) || !recordingNamePattern.MatchString(name) {
+		w.Header().Set("Content-Type", "application/json")
+		writeRecordingError(w, http.StatusBadRequest, "Invalid labId or recording name")
+		return
+	}
+	if !authorizeLab(r, labID) {
+		w.Header().Set("Content-Type", "application/json")
+		writeRecordingError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	url, err := utils.GeneratePresignedUrl(os.Getenv("AWS_S3_BUCKET_NAME"), recordingKey(labID, name))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeRecordingError(w, http.StatusInternalServerError, "Failed to create download URL")
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
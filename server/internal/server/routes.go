@@ -6,10 +6,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"lms_v0/internal/database"
+	"lms_v0/internal/testresults"
 	"lms_v0/k8s"
 	"lms_v0/utils"
 
@@ -40,6 +42,15 @@ func (s *Server) RegisterRoutes() http.Handler {
 	r.HandlerFunc(http.MethodGet, "/v1/experimental/quest/:questSlug/checkpoints", s.GetQuestCheckpoints)
 	r.HandlerFunc(http.MethodGet, "/v1/test-results/:labId", s.GetTestResults)
 
+	// Terminal session recordings
+	r.HandlerFunc(http.MethodPost, "/v1/recordings/:labId/upload-url", s.CreateRecordingUploadUrl)
+	r.HandlerFunc(http.MethodGet, "/v1/recordings/:labId", s.ListRecordings)
+	r.HandlerFunc(http.MethodGet, "/v1/recordings/:labId/:name", s.GetRecording)
+
+	// Checkpoint test runs
+	r.HandlerFunc(http.MethodPost, "/v1/submissions/:labId", s.CreateSubmission)
+	r.HandlerFunc(http.MethodGet, "/v1/submissions", s.ListSubmissions)
+
 	// Project management endpoints
 	r.HandlerFunc(http.MethodGet, "/v0/project/options", s.GetProjectOptions)
 	r.HandlerFunc(http.MethodPost, "/v0/project/add", s.AddProjectHandler)
@@ -204,6 +215,7 @@ type StartQuestRequest struct {
 	Language    string `json:"language"`
 	ProjectSlug string `json:"projectSlug"`
 	LabID       string `json:"labId"`
+	UserID      string `json:"userId,omitempty"` // Owner of the lab's submissions
 }
 
 // StartQuestResponse represents the response payload for starting a quest
@@ -250,6 +262,16 @@ func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := uuid.Parse(req.UserID); req.UserID != "" && err != nil {
+		response := StartQuestResponse{
+			Success: false,
+			Error:   "Invalid userId parameter",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Generate LabID if not provided
 	if req.LabID == "" {
 		req.LabID = uuid.New().String()
@@ -310,10 +332,17 @@ func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
 		ProjectSlug:           req.ProjectSlug,
 		S3Bucket:              os.Getenv("AWS_S3_BUCKET_NAME"),
 		BoilerplateKey:        quest.BoilerPlateCode, // URL from database
-		TestFilesKey:          "",                    // Will be set automatically to devsarena/projects/{projectSlug}/tests/
+		TestFilesKey:          "",                    // Will be set automatically to projects/{projectSlug}/tests/
 		Namespace:             "devsarena",
 		ShouldCreateNamespace: true,
+		RecordSessions:        quest.RecordTerminalSessions,
+		APIBaseURL:            os.Getenv("API_INTERNAL_URL"),
 	}
+	questParams.SetFinalTests(quest)
+	questParams.SetJudgeTests(quest)
+	questParams.SetTestLimits(quest)
+	questParams.SetHiddenTests(quest)
+	questParams.SetTestBundles(quest)
 
 	// Create lab instance in Redis
 	labInstance := utils.LabInstanceEntry{
@@ -324,6 +353,8 @@ func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
 		LastUpdatedAt:  time.Now().Unix(),
 		ProgressLogs:   []utils.LabProgressEntry{},
 		DirtyReadPaths: []string{},
+		UserID:         req.UserID,
+		QuestSlug:      req.ProjectSlug,
 	}
 	utils.RedisUtilsInstance.CreateLabInstance(labInstance)
 
@@ -411,6 +442,7 @@ func (s *Server) GetQuestsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Quest not found", http.StatusNotFound)
 		return
 	}
+	quest.RedactHiddenTests()
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(quest); err != nil {
 		log.Printf("error encoding quest response: %v", err)
@@ -666,6 +698,7 @@ func (s *Server) GetExperimentalQuestMetadata(w http.ResponseWriter, r *http.Req
 		http.Error(w, "Quest not found", http.StatusNotFound)
 		return
 	}
+	quest.RedactHiddenTests()
 
 	// Format response for experimental IDE
 	response := map[string]interface{}{
@@ -708,15 +741,39 @@ func (s *Server) GetQuestCheckpoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// With ?labId= the statuses come from the lab's test history
+	var progress []testresults.CheckpointProgress
+	if labID := r.URL.Query().Get("labId"); labID != "" {
+		if !recordingLabIDPattern.MatchString(labID) {
+			http.Error(w, "Invalid labId", http.StatusBadRequest)
+			return
+		}
+		summary, _, err := testresults.Load(labID, 0, s.db.GetSubmissions)
+		if err != nil {
+			log.Printf("Failed to load test results of lab %s: %v", labID, err)
+			http.Error(w, "Failed to load lab progress", http.StatusInternalServerError)
+			return
+		}
+		progress = testresults.QuestProgress(len(quest.Checkpoints), summary)
+	}
+
 	checkpoints := make([]map[string]interface{}, len(quest.Checkpoints))
 	for i, checkpoint := range quest.Checkpoints {
 		checkpoints[i] = map[string]interface{}{
-			"id":           fmt.Sprintf("%d", i+1),
+			"id":           checkpoint.ID.String(),
+			"number":       i + 1,
 			"title":        checkpoint.Title,
 			"description":  checkpoint.Description,
 			"requirements": checkpoint.Requirements,
 			"status":       "pending",
 		}
+		if progress != nil {
+			checkpoints[i]["status"] = progress[i].Status
+			checkpoints[i]["attempts"] = progress[i].Attempts
+			checkpoints[i]["latestStatus"] = progress[i].LatestStatus
+			checkpoints[i]["firstPassedAt"] = progress[i].FirstPassedAt
+			checkpoints[i]["lastAttemptAt"] = progress[i].LastAttemptAt
+		}
 	}
 
 	response := map[string]interface{}{
@@ -728,22 +785,41 @@ func (s *Server) GetQuestCheckpoints(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetTestResults returns test results for a lab
+// GetTestResults returns the test history of a lab per checkpoint, from the lab's Redis
+// state and its stored submissions. ?checkpoint=<n> limits it to one checkpoint.
 func (s *Server) GetTestResults(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(pathParts) < 3 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	labID := httprouter.ParamsFromContext(r.Context()).ByName("labId")
+	if !recordingLabIDPattern.MatchString(labID) {
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid labId")
 		return
 	}
-	labID := pathParts[2]
 
-	response := map[string]interface{}{
-		"success": true,
-		"labId":   labID,
-		"results": map[string]interface{}{},
+	checkpoint := 0
+	if value := r.URL.Query().Get("checkpoint"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeSubmissionError(w, http.StatusBadRequest, "Invalid checkpoint")
+			return
+		}
+		checkpoint = parsed
 	}
 
-	json.NewEncoder(w).Encode(response)
+	summary, found, err := testresults.Load(labID, checkpoint, s.db.GetSubmissions)
+	if err != nil {
+		log.Printf("Failed to load test results of lab %s: %v", labID, err)
+		writeSubmissionError(w, http.StatusInternalServerError, "Failed to load test results")
+		return
+	}
+	if !found {
+		writeSubmissionError(w, http.StatusNotFound, "Lab not found")
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"labId":   labID,
+		"results": summary,
+	})
 }
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"lms_v0/internal/database"
+	"lms_v0/utils"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Checkpoint test runs are reported by the PTY relay of a lab as they complete and stored
+// as Submission rows, which outlive the lab's Redis state. The relay retries, a run is
+// stored once per runId.
+
+var submissionRunIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+type CreateSubmissionRequest struct {
+	RunID       string `json:"runId"`
+	Checkpoint  int    `json:"checkpoint"`
+	Status      string `json:"status"` // PASSED, FAILED_ASSERTION, FAILED_RUNTIME or a *_LIMIT_EXCEEDED
+	TestsPassed int    `json:"testsPassed"`
+	TestsTotal  int    `json:"testsTotal"`
+	DurationMs  int64  `json:"durationMs"`
+	Message     string `json:"message"`
+	Hidden      bool   `json:"hidden"`      // The run had hidden tests
+	SubmittedAt int64  `json:"submittedAt"` // Unix seconds, when the run completed
+}
+
+var submissionStatuses = map[string]bool{
+	"PASSED":           true,
+	"FAILED_ASSERTION": true,
+	"FAILED_RUNTIME":   true,
+	// The run was killed for going over a limit of its checkpoint
+	"TIME_LIMIT_EXCEEDED":   true,
+	"MEMORY_LIMIT_EXCEEDED": true,
+}
+
+// authorizeLab reports whether the request carries the API secret of the lab, which only its
+// PTY relay has
+func authorizeLab(r *http.Request, labID string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && utils.RedisUtilsInstance.CheckLabSecret(labID, strings.TrimSpace(token))
+}
+
+func writeSubmissionError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   message,
+	})
+}
+
+// CreateSubmission stores a checkpoint test run of a running lab
+func (s *Server) CreateSubmission(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	labID := httprouter.ParamsFromContext(r.Context()).ByName("labId")
+	if !recordingLabIDPattern.MatchString(labID) {
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid labId")
+		return
+	}
+	if !authorizeLab(r, labID) {
+		writeSubmissionError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req CreateSubmissionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	switch {
+	case !submissionRunIDPattern.MatchString(req.RunID):
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid runId")
+		return
+	case req.Checkpoint < 1:
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid checkpoint")
+		return
+	case !submissionStatuses[req.Status]:
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid status")
+		return
+	case req.TestsPassed < 0 || req.TestsTotal < req.TestsPassed:
+		writeSubmissionError(w, http.StatusBadRequest, "Invalid test counts")
+		return
+	}
+
+	instance, err := utils.RedisUtilsInstance.GetLabInstance(labID)
+	if err != nil {
+		writeSubmissionError(w, http.StatusNotFound, "Lab not found")
+		return
+	}
+	if instance.QuestSlug == "" {
+		writeSubmissionError(w, http.StatusConflict, "Lab is not a quest lab")
+		return
+	}
+
+	quest, err := s.db.GetQuestBySlug(instance.QuestSlug)
+	if err != nil {
+		writeSubmissionError(w, http.StatusNotFound, "Quest not found")
+		return
+	}
+	if req.Checkpoint > len(quest.Checkpoints) {
+		writeSubmissionError(w, http.StatusBadRequest, "Quest has no such checkpoint")
+		return
+	}
+
+	submission := database.Submission{
+		RunID:           req.RunID,
+		LabID:           labID,
+		Checkpoint:      req.Checkpoint,
+		CheckpointID:    quest.Checkpoints[req.Checkpoint-1].ID,
+		Status:          req.Status,
+		IsSuccess:       req.Status == "PASSED",
+		TestcasesPassed: req.TestsPassed,
+		TestcasesTotal:  req.TestsTotal,
+		DurationMs:      req.DurationMs,
+		Message:         req.Message,
+		Hidden:          req.Hidden,
+	}
+	if userID, err := uuid.Parse(instance.UserID); err == nil {
+		submission.UserID = userID
+	}
+	if req.SubmittedAt > 0 {
+		submission.SubmittedOn = time.Unix(req.SubmittedAt, 0)
+	}
+
+	created, err := s.db.CreateSubmission(&submission)
+	if err != nil {
+		log.Printf("Failed to store submission %s of lab %s: %v", req.RunID, labID, err)
+		writeSubmissionError(w, http.StatusInternalServerError, "Failed to store submission")
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"created":    created,
+		"submission": submission,
+	})
+}
+
+// ListSubmissions returns submissions filtered by userId, checkpointId and labId, newest
+// first. At least one filter is required.
+func (s *Server) ListSubmissions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	filter := database.SubmissionFilter{LabID: query.Get("labId")}
+	if value := query.Get("userId"); value != "" {
+		userID, err := uuid.Parse(value)
+		if err != nil {
+			writeSubmissionError(w, http.StatusBadRequest, "Invalid userId")
+			return
+		}
+		filter.UserID = &userID
+	}
+	if value := query.Get("checkpointId"); value != "" {
+		checkpointID, err := uuid.Parse(value)
+		if err != nil {
+			writeSubmissionError(w, http.StatusBadRequest, "Invalid checkpointId")
+			return
+		}
+		filter.CheckpointID = &checkpointID
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeSubmissionError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		filter.Limit = limit
+	}
+	if filter.UserID == nil && filter.CheckpointID == nil && filter.LabID == "" {
+		writeSubmissionError(w, http.StatusBadRequest, "Missing userId, checkpointId or labId")
+		return
+	}
+
+	submissions, err := s.db.GetSubmissions(filter)
+	if err != nil {
+		log.Printf("Failed to list submissions: %v", err)
+		writeSubmissionError(w, http.StatusInternalServerError, "Failed to list submissions")
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"submissions": submissions,
+	})
+}
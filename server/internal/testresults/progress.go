@@ -0,0 +1,60 @@
+package testresults
+
+// Statuses of a quest's checkpoints in a lab
+const (
+	StatusLocked = "locked" // Not reached yet
+	StatusActive = "active" // The one to work on, not tested yet
+	StatusPassed = "passed"
+	StatusFailed = "failed" // Tested, never passed
+)
+
+type CheckpointProgress struct {
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	LatestStatus  string `json:"latestStatus,omitempty"`
+	FirstPassedAt int64  `json:"firstPassedAt,omitempty"`
+	LastAttemptAt int64  `json:"lastAttemptAt,omitempty"`
+}
+
+// QuestProgress returns the progress of checkpoints 1 to count of a quest. The active
+// checkpoint is the lab's ActiveCheckpoint while the lab is up, otherwise the first one
+// not passed.
+func QuestProgress(count int, summary Summary) []CheckpointProgress {
+	results := map[int]CheckpointResult{}
+	for _, result := range summary.Checkpoints {
+		results[result.Checkpoint] = result
+	}
+
+	active := summary.ActiveCheckpoint
+	if !summary.LabActive || active < 1 {
+		active = 1
+		for results[active].Passed {
+			active++
+		}
+	}
+
+	progress := make([]CheckpointProgress, count)
+	for i := range progress {
+		checkpoint := i + 1
+		result := results[checkpoint]
+
+		status := StatusLocked
+		switch {
+		case summary.Completed || result.Passed || checkpoint < active:
+			status = StatusPassed
+		case result.Attempts > 0:
+			status = StatusFailed
+		case checkpoint == active:
+			status = StatusActive
+		}
+
+		progress[i] = CheckpointProgress{
+			Status:        status,
+			Attempts:      result.Attempts,
+			LatestStatus:  result.LatestStatus,
+			FirstPassedAt: result.FirstPassedAt,
+			LastAttemptAt: result.LastAttemptAt,
+		}
+	}
+	return progress
+}
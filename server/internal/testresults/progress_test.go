@@ -0,0 +1,81 @@
+package testresults
+
+import (
+	"strings"
+	"testing"
+)
+
+// The statuses of a quest's checkpoints, comma separated
+func progressStatuses(progress []CheckpointProgress) string {
+	statuses := make([]string, len(progress))
+	for i, checkpoint := range progress {
+		statuses[i] = checkpoint.Status
+	}
+	return strings.Join(statuses, ",")
+}
+
+func passedResult(checkpoint int) CheckpointResult {
+	return CheckpointResult{Checkpoint: checkpoint, LatestStatus: statusPassed, Passed: true, Attempts: 1, FirstPassedAt: 100, LastAttemptAt: 100}
+}
+
+func failedResult(checkpoint, attempts int) CheckpointResult {
+	return CheckpointResult{Checkpoint: checkpoint, LatestStatus: "FAILED_ASSERTION", Attempts: attempts, LastAttemptAt: 200}
+}
+
+func TestQuestProgressOfAFreshLab(t *testing.T) {
+	progress := QuestProgress(3, Summary{LabActive: true, ActiveCheckpoint: 1})
+	if got := progressStatuses(progress); got != "active,locked,locked" {
+		t.Errorf("expected active,locked,locked; got %s", got)
+	}
+	if len(QuestProgress(0, Summary{LabActive: true, ActiveCheckpoint: 1})) != 0 {
+		t.Errorf("expected no progress for a quest without checkpoints")
+	}
+}
+
+func TestQuestProgressPassesCheckpointsBeforeTheActiveOne(t *testing.T) {
+	// Checkpoints the lab moved past count as passed, tested or not
+	progress := QuestProgress(4, Summary{LabActive: true, ActiveCheckpoint: 3})
+	if got := progressStatuses(progress); got != "passed,passed,active,locked" {
+		t.Errorf("expected passed,passed,active,locked; got %s", got)
+	}
+	if progress[0].Attempts != 0 || progress[0].FirstPassedAt != 0 {
+		t.Errorf("expected no attempt for checkpoint 1; got %+v", progress[0])
+	}
+}
+
+func TestQuestProgressOfTestedCheckpoints(t *testing.T) {
+	summary := Summary{LabActive: true, ActiveCheckpoint: 2, Checkpoints: []CheckpointResult{passedResult(1), failedResult(2, 2)}}
+	progress := QuestProgress(3, summary)
+	if got := progressStatuses(progress); got != "passed,failed,locked" {
+		t.Errorf("expected passed,failed,locked; got %s", got)
+	}
+	if progress[1].Attempts != 2 || progress[1].LatestStatus != "FAILED_ASSERTION" || progress[1].LastAttemptAt != 200 {
+		t.Errorf("expected checkpoint 2 to carry its attempts; got %+v", progress[1])
+	}
+
+	// A checkpoint passed ahead of the active one stays passed
+	summary = Summary{LabActive: true, ActiveCheckpoint: 1, Checkpoints: []CheckpointResult{passedResult(3)}}
+	if got := progressStatuses(QuestProgress(3, summary)); got != "active,locked,passed" {
+		t.Errorf("expected active,locked,passed; got %s", got)
+	}
+}
+
+func TestQuestProgressOfAnEndedLab(t *testing.T) {
+	// Without the lab the active checkpoint is the first one not passed
+	summary := Summary{ActiveCheckpoint: 1, Checkpoints: []CheckpointResult{passedResult(1), passedResult(2)}}
+	if got := progressStatuses(QuestProgress(3, summary)); got != "passed,passed,active" {
+		t.Errorf("expected passed,passed,active; got %s", got)
+	}
+
+	summary = Summary{Checkpoints: []CheckpointResult{failedResult(1, 4)}}
+	if got := progressStatuses(QuestProgress(2, summary)); got != "failed,locked" {
+		t.Errorf("expected failed,locked; got %s", got)
+	}
+}
+
+func TestQuestProgressOfACompletedQuest(t *testing.T) {
+	summary := Summary{LabActive: true, ActiveCheckpoint: 2, Completed: true, Checkpoints: []CheckpointResult{failedResult(2, 1)}}
+	if got := progressStatuses(QuestProgress(2, summary)); got != "passed,passed" {
+		t.Errorf("expected every checkpoint passed; got %s", got)
+	}
+}
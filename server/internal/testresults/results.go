@@ -0,0 +1,266 @@
+// Package testresults combines the test history a lab keeps in Redis with the submissions
+// stored in Postgres into one result per checkpoint. Redis has the details of recent runs
+// while the lab is up, submissions outlive it.
+package testresults
+
+import (
+	"errors"
+	"sort"
+
+	"lms_v0/internal/database"
+	"lms_v0/utils"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const statusPassed = "PASSED"
+
+// Failure details of the last failed attempt of a checkpoint
+type Failure struct {
+	RunID       string `json:"runId,omitempty"`
+	Status      string `json:"status"`
+	CompletedAt int64  `json:"completedAt,omitempty"`
+	Scenario    string `json:"scenario,omitempty"`
+	Expected    string `json:"expected,omitempty"`
+	Received    string `json:"received,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+	Message     string `json:"message,omitempty"`
+	// Expected and actual values with their diff and the failing line, for failed assertions
+	Assertion *Assertion `json:"assertion,omitempty"`
+	// Set for runs with hidden tests, which have no details
+	Hidden      bool `json:"hidden,omitempty"`
+	TestsPassed int  `json:"testsPassed,omitempty"`
+	TestsTotal  int  `json:"testsTotal,omitempty"`
+}
+
+type Assertion struct {
+	Kind     string          `json:"kind"` // string, object or value
+	Expected string          `json:"expected"`
+	Actual   string          `json:"actual"`
+	Diff     []DiffLine      `json:"diff,omitempty"`
+	Location *SourceLocation `json:"location,omitempty"`
+	Hint     string          `json:"hint,omitempty"`
+}
+
+type DiffLine struct {
+	Op   string `json:"op"` // equal, delete (only in expected) or insert (only in actual)
+	Text string `json:"text"`
+}
+
+// A place in the learner's code, relative to the workspace
+type SourceLocation struct {
+	File   string `json:"file"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+type CheckpointResult struct {
+	Checkpoint     int      `json:"checkpoint"`
+	CheckpointID   string   `json:"checkpointId,omitempty"`
+	LatestStatus   string   `json:"latestStatus"`
+	Passed         bool     `json:"passed"` // Passed at least once
+	Attempts       int      `json:"attempts"`
+	FirstPassedAt  int64    `json:"firstPassedAt,omitempty"` // Unix seconds
+	LastAttemptAt  int64    `json:"lastAttemptAt,omitempty"`
+	LastDurationMs int64    `json:"lastDurationMs"`
+	LastFailure    *Failure `json:"lastFailure,omitempty"`
+}
+
+type Summary struct {
+	LabID            string             `json:"labId"`
+	LabActive        bool               `json:"labActive"` // The lab's Redis state still exists
+	ActiveCheckpoint int                `json:"activeCheckpoint,omitempty"`
+	Completed        bool               `json:"completed"`
+	Checkpoints      []CheckpointResult `json:"checkpoints"`
+}
+
+// One test run, from either source
+type attempt struct {
+	runID        string
+	checkpoint   int
+	checkpointID string
+	status       string
+	completedAt  int64
+	durationMs   int64
+	failure      *Failure
+}
+
+// Load reads the Redis state and the submissions of a lab and aggregates them. found is
+// false when the lab has neither.
+func Load(labID string, checkpoint int, submissions func(database.SubmissionFilter) ([]database.Submission, error)) (summary Summary, found bool, err error) {
+	instance, err := utils.RedisUtilsInstance.GetLabInstance(labID)
+	if errors.Is(err, redis.Nil) {
+		instance, err = nil, nil
+	}
+	if err != nil {
+		return Summary{}, false, err
+	}
+
+	stored, err := submissions(database.SubmissionFilter{LabID: labID})
+	if err != nil {
+		return Summary{}, false, err
+	}
+
+	summary = Aggregate(labID, instance, stored, checkpoint)
+	return summary, instance != nil || len(stored) > 0, nil
+}
+
+// Aggregate groups the runs of a lab by checkpoint, ordered by checkpoint. instance is nil
+// once the lab is gone. A run found in both sources counts once. checkpoint > 0 keeps only
+// that checkpoint.
+func Aggregate(labID string, instance *utils.LabInstanceEntry, submissions []database.Submission, checkpoint int) Summary {
+	summary := Summary{LabID: labID, Checkpoints: []CheckpointResult{}}
+
+	attempts := []attempt{}
+	seen := map[string]int{}
+	if instance != nil {
+		summary.LabActive = true
+		summary.ActiveCheckpoint = instance.ActiveCheckpoint
+		summary.Completed = instance.Completed
+
+		for _, result := range instance.TestResults {
+			if result.RunID != "" {
+				seen[result.RunID] = len(attempts)
+			}
+			attempts = append(attempts, fromLab(result))
+		}
+	}
+
+	for _, submission := range submissions {
+		if i, ok := seen[submission.RunID]; ok && submission.RunID != "" {
+			// Redis has the details, the submission knows the checkpoint's id
+			attempts[i].checkpointID = checkpointID(submission)
+			continue
+		}
+		attempts = append(attempts, fromSubmission(submission))
+	}
+
+	// Runs of older relays have no time and come first, as they did in Redis
+	sort.SliceStable(attempts, func(i, j int) bool {
+		return attempts[i].completedAt < attempts[j].completedAt
+	})
+
+	byCheckpoint := map[int]*CheckpointResult{}
+	for _, run := range attempts {
+		if checkpoint > 0 && run.checkpoint != checkpoint {
+			continue
+		}
+
+		result, ok := byCheckpoint[run.checkpoint]
+		if !ok {
+			result = &CheckpointResult{Checkpoint: run.checkpoint}
+			byCheckpoint[run.checkpoint] = result
+		}
+		if run.checkpointID != "" {
+			result.CheckpointID = run.checkpointID
+		}
+
+		result.Attempts++
+		result.LatestStatus = run.status
+		result.LastDurationMs = run.durationMs
+		if run.completedAt > 0 {
+			result.LastAttemptAt = run.completedAt
+		}
+		if run.status == statusPassed {
+			if !result.Passed {
+				result.FirstPassedAt = run.completedAt
+			}
+			result.Passed = true
+		} else if run.failure != nil {
+			result.LastFailure = run.failure
+		}
+	}
+
+	for _, result := range byCheckpoint {
+		summary.Checkpoints = append(summary.Checkpoints, *result)
+	}
+	sort.Slice(summary.Checkpoints, func(i, j int) bool {
+		return summary.Checkpoints[i].Checkpoint < summary.Checkpoints[j].Checkpoint
+	})
+	return summary
+}
+
+func fromLab(result utils.LabTestResult) attempt {
+	run := attempt{
+		runID:       result.RunID,
+		checkpoint:  result.Checkpoint,
+		status:      result.Status,
+		completedAt: result.CompletedAt,
+		durationMs:  result.DurationMs,
+	}
+	if result.Status != statusPassed {
+		run.failure = &Failure{RunID: result.RunID, Status: result.Status, CompletedAt: result.CompletedAt, Hidden: result.Hidden}
+		if result.Tests != nil {
+			run.failure.TestsPassed, run.failure.TestsTotal = result.Tests.Passed, result.Tests.Total
+		}
+		if result.Error != nil {
+			run.failure.Scenario = result.Error.Scenario
+			run.failure.Expected = result.Error.Expected
+			run.failure.Received = result.Error.Received
+			run.failure.Hint = result.Error.Hint
+			run.failure.Message = result.Error.Message
+			run.failure.Assertion = fromLabAssertion(result.Error.Assertion)
+		}
+		if result.Hidden {
+			// The relay leaves these out, in case an older one did not
+			run.failure.Scenario, run.failure.Expected, run.failure.Received = "", "", ""
+			run.failure.Assertion = nil
+		}
+	}
+	return run
+}
+
+func fromLabAssertion(assertion *utils.LabAssertion) *Assertion {
+	if assertion == nil {
+		return nil
+	}
+	converted := &Assertion{
+		Kind:     assertion.Kind,
+		Expected: assertion.Expected,
+		Actual:   assertion.Actual,
+		Hint:     assertion.Hint,
+	}
+	for _, line := range assertion.Diff {
+		converted.Diff = append(converted.Diff, DiffLine{Op: line.Op, Text: line.Text})
+	}
+	if assertion.Location != nil {
+		converted.Location = &SourceLocation{
+			File:   assertion.Location.File,
+			Line:   assertion.Location.Line,
+			Column: assertion.Location.Column,
+		}
+	}
+	return converted
+}
+
+func fromSubmission(submission database.Submission) attempt {
+	run := attempt{
+		runID:        submission.RunID,
+		checkpoint:   submission.Checkpoint,
+		checkpointID: checkpointID(submission),
+		status:       submission.Status,
+		completedAt:  submission.SubmittedOn.Unix(),
+		durationMs:   submission.DurationMs,
+	}
+	if !submission.IsSuccess {
+		run.failure = &Failure{
+			RunID:       submission.RunID,
+			Status:      submission.Status,
+			CompletedAt: run.completedAt,
+			Message:     submission.Message,
+			Hidden:      submission.Hidden,
+		}
+		if submission.Hidden {
+			run.failure.TestsPassed, run.failure.TestsTotal = submission.TestcasesPassed, submission.TestcasesTotal
+		}
+	}
+	return run
+}
+
+func checkpointID(submission database.Submission) string {
+	if submission.CheckpointID == uuid.Nil {
+		return ""
+	}
+	return submission.CheckpointID.String()
+}
@@ -0,0 +1,158 @@
+package testresults
+
+import (
+	"testing"
+	"time"
+
+	"lms_v0/internal/database"
+	"lms_v0/utils"
+
+	"github.com/google/uuid"
+)
+
+var firstCheckpointID = uuid.MustParse("11111111-1111-1111-1111-111111111111")
+
+func storedSubmission(runID string, checkpoint int, status string, submittedAt int64) database.Submission {
+	return database.Submission{
+		RunID:        runID,
+		Checkpoint:   checkpoint,
+		CheckpointID: firstCheckpointID,
+		Status:       status,
+		IsSuccess:    status == statusPassed,
+		SubmittedOn:  time.Unix(submittedAt, 0),
+		Message:      "stored",
+	}
+}
+
+func TestAggregateWithoutRuns(t *testing.T) {
+	summary := Aggregate("lab-1", nil, nil, 0)
+	if summary.LabID != "lab-1" || summary.LabActive {
+		t.Errorf("expected an inactive lab-1; got %+v", summary)
+	}
+	if summary.Checkpoints == nil || len(summary.Checkpoints) != 0 {
+		t.Errorf("expected an empty list of checkpoints; got %#v", summary.Checkpoints)
+	}
+
+	summary = Aggregate("lab-1", &utils.LabInstanceEntry{ActiveCheckpoint: 2, Completed: true}, nil, 0)
+	if !summary.LabActive || summary.ActiveCheckpoint != 2 || !summary.Completed {
+		t.Errorf("expected the lab's state to be kept; got %+v", summary)
+	}
+}
+
+func TestAggregateCountsARunOnce(t *testing.T) {
+	instance := &utils.LabInstanceEntry{TestResults: []utils.LabTestResult{{
+		RunID:       "run-1",
+		Checkpoint:  1,
+		Status:      "FAILED_ASSERTION",
+		CompletedAt: 100,
+		Error:       &utils.LabTestError{Expected: "3", Received: "4", Message: "wrong sum"},
+	}}}
+	stored := []database.Submission{storedSubmission("run-1", 1, "FAILED_ASSERTION", 100)}
+
+	summary := Aggregate("lab-1", instance, stored, 0)
+	if len(summary.Checkpoints) != 1 {
+		t.Fatalf("expected one checkpoint; got %+v", summary.Checkpoints)
+	}
+	result := summary.Checkpoints[0]
+	if result.Attempts != 1 {
+		t.Errorf("expected the run found in Redis and Postgres to count once; got %d attempts", result.Attempts)
+	}
+	if result.CheckpointID != firstCheckpointID.String() {
+		t.Errorf("expected the checkpoint id of the submission; got %q", result.CheckpointID)
+	}
+	if result.LastFailure == nil || result.LastFailure.Message != "wrong sum" || result.LastFailure.Expected != "3" {
+		t.Errorf("expected the failure details from Redis; got %+v", result.LastFailure)
+	}
+}
+
+func TestAggregateOrdersRunsByCompletion(t *testing.T) {
+	instance := &utils.LabInstanceEntry{TestResults: []utils.LabTestResult{
+		{RunID: "run-3", Checkpoint: 1, Status: statusPassed, CompletedAt: 300, DurationMs: 30},
+	}}
+	stored := []database.Submission{
+		storedSubmission("run-2", 1, "FAILED_RUNTIME", 200),
+		storedSubmission("run-1", 1, statusPassed, 100),
+	}
+
+	result := Aggregate("lab-1", instance, stored, 0).Checkpoints[0]
+	if result.Attempts != 3 || result.LatestStatus != statusPassed || result.LastDurationMs != 30 {
+		t.Errorf("expected three attempts ending with the run from Redis; got %+v", result)
+	}
+	if !result.Passed || result.FirstPassedAt != 100 || result.LastAttemptAt != 300 {
+		t.Errorf("expected first passed at 100 and last attempt at 300; got %+v", result)
+	}
+	if result.LastFailure == nil || result.LastFailure.RunID != "run-2" || result.LastFailure.Status != "FAILED_RUNTIME" {
+		t.Errorf("expected run-2 as the last failure; got %+v", result.LastFailure)
+	}
+}
+
+func TestAggregateGroupsByCheckpoint(t *testing.T) {
+	stored := []database.Submission{
+		storedSubmission("run-a", 3, statusPassed, 100),
+		storedSubmission("run-b", 1, "FAILED_ASSERTION", 200),
+		storedSubmission("run-c", 1, statusPassed, 300),
+	}
+
+	summary := Aggregate("lab-1", nil, stored, 0)
+	if len(summary.Checkpoints) != 2 || summary.Checkpoints[0].Checkpoint != 1 || summary.Checkpoints[1].Checkpoint != 3 {
+		t.Fatalf("expected checkpoints 1 and 3 in order; got %+v", summary.Checkpoints)
+	}
+	if summary.Checkpoints[0].Attempts != 2 || summary.Checkpoints[1].Attempts != 1 {
+		t.Errorf("expected 2 and 1 attempts; got %+v", summary.Checkpoints)
+	}
+
+	summary = Aggregate("lab-1", nil, stored, 3)
+	if len(summary.Checkpoints) != 1 || summary.Checkpoints[0].Checkpoint != 3 {
+		t.Errorf("expected only checkpoint 3; got %+v", summary.Checkpoints)
+	}
+}
+
+func TestAggregateKeepsHiddenRunsToCounts(t *testing.T) {
+	instance := &utils.LabInstanceEntry{TestResults: []utils.LabTestResult{{
+		RunID:       "run-1",
+		Checkpoint:  1,
+		Status:      "FAILED_ASSERTION",
+		CompletedAt: 100,
+		Hidden:      true,
+		Tests:       &utils.LabTestCounts{Passed: 2, Total: 3},
+		Error:       &utils.LabTestError{Scenario: "sums", Expected: "3", Received: "4", Message: "1 of 3 tests failed"},
+	}}}
+
+	failure := Aggregate("lab-1", instance, nil, 0).Checkpoints[0].LastFailure
+	if failure == nil || !failure.Hidden || failure.TestsPassed != 2 || failure.TestsTotal != 3 {
+		t.Fatalf("expected a hidden failure with 2 of 3 tests passed; got %+v", failure)
+	}
+	if failure.Scenario != "" || failure.Expected != "" || failure.Received != "" {
+		t.Errorf("expected the details of a hidden run to be dropped; got %+v", failure)
+	}
+
+	stored := storedSubmission("run-2", 2, "FAILED_ASSERTION", 200)
+	stored.Hidden, stored.TestcasesPassed, stored.TestcasesTotal = true, 1, 4
+	failure = Aggregate("lab-1", nil, []database.Submission{stored}, 0).Checkpoints[0].LastFailure
+	if failure == nil || !failure.Hidden || failure.TestsPassed != 1 || failure.TestsTotal != 4 {
+		t.Errorf("expected the counts of a hidden submission; got %+v", failure)
+	}
+}
+
+func TestAggregateCarriesAssertions(t *testing.T) {
+	assertion := &utils.LabAssertion{
+		Kind:     "string",
+		Expected: "a",
+		Actual:   "b",
+		Diff:     []utils.LabDiffLine{{Op: "delete", Text: "a"}, {Op: "insert", Text: "b"}},
+		Location: &utils.LabSourceLocation{File: "index.js", Line: 4},
+	}
+	instance := &utils.LabInstanceEntry{TestResults: []utils.LabTestResult{
+		{RunID: "run-1", Checkpoint: 1, Status: "FAILED_ASSERTION", CompletedAt: 100, Error: &utils.LabTestError{Assertion: assertion}},
+		{RunID: "run-2", Checkpoint: 2, Status: "FAILED_ASSERTION", CompletedAt: 200, Hidden: true, Error: &utils.LabTestError{Assertion: assertion}},
+	}}
+
+	summary := Aggregate("lab-1", instance, nil, 0)
+	got := summary.Checkpoints[0].LastFailure.Assertion
+	if got == nil || got.Kind != "string" || len(got.Diff) != 2 || got.Location == nil || got.Location.Line != 4 {
+		t.Errorf("expected the assertion with its diff and location; got %+v", got)
+	}
+	if hidden := summary.Checkpoints[1].LastFailure.Assertion; hidden != nil {
+		t.Errorf("expected no assertion for a hidden run; got %+v", hidden)
+	}
+}
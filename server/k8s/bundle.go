@@ -0,0 +1,216 @@
+package k8s
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lms_v0/internal/database"
+	"lms_v0/utils"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Test bundles
+//
+// Every checkpoint has a bundle of its own, checkpoint-<n>.test.js, from Checkpoint.TestingCode
+// or, for checkpoints without one, from the project's tests in TestFilesKey. The quest's final
+// suite is the "final" bundle. When the pod is spun up the server hashes the files it expects
+// the init container to stage and signs the manifest of those hashes with an Ed25519 key
+// generated for the lab. Only the public key goes to the pod, the private key is dropped once
+// the manifest is signed. The grader checks the manifest against the public key and the staged
+// files against the manifest before every run, so a bundle that changed since the lab started,
+// or that was never staged, fails the run instead of grading with the wrong tests.
+
+const (
+	maxTestBundleFile     = 5 * 1024 * 1024  // 5 MB
+	testBundleReadTimeout = 30 * time.Second // For all of a quest's files
+)
+
+// A file of a bundle, relative to /internal-test
+type TestBundleFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// What the grader verifies, written to /internal-test/manifest.json by the init container
+type TestBundleManifest struct {
+	Quest     string                      `json:"quest"`
+	LabID     string                      `json:"labId"`
+	CreatedAt int64                       `json:"createdAt"`
+	Bundles   map[string][]TestBundleFile `json:"bundles"`
+}
+
+// A file the init container stages: a URL, or a key in S3Bucket
+type testBundleSource struct {
+	Bundle   string
+	Path     string
+	Source   string
+	Fallback bool // The project's test file, standing in for a missing TestingCode
+}
+
+// SetTestBundles lists the checkpoint test files of the quest. They are hashed and signed
+// when the pod is spun up, see signTestBundles.
+func (p *SpinUpQuestParams) SetTestBundles(quest *database.Quest) {
+	p.testBundleSources = nil
+	for i, checkpoint := range quest.Checkpoints {
+		bundle := fmt.Sprintf("checkpoint-%d", i+1)
+		source := strings.TrimSpace(checkpoint.TestingCode)
+		fallback := source == ""
+		if fallback {
+			source = fmt.Sprintf("%s%s.test.js", projectTestFilesKey(quest.Slug), bundle)
+		}
+		p.testBundleSources = append(p.testBundleSources, testBundleSource{
+			Bundle:   bundle,
+			Path:     bundle + ".test.js",
+			Source:   source,
+			Fallback: fallback,
+		})
+	}
+}
+
+// The project's own test files, for checkpoints without a TestingCode
+func projectTestFilesKey(projectSlug string) string {
+	return fmt.Sprintf("projects/%s/tests/", projectSlug)
+}
+
+// signTestBundles hashes the files of every bundle, final suite included, and fills in the
+// signed manifest and the list of files the init container copies. The files are read at
+// once, within testBundleReadTimeout. A checkpoint's TestingCode that cannot be read is left
+// out, the grader then refuses to run its checkpoint; a missing project test file standing in
+// for one fails the lab, it was never there to begin with.
+func (p *SpinUpQuestParams) signTestBundles() error {
+	manifest := TestBundleManifest{
+		Quest:     p.ProjectSlug,
+		LabID:     p.LabID,
+		CreatedAt: time.Now().Unix(),
+		Bundles:   map[string][]TestBundleFile{},
+	}
+	var staged []string
+
+	sources := p.testBundleSources
+	if p.FinalTestURL != "" {
+		sources = append(sources[:len(sources):len(sources)], testBundleSource{Bundle: "final", Path: "final/suite.js", Source: p.FinalTestURL})
+	}
+	contents, errs := p.readTestBundleSources(sources)
+
+	for i, file := range sources {
+		if errs[i] != nil {
+			if file.Fallback {
+				return fmt.Errorf("checkpoint %s of quest %s has no test file: %w", file.Bundle, p.ProjectSlug, errs[i])
+			}
+			log.Printf("Test bundle %s of quest %s left out: %v", file.Bundle, p.ProjectSlug, errs[i])
+			continue
+		}
+		manifest.Bundles[file.Bundle] = append(manifest.Bundles[file.Bundle], testBundleFile(file.Path, contents[i]))
+		if file.Bundle != "final" {
+			staged = append(staged, file.Path+" "+file.Source)
+		}
+	}
+
+	if p.FinalTestURL != "" {
+		// Written by the init container from FinalTestCases
+		if cases, err := base64.StdEncoding.DecodeString(p.FinalTestCases); err == nil {
+			manifest.Bundles["final"] = append(manifest.Bundles["final"], testBundleFile("final/cases.json", cases))
+		}
+	}
+
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode test bundle manifest: %w", err)
+	}
+	publicKey, signature, err := signTestBundleManifest(encoded)
+	if err != nil {
+		return err
+	}
+
+	p.TestBundlePublicKey = publicKey
+	p.TestBundleManifest = base64.StdEncoding.EncodeToString(encoded)
+	p.TestBundleSignature = signature
+	p.TestBundleFiles = base64.StdEncoding.EncodeToString([]byte(strings.Join(staged, "\n")))
+	return nil
+}
+
+// signTestBundleManifest signs a manifest with a key of its own. It returns the public key,
+// base64 encoded DER (SPKI), and the hex encoded signature; the private key goes nowhere.
+func signTestBundleManifest(manifest []byte) (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("could not generate test bundle key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", "", fmt.Errorf("could not encode test bundle key: %w", err)
+	}
+	signature := ed25519.Sign(privateKey, manifest)
+	return base64.StdEncoding.EncodeToString(der), hex.EncodeToString(signature), nil
+}
+
+// Read the files of all bundles at once, the contents and errors in the order of sources
+func (p *SpinUpQuestParams) readTestBundleSources(sources []testBundleSource) ([][]byte, []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), testBundleReadTimeout)
+	defer cancel()
+
+	contents := make([][]byte, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, file := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			contents[i], errs[i] = p.readTestBundleSource(ctx, file.Source)
+		}()
+	}
+	wg.Wait()
+	return contents, errs
+}
+
+func testBundleFile(path string, content []byte) TestBundleFile {
+	sum := sha256.Sum256(content)
+	return TestBundleFile{Path: path, SHA256: hex.EncodeToString(sum[:]), Size: len(content)}
+}
+
+// Read a test file the way the init container will: a URL as is, a key through a
+// presigned URL
+func (p *SpinUpQuestParams) readTestBundleSource(ctx context.Context, source string) ([]byte, error) {
+	url := source
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		presigned, err := utils.GeneratePresignedUrl(p.S3Bucket, source)
+		if err != nil {
+			return nil, err
+		}
+		url = presigned
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %d", strings.SplitN(source, "?", 2)[0], resp.StatusCode)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxTestBundleFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxTestBundleFile {
+		return nil, fmt.Errorf("%s is larger than %d bytes", strings.SplitN(source, "?", 2)[0], maxTestBundleFile)
+	}
+	return content, nil
+}
@@ -0,0 +1,200 @@
+package k8s
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// verifyTestBundleManifest checks a signed manifest the way the grader does
+func verifyTestBundleManifest(t *testing.T, publicKey, manifest, signature string) bool {
+	t.Helper()
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		t.Fatalf("public key is not base64: %v", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatalf("public key is not SPKI: %v", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		t.Fatalf("public key is a %T, not Ed25519", key)
+	}
+	raw, err := base64.StdEncoding.DecodeString(manifest)
+	if err != nil {
+		t.Fatalf("manifest is not base64: %v", err)
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		t.Fatalf("signature is not hex: %v", err)
+	}
+	return ed25519.Verify(edKey, raw, sig)
+}
+
+func TestSignTestBundleManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		tamper   func(string) string
+		want     bool
+	}{
+		{
+			name:     "untouched manifest verifies",
+			manifest: `{"quest":"todo","bundles":{}}`,
+			tamper:   func(m string) string { return m },
+			want:     true,
+		},
+		{
+			name:     "changed manifest does not",
+			manifest: `{"quest":"todo","bundles":{}}`,
+			tamper:   func(m string) string { return strings.Replace(m, "todo", "tada", 1) },
+			want:     false,
+		},
+		{
+			name:     "empty manifest verifies",
+			manifest: ``,
+			tamper:   func(m string) string { return m },
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publicKey, signature, err := signTestBundleManifest([]byte(tt.manifest))
+			if err != nil {
+				t.Fatalf("signTestBundleManifest: %v", err)
+			}
+			signed := base64.StdEncoding.EncodeToString([]byte(tt.tamper(tt.manifest)))
+			if got := verifyTestBundleManifest(t, publicKey, signed, signature); got != tt.want {
+				t.Errorf("verified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignTestBundleManifestKeysPerLab(t *testing.T) {
+	manifest := []byte(`{"quest":"todo"}`)
+	firstKey, firstSignature, _ := signTestBundleManifest(manifest)
+	secondKey, _, _ := signTestBundleManifest(manifest)
+	if firstKey == secondKey {
+		t.Fatal("two labs were signed with the same key")
+	}
+	encoded := base64.StdEncoding.EncodeToString(manifest)
+	if verifyTestBundleManifest(t, secondKey, encoded, firstSignature) {
+		t.Error("signature verified with another lab's key")
+	}
+}
+
+func TestSignTestBundles(t *testing.T) {
+	files := map[string]string{
+		"/checkpoint-1.test.js": "test('one', () => {})",
+		"/final.js":             "module.exports = {}",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		sources     []testBundleSource
+		finalURL    string
+		wantBundles map[string][]string // Paths by bundle
+		wantStaged  []string
+		wantErr     bool
+	}{
+		{
+			name: "every file read",
+			sources: []testBundleSource{
+				{Bundle: "checkpoint-1", Path: "checkpoint-1.test.js", Source: server.URL + "/checkpoint-1.test.js"},
+			},
+			finalURL: server.URL + "/final.js",
+			wantBundles: map[string][]string{
+				"checkpoint-1": {"checkpoint-1.test.js"},
+				"final":        {"final/suite.js", "final/cases.json"},
+			},
+			wantStaged: []string{"checkpoint-1.test.js " + server.URL + "/checkpoint-1.test.js"},
+		},
+		{
+			name: "missing TestingCode is left out",
+			sources: []testBundleSource{
+				{Bundle: "checkpoint-1", Path: "checkpoint-1.test.js", Source: server.URL + "/checkpoint-1.test.js"},
+				{Bundle: "checkpoint-2", Path: "checkpoint-2.test.js", Source: server.URL + "/gone.test.js"},
+			},
+			wantBundles: map[string][]string{"checkpoint-1": {"checkpoint-1.test.js"}},
+			wantStaged:  []string{"checkpoint-1.test.js " + server.URL + "/checkpoint-1.test.js"},
+		},
+		{
+			name: "missing project test file fails",
+			sources: []testBundleSource{
+				{Bundle: "checkpoint-1", Path: "checkpoint-1.test.js", Source: server.URL + "/checkpoint-1.test.js"},
+				{Bundle: "checkpoint-2", Path: "checkpoint-2.test.js", Source: server.URL + "/checkpoint-2.test.js", Fallback: true},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := SpinUpQuestParams{
+				LabID:             "lab1",
+				ProjectSlug:       "todo",
+				FinalTestURL:      tt.finalURL,
+				FinalTestCases:    base64.StdEncoding.EncodeToString([]byte(`[]`)),
+				testBundleSources: tt.sources,
+			}
+			err := params.signTestBundles()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("signTestBundles: %v", err)
+			}
+
+			if !verifyTestBundleManifest(t, params.TestBundlePublicKey, params.TestBundleManifest, params.TestBundleSignature) {
+				t.Fatal("manifest does not verify")
+			}
+
+			raw, _ := base64.StdEncoding.DecodeString(params.TestBundleManifest)
+			var manifest TestBundleManifest
+			if err := json.Unmarshal(raw, &manifest); err != nil {
+				t.Fatalf("manifest: %v", err)
+			}
+			if len(manifest.Bundles) != len(tt.wantBundles) {
+				t.Errorf("bundles = %v, want %v", manifest.Bundles, tt.wantBundles)
+			}
+			for bundle, paths := range tt.wantBundles {
+				got := manifest.Bundles[bundle]
+				if len(got) != len(paths) {
+					t.Errorf("bundle %s = %v, want %v", bundle, got, paths)
+					continue
+				}
+				for i, path := range paths {
+					if got[i].Path != path {
+						t.Errorf("bundle %s file %d = %s, want %s", bundle, i, got[i].Path, path)
+					}
+				}
+			}
+
+			staged, _ := base64.StdEncoding.DecodeString(params.TestBundleFiles)
+			if got := strings.Join(tt.wantStaged, "\n"); string(staged) != got {
+				t.Errorf("staged = %q, want %q", staged, got)
+			}
+		})
+	}
+}
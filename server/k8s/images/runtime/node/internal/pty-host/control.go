@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Control connections
+//
+// Besides the shell listener the host accepts control connections on PTY_HOST_CONTROL_ADDR.
+// The first frame names the operation; everything after it is specific to that operation.
+// Control connections carry structured work that must not go through the learner's shell.
+
+const controlHandshakeTimeout = 10 * time.Second
+
+// Serialises frames written from several goroutines
+type frameWriter struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (w *frameWriter) write(kind byte, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return writeFrame(w.conn, kind, payload)
+}
+
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(controlHandshakeTimeout))
+	first, err := readFrame(reader)
+	if err != nil {
+		log.Printf("Control connection from %s closed before a request: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	out := &frameWriter{conn: conn}
+	switch first.kind {
+	case FRAME_EXEC:
+		serveExec(reader, out, first.payload)
+	case FRAME_RUN:
+		serveRunRequest(out, first.payload)
+	case FRAME_SUBSCRIBE:
+		serveRunSubscription(reader, out)
+	case FRAME_USAGE_SUBSCRIBE:
+		serveUsageSubscription(reader, out, first.payload)
+	default:
+		log.Printf("Unknown control request type %d", first.kind)
+	}
+}
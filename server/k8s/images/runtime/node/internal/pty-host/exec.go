@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Structured command execution
+//
+// An exec runs one process directly in the container, outside of any shell session. The
+// request is the payload of FRAME_EXEC:
+//
+//	{"argv": ["npm", "test"], "cwd": "/workspace", "env": {"CI": "1"}, "timeout": 60}
+//
+// `command` may be given instead of `argv` and is run with `sh -c`. The process gets a
+// process group of its own; FRAME_DATA frames feed its stdin (an empty frame closes it) and
+// FRAME_SIGNAL frames signal the group. The host answers with FRAME_STARTED, the output as
+// FRAME_STDOUT/FRAME_STDERR and finally FRAME_EXIT. The group is killed when the process
+// exits, times out or the relay goes away.
+
+const (
+	defaultExecTimeout = 10 * time.Minute
+	maxExecTimeout     = time.Hour
+	// Output still buffered after the process exited gets this long to drain
+	execOutputDrainTimeout = 2 * time.Second
+	// How long a timed out process gets between SIGTERM and SIGKILL
+	execKillGracePeriod = 5 * time.Second
+)
+
+type execRequest struct {
+	Argv    []string          `json:"argv,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Timeout int               `json:"timeout,omitempty"` // Seconds
+}
+
+type execStarted struct {
+	Pid int `json:"pid"`
+}
+
+type execExit struct {
+	Code       int    `json:"code"`
+	Signal     string `json:"signal,omitempty"`
+	TimedOut   bool   `json:"timedOut,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Writes process output as frames of one kind
+type streamWriter struct {
+	out  *frameWriter
+	kind byte
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if err := w.out.write(w.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (req execRequest) command() (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	switch {
+	case len(req.Argv) > 0 && req.Command != "":
+		return nil, errors.New("exec request sets both argv and command")
+	case len(req.Argv) > 0:
+		cmd = exec.Command(req.Argv[0], req.Argv[1:]...)
+	case req.Command != "":
+		cmd = exec.Command("/bin/sh", "-c", req.Command)
+	default:
+		return nil, errors.New("exec request has no argv or command")
+	}
+
+	cmd.Dir = req.Cwd
+	cmd.Env = os.Environ()
+	for key, value := range req.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = execOutputDrainTimeout
+	return cmd, nil
+}
+
+func (req execRequest) timeout() time.Duration {
+	if req.Timeout <= 0 {
+		return defaultExecTimeout
+	}
+	return min(time.Duration(req.Timeout)*time.Second, maxExecTimeout)
+}
+
+func serveExec(in io.Reader, out *frameWriter, payload []byte) {
+	started := time.Now()
+	sendExit := func(exit execExit) {
+		exit.DurationMs = time.Since(started).Milliseconds()
+		data, _ := json.Marshal(exit)
+		out.write(FRAME_EXIT, data)
+	}
+
+	var req execRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		sendExit(execExit{Code: -1, Error: fmt.Sprintf("invalid exec request: %v", err)})
+		return
+	}
+	cmd, err := req.command()
+	if err != nil {
+		sendExit(execExit{Code: -1, Error: err.Error()})
+		return
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		sendExit(execExit{Code: -1, Error: err.Error()})
+		return
+	}
+	cmd.Stdout = streamWriter{out: out, kind: FRAME_STDOUT}
+	cmd.Stderr = streamWriter{out: out, kind: FRAME_STDERR}
+
+	if err := cmd.Start(); err != nil {
+		sendExit(execExit{Code: -1, Error: err.Error()})
+		return
+	}
+	pid := cmd.Process.Pid
+	data, _ := json.Marshal(execStarted{Pid: pid})
+	out.write(FRAME_STARTED, data)
+	log.Printf("Exec %d started: %v", pid, cmd.Args)
+
+	exited := make(chan struct{})
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(req.timeout(), func() {
+		timedOut.Store(true)
+		syscall.Kill(-pid, syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(execKillGracePeriod):
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	})
+
+	go forwardExecInput(in, stdin, pid, exited)
+
+	err = cmd.Wait()
+	close(exited)
+	timer.Stop()
+	// Nothing the process left behind outlives it
+	syscall.Kill(-pid, syscall.SIGKILL)
+
+	exit := execExit{Code: cmd.ProcessState.ExitCode(), TimedOut: timedOut.Load()}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit.Signal = status.Signal().String()
+	}
+	if err != nil && !errors.As(err, new(*exec.ExitError)) {
+		exit.Error = err.Error()
+	}
+	sendExit(exit)
+	log.Printf("Exec %d finished with code %d", pid, exit.Code)
+}
+
+// Apply stdin and signal frames until the process exits. A relay that goes away takes the
+// process with it.
+func forwardExecInput(in io.Reader, stdin io.WriteCloser, pid int, exited <-chan struct{}) {
+	defer stdin.Close()
+
+	for {
+		frame, err := readFrame(in)
+		if err != nil {
+			select {
+			case <-exited:
+			default:
+				syscall.Kill(-pid, syscall.SIGKILL)
+			}
+			return
+		}
+
+		switch frame.kind {
+		case FRAME_DATA:
+			if len(frame.payload) == 0 {
+				stdin.Close()
+				continue
+			}
+			stdin.Write(frame.payload)
+
+		case FRAME_SIGNAL:
+			if len(frame.payload) != 1 {
+				log.Printf("Ignoring invalid signal frame for exec %d", pid)
+				continue
+			}
+			syscall.Kill(-pid, syscall.Signal(frame.payload[0]))
+
+		default:
+			log.Printf("Ignoring frame type %d for exec %d", frame.kind, pid)
+		}
+	}
+}
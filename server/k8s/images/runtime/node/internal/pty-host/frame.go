@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Relay -> host framing
+//
+// Every frame is a one byte type, a big-endian uint32 payload length and the payload:
+//
+//	FRAME_DATA    raw keystrokes for the shell, or stdin of an exec
+//	FRAME_RESIZE  rows and columns as two big-endian uint16 values
+//
+// Shell output flows back unframed: the host copies the PTY master straight to the
+// connection. Control connections (see control.go) are framed both ways.
+
+const (
+	FRAME_DATA   byte = 0
+	FRAME_RESIZE byte = 1
+
+	// Control connections
+	FRAME_EXEC    byte = 2 // relay -> host: JSON exec request, opens the connection
+	FRAME_SIGNAL  byte = 3 // relay -> host: signal number for the process group
+	FRAME_STARTED byte = 4 // host -> relay: JSON {"pid": ...}
+	FRAME_STDOUT  byte = 5
+	FRAME_STDERR  byte = 6
+	FRAME_EXIT    byte = 7 // host -> relay: JSON exit status, the last frame
+
+	// Run supervisor (see supervisor.go)
+	FRAME_RUN        byte = 8  // relay -> host: JSON run request
+	FRAME_RUN_STATUS byte = 9  // host -> relay: JSON run status or event
+	FRAME_SUBSCRIBE  byte = 10 // relay -> host: stream run events and output
+
+	// Resource usage (see usage.go)
+	FRAME_USAGE_SUBSCRIBE byte = 11 // relay -> host: JSON options, stream usage samples
+	FRAME_USAGE           byte = 12 // host -> relay: JSON usage sample
+)
+
+const (
+	frameHeaderSize = 5
+	maxFrameSize    = 1024 * 1024 // 1 MB
+)
+
+var errFrameTooLarge = errors.New("frame exceeds maximum size")
+
+type frame struct {
+	kind    byte
+	payload []byte
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrameSize {
+		return frame{}, errFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	return frame{kind: header[0], payload: payload}, nil
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:frameHeaderSize], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func decodeResize(payload []byte) (rows, cols uint16, err error) {
+	if len(payload) != 4 {
+		return 0, 0, fmt.Errorf("invalid resize payload of %d bytes", len(payload))
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]), nil
+}
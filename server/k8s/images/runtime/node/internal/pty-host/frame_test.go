@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// The relay writes the same bytes, see pty/backend_test.go
+func TestReadFrameOfTheRelay(t *testing.T) {
+	stream := bytes.NewReader([]byte{
+		FRAME_DATA, 0, 0, 0, 3, 'l', 's', '\r',
+		FRAME_RESIZE, 0, 0, 0, 4, 0, 24, 0, 80,
+		FRAME_DATA, 0, 0, 0, 0,
+	})
+
+	f, err := readFrame(stream)
+	if err != nil || f.kind != FRAME_DATA || string(f.payload) != "ls\r" {
+		t.Errorf("expected the keystrokes; got %+v, %v", f, err)
+	}
+
+	f, err = readFrame(stream)
+	if err != nil || f.kind != FRAME_RESIZE {
+		t.Fatalf("expected a resize; got %+v, %v", f, err)
+	}
+	rows, cols, err := decodeResize(f.payload)
+	if err != nil || rows != 24 || cols != 80 {
+		t.Errorf("expected 24x80; got %dx%d, %v", rows, cols, err)
+	}
+
+	f, err = readFrame(stream)
+	if err != nil || f.kind != FRAME_DATA || len(f.payload) != 0 {
+		t.Errorf("expected an empty data frame; got %+v, %v", f, err)
+	}
+
+	if _, err := readFrame(stream); err != io.EOF {
+		t.Errorf("expected EOF after the last frame; got %v", err)
+	}
+}
+
+func TestReadFrameOfABrokenStream(t *testing.T) {
+	if _, err := readFrame(bytes.NewReader([]byte{FRAME_DATA, 0, 0})); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a cut header to fail; got %v", err)
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{FRAME_DATA, 0, 0, 0, 4, 'a', 'b'})); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a cut payload to fail; got %v", err)
+	}
+
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header[1:], maxFrameSize+1)
+	if _, err := readFrame(bytes.NewReader(header)); err != errFrameTooLarge {
+		t.Errorf("expected a frame over %d bytes to be refused; got %v", maxFrameSize, err)
+	}
+}
+
+func TestDecodeResize(t *testing.T) {
+	rows, cols, err := decodeResize([]byte{1, 0, 2, 0})
+	if err != nil || rows != 256 || cols != 512 {
+		t.Errorf("expected big-endian rows then columns; got %dx%d, %v", rows, cols, err)
+	}
+
+	for _, payload := range [][]byte{nil, {0, 24, 0}, {0, 24, 0, 80, 0}} {
+		if _, _, err := decodeResize(payload); err == nil {
+			t.Errorf("expected a payload of %d bytes to be refused", len(payload))
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module devsarena/pty-host
+
+go 1.24.5
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pty-host runs inside the app container and gives every relay connection its own login
+// shell on a real pseudo-terminal. It replaces the socat bridge so the relay can forward
+// window size changes next to keystrokes (see frame.go). A second listener takes control
+// connections for work that bypasses the shell (see control.go).
+
+var (
+	PTY_HOST_NETWORK         = "tcp"
+	PTY_HOST_ADDR            = "127.0.0.1:54321"
+	PTY_HOST_CONTROL_NETWORK = "tcp"
+	PTY_HOST_CONTROL_ADDR    = "127.0.0.1:54322"
+	SHELL_COMMAND            = []string{"/bin/bash", "--login"}
+	// Consecutive crashes an auto-restarted run command is restarted after
+	PTY_HOST_RUN_MAX_RESTARTS = 5
+)
+
+func main() {
+	loadConfig()
+
+	listener := listen(PTY_HOST_NETWORK, PTY_HOST_ADDR)
+	log.Printf("PTY host listening on %s %s, shell: %s", PTY_HOST_NETWORK, PTY_HOST_ADDR, strings.Join(SHELL_COMMAND, " "))
+
+	controlListener := listen(PTY_HOST_CONTROL_NETWORK, PTY_HOST_CONTROL_ADDR)
+	log.Printf("PTY host control listening on %s %s", PTY_HOST_CONTROL_NETWORK, PTY_HOST_CONTROL_ADDR)
+	go acceptLoop(controlListener, serveControl)
+
+	acceptLoop(listener, serveShell)
+}
+
+func listen(network, addr string) net.Listener {
+	if network == "unix" {
+		// Remove a socket left behind by a previous run
+		if err := os.Remove(addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Failed to remove stale socket %s: %v", addr, err)
+		}
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s %s: %v", network, addr, err)
+	}
+	return listener
+}
+
+func acceptLoop(listener net.Listener, serve func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+		go serve(conn)
+	}
+}
+
+// Read overrides from the environment
+func loadConfig() {
+	if network := os.Getenv("PTY_HOST_NETWORK"); network != "" {
+		PTY_HOST_NETWORK = network
+	}
+	if addr := os.Getenv("PTY_HOST_ADDR"); addr != "" {
+		PTY_HOST_ADDR = addr
+	}
+	if network := os.Getenv("PTY_HOST_CONTROL_NETWORK"); network != "" {
+		PTY_HOST_CONTROL_NETWORK = network
+	}
+	if addr := os.Getenv("PTY_HOST_CONTROL_ADDR"); addr != "" {
+		PTY_HOST_CONTROL_ADDR = addr
+	}
+	if restarts := os.Getenv("PTY_HOST_RUN_MAX_RESTARTS"); restarts != "" {
+		if parsed, err := strconv.Atoi(restarts); err == nil && parsed >= 0 {
+			PTY_HOST_RUN_MAX_RESTARTS = parsed
+		} else {
+			log.Printf("Invalid PTY_HOST_RUN_MAX_RESTARTS %q", restarts)
+		}
+	}
+	if shell := strings.Fields(os.Getenv("PTY_HOST_SHELL")); len(shell) > 0 {
+		SHELL_COMMAND = shell
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	Rows   uint16
+	Cols   uint16
+	XPixel uint16
+	YPixel uint16
+}
+
+// Allocate a new pseudo-terminal pair through /dev/ptmx
+func openPty() (master *os.File, slave *os.File, err error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+
+	var unlock int32
+	if err := ioctl(uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+
+	var ptyNumber uint32
+	if err := ioctl(uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNumber))); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+
+	// Non-blocking so reads go through the runtime poller and Close interrupts them
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("failed to set pty non-blocking: %w", err)
+	}
+	master = os.NewFile(uintptr(fd), "/dev/ptmx")
+
+	slavePath := fmt.Sprintf("/dev/pts/%d", ptyNumber)
+	slave, err = os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open %s: %w", slavePath, err)
+	}
+	return master, slave, nil
+}
+
+// Apply a window size; the kernel delivers SIGWINCH to the foreground process group
+func setWindowSize(master *os.File, rows, cols uint16) error {
+	size := winsize{Rows: rows, Cols: cols}
+
+	conn, err := master.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ioctlErr error
+	if err := conn.Control(func(fd uintptr) {
+		ioctlErr = ioctl(fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+	}); err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
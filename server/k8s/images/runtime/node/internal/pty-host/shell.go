@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRows = 24
+	defaultCols = 80
+	// How long a shell gets to exit after SIGHUP before it is killed
+	hangupGracePeriod = 5 * time.Second
+)
+
+// Run a login shell on a fresh PTY for the lifetime of a relay connection
+func serveShell(conn net.Conn) {
+	defer conn.Close()
+
+	master, slave, err := openPty()
+	if err != nil {
+		log.Printf("Failed to allocate pty: %v", err)
+		return
+	}
+	defer master.Close()
+
+	if err := setWindowSize(master, defaultRows, defaultCols); err != nil {
+		log.Printf("Failed to set initial window size: %v", err)
+	}
+
+	cmd := exec.Command(SHELL_COMMAND[0], SHELL_COMMAND[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.Env = shellEnv()
+	// New session with the pty as controlling terminal, like socat's setsid,ctty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+	if err := cmd.Start(); err != nil {
+		slave.Close()
+		log.Printf("Failed to start shell: %v", err)
+		return
+	}
+	// The shell holds its own copy, ours would keep the pty alive after it exits
+	slave.Close()
+	pid := cmd.Process.Pid
+	log.Printf("Shell %d started for %s", pid, conn.RemoteAddr())
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+		// Unblock the input loop once the shell is gone
+		conn.Close()
+	}()
+
+	go func() {
+		if _, err := io.Copy(conn, master); err != nil && !isClosedError(err) {
+			log.Printf("Shell %d output error: %v", pid, err)
+		}
+	}()
+
+	if err := forwardInput(conn, master); err != nil && !isClosedError(err) {
+		log.Printf("Shell %d input error: %v", pid, err)
+	}
+
+	hangup(pid, exited)
+	log.Printf("Shell %d finished", pid)
+}
+
+// Apply frames from the relay to the pty until the connection ends
+func forwardInput(conn net.Conn, master *os.File) error {
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := readFrame(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		switch frame.kind {
+		case FRAME_DATA:
+			if _, err := master.Write(frame.payload); err != nil {
+				return err
+			}
+
+		case FRAME_RESIZE:
+			rows, cols, err := decodeResize(frame.payload)
+			if err != nil {
+				log.Printf("Ignoring resize: %v", err)
+				continue
+			}
+			if err := setWindowSize(master, rows, cols); err != nil {
+				log.Printf("Failed to resize pty to %dx%d: %v", cols, rows, err)
+			}
+
+		default:
+			log.Printf("Ignoring unknown frame type %d", frame.kind)
+		}
+	}
+}
+
+// Hang up the shell's session, killing it if it does not go away
+func hangup(pid int, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	default:
+	}
+
+	syscall.Kill(-pid, syscall.SIGHUP)
+	select {
+	case <-exited:
+	case <-time.After(hangupGracePeriod):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-exited
+	}
+}
+
+func shellEnv() []string {
+	env := os.Environ()
+	if os.Getenv("TERM") == "" {
+		env = append(env, "TERM=xterm-256color")
+	}
+	return env
+}
+
+// Errors that just mean the other side went away
+func isClosedError(err error) bool {
+	// Reading the master after the last slave fd is closed fails with EIO
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EIO)
+}
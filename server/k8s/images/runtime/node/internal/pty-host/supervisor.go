@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Run supervisor
+//
+// The supervisor owns the learner's run command: it runs the init commands one after the
+// other, then the run command, each with `sh -c` in a process group of its own. A FRAME_RUN
+// request controls it and is answered with one FRAME_RUN_STATUS frame:
+//
+//	{"op": "start", "spec": {"initCommands": ["npm install"], "runCommand": "npm run dev", "autoRestart": true}}
+//	{"op": "stop"} | {"op": "restart"} | {"op": "status"}
+//
+// A FRAME_SUBSCRIBE connection receives the current status, then a FRAME_RUN_STATUS frame
+// for every change and the output of the supervised processes as FRAME_STDOUT/FRAME_STDERR.
+//
+// Stopping sends SIGTERM to the process group and SIGKILL after runStopGracePeriod. With
+// autoRestart a run command that exits with an error is restarted after an exponential
+// backoff, up to PTY_HOST_RUN_MAX_RESTARTS times in a row.
+
+const (
+	RUN_STATE_IDLE       = "idle"
+	RUN_STATE_INSTALLING = "installing"
+	RUN_STATE_RUNNING    = "running"
+	RUN_STATE_RESTARTING = "restarting"
+	RUN_STATE_STOPPING   = "stopping"
+	RUN_STATE_STOPPED    = "stopped"
+	RUN_STATE_EXITED     = "exited"
+	RUN_STATE_CRASHED    = "crashed"
+	RUN_STATE_FAILED     = "failed" // An init command failed
+)
+
+const (
+	runStopGracePeriod = 10 * time.Second
+	maxRestartBackoff  = 30 * time.Second
+	// A run command that stayed up this long starts a fresh restart count
+	restartResetUptime = time.Minute
+)
+
+type runSpec struct {
+	InitCommands []string          `json:"initCommands,omitempty"`
+	RunCommand   string            `json:"runCommand"`
+	Cwd          string            `json:"cwd,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	AutoRestart  bool              `json:"autoRestart,omitempty"`
+}
+
+type runStatus struct {
+	State       string `json:"state"`
+	Step        string `json:"step,omitempty"` // init_<n> or main_run
+	Pid         int    `json:"pid,omitempty"`
+	RunCommand  string `json:"runCommand,omitempty"`
+	ExitCode    *int   `json:"exitCode,omitempty"`
+	Restarts    int    `json:"restarts"`
+	AutoRestart bool   `json:"autoRestart"`
+	StartedAt   int64  `json:"startedAt,omitempty"`
+}
+
+// Published on every change. Event is "state", "step_started" or "step_finished".
+type runEvent struct {
+	Event  string    `json:"event"`
+	Status runStatus `json:"status"`
+}
+
+type runRequest struct {
+	Op   string   `json:"op"`
+	Spec *runSpec `json:"spec,omitempty"`
+}
+
+type runReply struct {
+	Status runStatus `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type supervisor struct {
+	spec   *runSpec
+	status runStatus
+	// Process group of the current step, 0 between steps
+	pid int
+	// Closed when the current run loop has finished
+	done chan struct{}
+	// Closed when a stop of the current run was requested
+	stopCh   chan struct{}
+	stopping bool
+
+	subscribers map[*frameWriter]struct{}
+	mu          sync.Mutex
+}
+
+var runSupervisor = &supervisor{
+	status:      runStatus{State: RUN_STATE_IDLE},
+	subscribers: make(map[*frameWriter]struct{}),
+}
+
+func serveRunRequest(out *frameWriter, payload []byte) {
+	reply := func(err error) {
+		response := runReply{Status: runSupervisor.snapshot()}
+		if err != nil {
+			response.Error = err.Error()
+		}
+		data, _ := json.Marshal(response)
+		out.write(FRAME_RUN_STATUS, data)
+	}
+
+	var req runRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		reply(fmt.Errorf("invalid run request: %w", err))
+		return
+	}
+
+	switch req.Op {
+	case "start":
+		reply(runSupervisor.start(req.Spec))
+	case "stop":
+		runSupervisor.stop()
+		reply(nil)
+	case "restart":
+		reply(runSupervisor.restart(req.Spec))
+	case "status":
+		reply(nil)
+	default:
+		reply(fmt.Errorf("unknown run op %q", req.Op))
+	}
+}
+
+// Stream status changes and output to a control connection until it closes
+func serveRunSubscription(in io.Reader, out *frameWriter) {
+	runSupervisor.mu.Lock()
+	runSupervisor.subscribers[out] = struct{}{}
+	data, _ := json.Marshal(runEvent{Event: "state", Status: runSupervisor.status})
+	out.write(FRAME_RUN_STATUS, data)
+	runSupervisor.mu.Unlock()
+
+	// Nothing is expected from the relay, reading just detects the close
+	for {
+		if _, err := readFrame(in); err != nil {
+			break
+		}
+	}
+
+	runSupervisor.mu.Lock()
+	delete(runSupervisor.subscribers, out)
+	runSupervisor.mu.Unlock()
+}
+
+func (s *supervisor) snapshot() runStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *supervisor) start(spec *runSpec) error {
+	if spec == nil || strings.TrimSpace(spec.RunCommand) == "" {
+		return errors.New("run spec needs a runCommand")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done != nil {
+		return errors.New("already running, stop or restart it first")
+	}
+
+	s.spec = spec
+	s.stopping = false
+	s.stopCh = make(chan struct{})
+	s.done = make(chan struct{})
+	s.status = runStatus{
+		State:       RUN_STATE_INSTALLING,
+		RunCommand:  spec.RunCommand,
+		AutoRestart: spec.AutoRestart,
+		StartedAt:   time.Now().Unix(),
+	}
+	s.publishLocked("state")
+
+	go s.runLoop(spec, s.stopCh, s.done)
+	return nil
+}
+
+// Stop the current run and wait for it to be gone
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	done := s.done
+	if done == nil {
+		s.mu.Unlock()
+		return
+	}
+	if !s.stopping {
+		s.stopping = true
+		close(s.stopCh)
+		s.status.State = RUN_STATE_STOPPING
+		s.publishLocked("state")
+	}
+	pid := s.pid
+	s.mu.Unlock()
+
+	if pid != 0 {
+		syscall.Kill(-pid, syscall.SIGTERM)
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(runStopGracePeriod):
+	}
+
+	// The loop may have moved on to another step in the meantime
+	s.mu.Lock()
+	pid = s.pid
+	s.mu.Unlock()
+	if pid != 0 {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+	<-done
+}
+
+// Stop and start again, with the previous spec unless a new one is given
+func (s *supervisor) restart(spec *runSpec) error {
+	if spec == nil {
+		s.mu.Lock()
+		spec = s.spec
+		s.mu.Unlock()
+		if spec == nil {
+			return errors.New("nothing to restart")
+		}
+	}
+
+	s.stop()
+	return s.start(spec)
+}
+
+func (s *supervisor) runLoop(spec *runSpec, stopCh <-chan struct{}, done chan struct{}) {
+	defer func() {
+		s.mu.Lock()
+		s.done = nil
+		s.pid = 0
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	for i, command := range spec.InitCommands {
+		if strings.TrimSpace(command) == "" {
+			continue
+		}
+		code, stopped := s.runStep(spec, fmt.Sprintf("init_%d", i), command, RUN_STATE_INSTALLING)
+		if stopped {
+			s.finish(RUN_STATE_STOPPED, nil)
+			return
+		}
+		if code != 0 {
+			s.finish(RUN_STATE_FAILED, &code)
+			return
+		}
+	}
+
+	crashes := 0
+	for {
+		started := time.Now()
+		code, stopped := s.runStep(spec, "main_run", spec.RunCommand, RUN_STATE_RUNNING)
+		switch {
+		case stopped:
+			s.finish(RUN_STATE_STOPPED, &code)
+			return
+		case code == 0:
+			s.finish(RUN_STATE_EXITED, &code)
+			return
+		case !spec.AutoRestart:
+			s.finish(RUN_STATE_CRASHED, &code)
+			return
+		}
+
+		if time.Since(started) > restartResetUptime {
+			crashes = 0
+		}
+		crashes++
+		if crashes > PTY_HOST_RUN_MAX_RESTARTS {
+			log.Printf("Run command crashed %d times in a row, giving up", crashes)
+			s.finish(RUN_STATE_CRASHED, &code)
+			return
+		}
+
+		backoff := min(time.Duration(1<<(crashes-1))*time.Second, maxRestartBackoff)
+		s.mu.Lock()
+		s.status.State = RUN_STATE_RESTARTING
+		s.status.ExitCode = &code
+		s.status.Restarts++
+		s.publishLocked("state")
+		s.mu.Unlock()
+
+		log.Printf("Run command exited with %d, restarting in %v", code, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stopCh:
+			s.finish(RUN_STATE_STOPPED, &code)
+			return
+		}
+	}
+}
+
+// Run one command to completion. stopped reports whether a stop interrupted it.
+func (s *supervisor) runStep(spec *runSpec, step, command, state string) (code int, stopped bool) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = spec.Cwd
+	cmd.Env = os.Environ()
+	for key, value := range spec.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = runOutput{supervisor: s, kind: FRAME_STDOUT}
+	cmd.Stderr = runOutput{supervisor: s, kind: FRAME_STDERR}
+	cmd.WaitDelay = execOutputDrainTimeout
+
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return -1, true
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		s.output(FRAME_STDERR, []byte(fmt.Sprintf("failed to start %q: %v\n", command, err)))
+		return -1, false
+	}
+	s.pid = cmd.Process.Pid
+	s.status.State = state
+	s.status.Step = step
+	s.status.Pid = s.pid
+	s.status.ExitCode = nil
+	s.publishLocked("step_started")
+	s.mu.Unlock()
+	log.Printf("Run step %s started (%d): %s", step, cmd.Process.Pid, command)
+
+	cmd.Wait()
+	pid := cmd.Process.Pid
+	// Background jobs of the step go with it
+	syscall.Kill(-pid, syscall.SIGKILL)
+	code = cmd.ProcessState.ExitCode()
+
+	s.mu.Lock()
+	s.pid = 0
+	s.status.Pid = 0
+	s.status.ExitCode = &code
+	s.publishLocked("step_finished")
+	stopped = s.stopping
+	s.mu.Unlock()
+	log.Printf("Run step %s finished with code %d", step, code)
+	return code, stopped
+}
+
+func (s *supervisor) finish(state string, code *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.State = state
+	s.status.Pid = 0
+	if code != nil {
+		s.status.ExitCode = code
+	}
+	s.publishLocked("state")
+}
+
+// Send the current status to every subscriber. Callers hold s.mu.
+func (s *supervisor) publishLocked(event string) {
+	data, _ := json.Marshal(runEvent{Event: event, Status: s.status})
+	s.broadcastLocked(FRAME_RUN_STATUS, data)
+}
+
+func (s *supervisor) output(kind byte, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked(kind, p)
+}
+
+func (s *supervisor) broadcastLocked(kind byte, payload []byte) {
+	for subscriber := range s.subscribers {
+		if err := subscriber.write(kind, payload); err != nil {
+			delete(s.subscribers, subscriber)
+			subscriber.conn.Close()
+		}
+	}
+}
+
+// Streams the output of supervised processes to subscribers
+type runOutput struct {
+	supervisor *supervisor
+	kind       byte
+}
+
+func (w runOutput) Write(p []byte) (int, error) {
+	w.supervisor.output(w.kind, p)
+	return len(p), nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resource usage
+//
+// A FRAME_USAGE_SUBSCRIBE connection receives a FRAME_USAGE sample of the app container every
+// interval until it closes. The payload of the subscription may set the interval:
+//
+//	{"interval": 2000}
+//
+// Samples come from the container's cgroup (v2, or v1 when that is all there is) and from
+// /proc for the processes using the most memory. Rates are computed over the last interval.
+
+const (
+	defaultUsageInterval = 2 * time.Second
+	minUsageInterval     = 500 * time.Millisecond
+	topProcessCount      = 5
+	// USER_HZ, the unit of utime and stime in /proc/<pid>/stat
+	clockTicksPerSecond = 100
+	// cgroup v1 reports "no limit" as a page-rounded int64 max
+	cgroupV1Unlimited = uint64(1) << 62
+)
+
+var (
+	cgroupRoot = "/sys/fs/cgroup"
+	pageSize   = uint64(os.Getpagesize())
+)
+
+type memoryUsage struct {
+	UsageBytes uint64 `json:"usageBytes"`
+	// Usage without reclaimable page cache, what the OOM killer is up against
+	WorkingSetBytes uint64  `json:"workingSetBytes"`
+	LimitBytes      uint64  `json:"limitBytes"` // 0 when unlimited
+	Percent         float64 `json:"percent"`    // Working set of the limit
+}
+
+type cpuUsage struct {
+	Percent          float64 `json:"percent"`    // 100 is one core
+	LimitCores       float64 `json:"limitCores"` // 0 when unlimited
+	ThrottledPeriods uint64  `json:"throttledPeriods"`
+	ThrottledPercent float64 `json:"throttledPercent"` // Of the scheduler periods
+	ThrottledMs      uint64  `json:"throttledMs"`
+}
+
+type processUsage struct {
+	Pid        int     `json:"pid"`
+	Command    string  `json:"command"`
+	RSSBytes   uint64  `json:"rssBytes"`
+	CPUPercent float64 `json:"cpuPercent"`
+}
+
+type usageSample struct {
+	Timestamp int64          `json:"timestamp"` // Unix milliseconds
+	Memory    memoryUsage    `json:"memory"`
+	CPU       cpuUsage       `json:"cpu"`
+	OOMKills  uint64         `json:"oomKills"` // Since the container started
+	Processes []processUsage `json:"processes"`
+}
+
+// Raw cgroup counters
+type cgroupStats struct {
+	memoryUsage   uint64
+	memoryLimit   uint64
+	inactiveFile  uint64
+	oomKills      uint64
+	cpuUsageUsec  uint64
+	periods       uint64
+	throttled     uint64
+	throttledUsec uint64
+	cpuLimit      float64
+}
+
+// Keeps the counters of the previous sample to compute rates
+type usageSampler struct {
+	prev      cgroupStats
+	prevTicks map[int]uint64
+	prevAt    time.Time
+}
+
+func serveUsageSubscription(in io.Reader, out *frameWriter, payload []byte) {
+	var req struct {
+		Interval int `json:"interval"`
+	}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			log.Printf("Invalid usage subscription: %v", err)
+		}
+	}
+	interval := defaultUsageInterval
+	if req.Interval > 0 {
+		interval = max(time.Duration(req.Interval)*time.Millisecond, minUsageInterval)
+	}
+
+	// Nothing is expected from the relay, reading just detects the close
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := readFrame(in); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	sampler := &usageSampler{}
+	sampler.sample() // Baseline for the first rates
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			data, _ := json.Marshal(sampler.sample())
+			if err := out.write(FRAME_USAGE, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *usageSampler) sample() usageSample {
+	now := time.Now()
+	stats := readCgroupStats()
+	elapsed := now.Sub(s.prevAt)
+
+	sample := usageSample{
+		Timestamp: now.UnixMilli(),
+		OOMKills:  stats.oomKills,
+	}
+
+	sample.Memory.UsageBytes = stats.memoryUsage
+	sample.Memory.WorkingSetBytes = stats.memoryUsage
+	if stats.inactiveFile < stats.memoryUsage {
+		sample.Memory.WorkingSetBytes = stats.memoryUsage - stats.inactiveFile
+	}
+	sample.Memory.LimitBytes = stats.memoryLimit
+	if stats.memoryLimit > 0 {
+		sample.Memory.Percent = percent(float64(sample.Memory.WorkingSetBytes), float64(stats.memoryLimit))
+	}
+
+	sample.CPU.LimitCores = stats.cpuLimit
+	if !s.prevAt.IsZero() && elapsed > 0 {
+		sample.CPU.Percent = percent(float64(delta(stats.cpuUsageUsec, s.prev.cpuUsageUsec)), float64(elapsed.Microseconds()))
+		sample.CPU.ThrottledPeriods = delta(stats.throttled, s.prev.throttled)
+		sample.CPU.ThrottledPercent = percent(float64(sample.CPU.ThrottledPeriods), float64(delta(stats.periods, s.prev.periods)))
+		sample.CPU.ThrottledMs = delta(stats.throttledUsec, s.prev.throttledUsec) / 1000
+	}
+
+	ticks := make(map[int]uint64)
+	sample.Processes = s.topProcesses(ticks, elapsed)
+
+	s.prev = stats
+	s.prevTicks = ticks
+	s.prevAt = now
+	return sample
+}
+
+// The processes using the most memory. ticks is filled with the CPU time of every process.
+func (s *usageSampler) topProcesses(ticks map[int]uint64, elapsed time.Duration) []processUsage {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var processes []processUsage
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		command, cpuTicks, rssPages, ok := readProcessStat(pid)
+		if !ok {
+			continue
+		}
+		ticks[pid] = cpuTicks
+
+		process := processUsage{Pid: pid, Command: command, RSSBytes: rssPages * pageSize}
+		if previous, seen := s.prevTicks[pid]; seen && elapsed > 0 {
+			process.CPUPercent = percent(float64(delta(cpuTicks, previous))/clockTicksPerSecond, elapsed.Seconds())
+		}
+		processes = append(processes, process)
+	}
+
+	sort.Slice(processes, func(i, j int) bool { return processes[i].RSSBytes > processes[j].RSSBytes })
+	if len(processes) > topProcessCount {
+		processes = processes[:topProcessCount]
+	}
+	for i := range processes {
+		processes[i].Command = processCommand(processes[i].Pid, processes[i].Command)
+	}
+	return processes
+}
+
+// Name, utime+stime and resident pages from /proc/<pid>/stat
+func readProcessStat(pid int) (string, uint64, uint64, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0, 0, false
+	}
+	// The name is in parentheses and may contain spaces or parentheses itself
+	open, end := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+	if open < 0 || end < open {
+		return "", 0, 0, false
+	}
+	name := string(data[open+1 : end])
+
+	// Fields after the name, starting with the state (field 3 of proc(5))
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return "", 0, 0, false
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	return name, utime + stime, rss, true
+}
+
+// The command line of a process, shortened, or its name when it has none
+func processCommand(pid int, name string) string {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(data) == 0 {
+		return name
+	}
+	command := strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+	if len(command) > 120 {
+		command = command[:117] + "..."
+	}
+	return command
+}
+
+func readCgroupStats() cgroupStats {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return readCgroupV2Stats(cgroupRoot)
+	}
+	return readCgroupV1Stats(cgroupRoot)
+}
+
+func readCgroupV2Stats(dir string) cgroupStats {
+	var stats cgroupStats
+	stats.memoryUsage = readUint(filepath.Join(dir, "memory.current"))
+	stats.memoryLimit = readUint(filepath.Join(dir, "memory.max")) // "max" parses as 0
+	stats.inactiveFile = readKeyed(filepath.Join(dir, "memory.stat"))["inactive_file"]
+	stats.oomKills = readKeyed(filepath.Join(dir, "memory.events"))["oom_kill"]
+
+	cpu := readKeyed(filepath.Join(dir, "cpu.stat"))
+	stats.cpuUsageUsec = cpu["usage_usec"]
+	stats.periods = cpu["nr_periods"]
+	stats.throttled = cpu["nr_throttled"]
+	stats.throttledUsec = cpu["throttled_usec"]
+
+	// "<quota> <period>", the quota being "max" when unlimited
+	if fields := strings.Fields(readString(filepath.Join(dir, "cpu.max"))); len(fields) == 2 {
+		quota, quotaErr := strconv.ParseFloat(fields[0], 64)
+		period, periodErr := strconv.ParseFloat(fields[1], 64)
+		if quotaErr == nil && periodErr == nil && period > 0 {
+			stats.cpuLimit = quota / period
+		}
+	}
+	return stats
+}
+
+func readCgroupV1Stats(root string) cgroupStats {
+	var stats cgroupStats
+	memory := filepath.Join(root, "memory")
+	stats.memoryUsage = readUint(filepath.Join(memory, "memory.usage_in_bytes"))
+	if limit := readUint(filepath.Join(memory, "memory.limit_in_bytes")); limit < cgroupV1Unlimited {
+		stats.memoryLimit = limit
+	}
+	stats.inactiveFile = readKeyed(filepath.Join(memory, "memory.stat"))["total_inactive_file"]
+	stats.oomKills = readKeyed(filepath.Join(memory, "memory.oom_control"))["oom_kill"]
+
+	cpu := filepath.Join(root, "cpu,cpuacct")
+	if _, err := os.Stat(cpu); err != nil {
+		cpu = filepath.Join(root, "cpu")
+	}
+	cpuacct := filepath.Join(root, "cpuacct")
+	if _, err := os.Stat(cpuacct); err != nil {
+		cpuacct = cpu
+	}
+	stats.cpuUsageUsec = readUint(filepath.Join(cpuacct, "cpuacct.usage")) / 1000
+	cpuStat := readKeyed(filepath.Join(cpu, "cpu.stat"))
+	stats.periods = cpuStat["nr_periods"]
+	stats.throttled = cpuStat["nr_throttled"]
+	stats.throttledUsec = cpuStat["throttled_time"] / 1000
+
+	quota, quotaErr := strconv.ParseFloat(readString(filepath.Join(cpu, "cpu.cfs_quota_us")), 64)
+	period, periodErr := strconv.ParseFloat(readString(filepath.Join(cpu, "cpu.cfs_period_us")), 64)
+	if quotaErr == nil && periodErr == nil && quota > 0 && period > 0 {
+		stats.cpuLimit = quota / period
+	}
+	return stats
+}
+
+func readString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// A file holding one number, 0 when missing or not a number
+func readUint(path string) uint64 {
+	value, _ := strconv.ParseUint(readString(path), 10, 64)
+	return value
+}
+
+// A file of "<key> <value>" lines, such as memory.stat
+func readKeyed(path string) map[string]uint64 {
+	values := make(map[string]uint64)
+	file, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values
+}
+
+// Difference of two counters, 0 if the counter was reset
+func delta(current, previous uint64) uint64 {
+	if current < previous {
+		return 0
+	}
+	return current - previous
+}
+
+func percent(part, whole float64) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	// Two decimals are plenty for a gauge
+	return float64(int64(part/whole*10000)) / 100
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// Assertion results
+//
+// failAssertion in jest.setup.cjs throws a __DEVSARENA_ASSERTION__ payload, which the reporter
+// prints as the error of a FAILED_ASSERTION result. Test authors pass whatever they compared,
+// so expected and received can be any JSON value. The relay turns the payload into an
+// AssertionResult: both values rendered as text, a line diff when they are strings or objects,
+// and the place in the learner's file the failure points at, if any. The IDE highlights that
+// line and shows the diff.
+
+const (
+	ASSERTION_KIND_STRING = "string"
+	ASSERTION_KIND_OBJECT = "object" // Objects and arrays, rendered as indented JSON
+	ASSERTION_KIND_VALUE  = "value"  // Numbers, booleans, null and mixed kinds
+)
+
+const (
+	DIFF_EQUAL  = "equal"
+	DIFF_DELETE = "delete" // Only in expected
+	DIFF_INSERT = "insert" // Only in actual
+)
+
+const (
+	maxAssertionValue = 8 * 1024 // Bytes of a rendered value
+	maxDiffLines      = 400      // Lines of either side, longer values get no diff
+)
+
+type AssertionResult struct {
+	Kind     string          `json:"kind"`
+	Expected string          `json:"expected"`
+	Actual   string          `json:"actual"`
+	Diff     []DiffLine      `json:"diff,omitempty"`
+	Location *SourceLocation `json:"location,omitempty"`
+	Hint     string          `json:"hint,omitempty"`
+}
+
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// A place in the learner's code, relative to /workspace. Line and Column are 1-based, 0
+// when unknown.
+type SourceLocation struct {
+	File   string `json:"file"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+// What the reporter prints as the error of a failed assertion
+type assertionPayload struct {
+	Expected json.RawMessage
+	Actual   json.RawMessage
+	Location *SourceLocation
+}
+
+// TestError accepts any JSON value as expected and received, and keeps them for normalize.
+// Errors the relay stored itself, with their assertion, read back unchanged.
+func (e *TestError) UnmarshalJSON(data []byte) error {
+	type plainTestError TestError
+	var payload struct {
+		*plainTestError
+		Expected json.RawMessage `json:"expected"`
+		Received json.RawMessage `json:"received"`
+		Actual   json.RawMessage `json:"actual"`
+		File     string          `json:"file"`
+		Line     int             `json:"line"`
+		Column   int             `json:"column"`
+		Location *SourceLocation `json:"location"`
+	}
+	payload.plainTestError = (*plainTestError)(e)
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return err
+	}
+
+	if len(payload.Actual) == 0 {
+		payload.Actual = payload.Received
+	}
+	e.Expected, _ = renderAssertionValue(payload.Expected)
+	e.Received, _ = renderAssertionValue(payload.Actual)
+
+	location := payload.Location
+	if location == nil && payload.File != "" {
+		location = &SourceLocation{File: payload.File, Line: payload.Line, Column: payload.Column}
+	}
+	e.payload = &assertionPayload{Expected: payload.Expected, Actual: payload.Actual, Location: location}
+	return nil
+}
+
+// normalize fills in the assertion of a failed assertion's error, or checks the one it has
+func (e *TestError) normalize() {
+	if e.Assertion != nil {
+		e.Assertion.Location = cleanSourceLocation(e.Assertion.Location)
+		e.Assertion.Expected = truncate(e.Assertion.Expected, maxAssertionValue)
+		e.Assertion.Actual = truncate(e.Assertion.Actual, maxAssertionValue)
+		return
+	}
+	if e.payload == nil || (len(e.payload.Expected) == 0 && len(e.payload.Actual) == 0) {
+		return
+	}
+
+	expected, expectedKind := renderAssertionValue(e.payload.Expected)
+	actual, actualKind := renderAssertionValue(e.payload.Actual)
+	kind := expectedKind
+	if expectedKind != actualKind {
+		kind = ASSERTION_KIND_VALUE
+	}
+
+	assertion := &AssertionResult{
+		Kind:     kind,
+		Expected: truncate(expected, maxAssertionValue),
+		Actual:   truncate(actual, maxAssertionValue),
+		Location: cleanSourceLocation(e.payload.Location),
+		Hint:     e.Hint,
+	}
+	if kind != ASSERTION_KIND_VALUE && expected != actual {
+		assertion.Diff = diffLines(expected, actual)
+	}
+	e.Assertion = assertion
+}
+
+// The assertion of a judged case with the wrong output
+func outputAssertion(expected, actual, hint string) *AssertionResult {
+	assertion := &AssertionResult{
+		Kind:     ASSERTION_KIND_STRING,
+		Expected: truncate(expected, maxAssertionValue),
+		Actual:   truncate(actual, maxAssertionValue),
+		Hint:     hint,
+	}
+	if expected != actual {
+		assertion.Diff = diffLines(expected, actual)
+	}
+	return assertion
+}
+
+// A value as text, a string as is and anything else as JSON, with its kind
+func renderAssertionValue(raw json.RawMessage) (string, string) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", ASSERTION_KIND_VALUE
+	}
+
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text, ASSERTION_KIND_STRING
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return string(raw), ASSERTION_KIND_VALUE
+	}
+	switch value.(type) {
+	case map[string]any, []any:
+		// Keys come out sorted, so the same objects diff equal
+		var rendered bytes.Buffer
+		encoder := json.NewEncoder(&rendered)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if encoder.Encode(value) == nil {
+			return strings.TrimSuffix(rendered.String(), "\n"), ASSERTION_KIND_OBJECT
+		}
+	}
+	return string(raw), ASSERTION_KIND_VALUE
+}
+
+// Only files in the workspace, relative to it; the tests' own files are not the learner's
+func cleanSourceLocation(location *SourceLocation) *SourceLocation {
+	if location == nil {
+		return nil
+	}
+	file := strings.TrimPrefix(strings.TrimSpace(location.File), "/workspace/")
+	file = path.Clean(file)
+	if file == "." || path.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") || strings.HasPrefix(file, "node_modules/") {
+		return nil
+	}
+	return &SourceLocation{File: file, Line: max(location.Line, 0), Column: max(location.Column, 0)}
+}
+
+// diffLines turns expected into actual line by line, through their longest common
+// subsequence
+func diffLines(expected, actual string) []DiffLine {
+	a, b := strings.Split(expected, "\n"), strings.Split(actual, "\n")
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return nil
+	}
+
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	diff := []DiffLine{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, DiffLine{Op: DIFF_EQUAL, Text: a[i]})
+			i, j = i+1, j+1
+		case common[i+1][j] >= common[i][j+1]:
+			diff = append(diff, DiffLine{Op: DIFF_DELETE, Text: a[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: DIFF_INSERT, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, DiffLine{Op: DIFF_DELETE, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, DiffLine{Op: DIFF_INSERT, Text: b[j]})
+	}
+	return diff
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Normalize the error a reporter printed
+func normalizedError(t *testing.T, payload string) TestError {
+	var testError TestError
+	if err := json.Unmarshal([]byte(payload), &testError); err != nil {
+		t.Fatalf("expected the error to unmarshal; got %v", err)
+	}
+	testError.normalize()
+	return testError
+}
+
+func TestDiffLinesOfEqualValues(t *testing.T) {
+	diff := diffLines("a\nb", "a\nb")
+	if len(diff) != 2 || diff[0] != (DiffLine{DIFF_EQUAL, "a"}) || diff[1] != (DiffLine{DIFF_EQUAL, "b"}) {
+		t.Errorf("expected two equal lines; got %v", diff)
+	}
+}
+
+func TestDiffLinesOfAChangedLine(t *testing.T) {
+	diff := diffLines("a\nb\nc", "a\nx\nc")
+	want := []DiffLine{{DIFF_EQUAL, "a"}, {DIFF_DELETE, "b"}, {DIFF_INSERT, "x"}, {DIFF_EQUAL, "c"}}
+	if len(diff) != len(want) {
+		t.Fatalf("expected %v; got %v", want, diff)
+	}
+	for i := range want {
+		if diff[i] != want[i] {
+			t.Errorf("expected line %d to be %v; got %v", i, want[i], diff[i])
+		}
+	}
+}
+
+func TestDiffLinesOfMissingAndExtraLines(t *testing.T) {
+	diff := diffLines("a\nb\nc", "a\nc")
+	if len(diff) != 3 || diff[1] != (DiffLine{DIFF_DELETE, "b"}) {
+		t.Errorf("expected b to be deleted; got %v", diff)
+	}
+
+	diff = diffLines("a", "a\nb\nc")
+	if len(diff) != 3 || diff[1].Op != DIFF_INSERT || diff[2].Op != DIFF_INSERT {
+		t.Errorf("expected b and c to be inserted; got %v", diff)
+	}
+}
+
+func TestDiffLinesOfLongValues(t *testing.T) {
+	if diff := diffLines(strings.Repeat("a\n", maxDiffLines+1), "a"); diff != nil {
+		t.Errorf("expected no diff of %d lines; got %d lines", maxDiffLines+1, len(diff))
+	}
+}
+
+func TestNormalizeStrings(t *testing.T) {
+	testError := normalizedError(t, `{"message":"wrong greeting","expected":"hello\nworld","received":"hello\nthere","hint":"check the name"}`)
+	assertion := testError.Assertion
+	if assertion == nil {
+		t.Fatal("expected an assertion; got none")
+	}
+	if assertion.Kind != ASSERTION_KIND_STRING || assertion.Expected != "hello\nworld" || assertion.Actual != "hello\nthere" || assertion.Hint != "check the name" {
+		t.Errorf("expected the string values and hint; got %+v", assertion)
+	}
+	if len(assertion.Diff) == 0 {
+		t.Errorf("expected a diff of the strings")
+	}
+	if testError.Expected != "hello\nworld" {
+		t.Errorf("expected the error to keep its expected value; got %q", testError.Expected)
+	}
+}
+
+func TestNormalizeObjects(t *testing.T) {
+	assertion := normalizedError(t, `{"expected":{"b":1,"a":[1,2]},"actual":{"a":[1,2],"b":1}}`).Assertion
+	rendered := "{\n  \"a\": [\n    1,\n    2\n  ],\n  \"b\": 1\n}"
+	if assertion == nil || assertion.Kind != ASSERTION_KIND_OBJECT {
+		t.Fatalf("expected an object assertion; got %+v", assertion)
+	}
+	if assertion.Expected != rendered || assertion.Actual != rendered {
+		t.Errorf("expected both objects rendered with sorted keys; got %q and %q", assertion.Expected, assertion.Actual)
+	}
+}
+
+func TestNormalizeValues(t *testing.T) {
+	assertion := normalizedError(t, `{"expected":4,"received":5}`).Assertion
+	if assertion == nil || assertion.Kind != ASSERTION_KIND_VALUE || assertion.Expected != "4" || assertion.Actual != "5" {
+		t.Fatalf("expected a value assertion of 4 and 5; got %+v", assertion)
+	}
+	if assertion.Diff != nil {
+		t.Errorf("expected no diff of numbers; got %v", assertion.Diff)
+	}
+
+	assertion = normalizedError(t, `{"expected":"4","received":4}`).Assertion
+	if assertion == nil || assertion.Kind != ASSERTION_KIND_VALUE {
+		t.Errorf("expected a string and a number to be values; got %+v", assertion)
+	}
+}
+
+func TestNormalizeLocations(t *testing.T) {
+	location := normalizedError(t, `{"expected":"a","received":"b","file":"/workspace/src/index.js","line":3,"column":7}`).Assertion.Location
+	if location == nil || *location != (SourceLocation{File: "src/index.js", Line: 3, Column: 7}) {
+		t.Errorf("expected the location relative to the workspace; got %+v", location)
+	}
+
+	location = normalizedError(t, `{"expected":"a","received":"b","location":{"file":"/internal-test/checkpoint-1.test.js","line":3}}`).Assertion.Location
+	if location != nil {
+		t.Errorf("expected a location outside the workspace to be dropped; got %+v", location)
+	}
+
+	location = normalizedError(t, `{"expected":"a","received":"b","file":"node_modules/jest/index.js","line":1}`).Assertion.Location
+	if location != nil {
+		t.Errorf("expected a location in node_modules to be dropped; got %+v", location)
+	}
+}
+
+func TestNormalizeKeepsStoredAssertions(t *testing.T) {
+	assertion := normalizedError(t, `{"assertion":{"kind":"string","expected":"a","actual":"b","location":{"file":"/workspace/app.js","line":2}}}`).Assertion
+	if assertion == nil || assertion.Kind != ASSERTION_KIND_STRING || assertion.Expected != "a" || assertion.Actual != "b" {
+		t.Fatalf("expected the stored assertion; got %+v", assertion)
+	}
+	if assertion.Location == nil || assertion.Location.File != "app.js" {
+		t.Errorf("expected its location relative to the workspace; got %+v", assertion.Location)
+	}
+}
+
+func TestNormalizeWithoutValues(t *testing.T) {
+	if assertion := normalizedError(t, `{"message":"TypeError: x is not a function"}`).Assertion; assertion != nil {
+		t.Errorf("expected no assertion without values; got %+v", assertion)
+	}
+}
+
+func TestNormalizeTruncatesValues(t *testing.T) {
+	long, _ := json.Marshal(strings.Repeat("x", maxAssertionValue*2))
+	assertion := normalizedError(t, `{"expected":"x","received":`+string(long)+`}`).Assertion
+	if assertion == nil {
+		t.Fatal("expected an assertion; got none")
+	}
+	if len(assertion.Actual) != maxAssertionValue+len("...") {
+		t.Errorf("expected the actual value cut to %d bytes; got %d", maxAssertionValue+len("..."), len(assertion.Actual))
+	}
+	if assertion.Diff == nil {
+		t.Errorf("expected a diff of the truncated values")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Backend protocol
+//
+// PTY_BACKEND_PROTOCOL selects how keystrokes reach the shell backend:
+//
+//	raw    - bytes are written as-is (the socat bridge); resize is not supported
+//	framed - the pty-host framing: a type byte, a big-endian uint32 length and the
+//	         payload, where type 0 carries input and type 1 a window size (rows and
+//	         columns as big-endian uint16)
+//
+// Output is unframed in both modes. The pty-host also serves exec requests on its control
+// port (PTY_CONTROL_ADDR), framed in both directions (see exec.go).
+
+const (
+	BACKEND_PROTOCOL_RAW    = "raw"
+	BACKEND_PROTOCOL_FRAMED = "framed"
+)
+
+const (
+	FRAME_DATA   byte = 0
+	FRAME_RESIZE byte = 1
+)
+
+const (
+	frameHeaderSize = 5
+	maxFrameSize    = 1024 * 1024 // 1 MB
+)
+
+const maxTerminalDimension = 1000
+
+type resizeRequest struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// Read the backend protocol and control address from the environment
+func loadBackendConfig() {
+	protocol := os.Getenv("PTY_BACKEND_PROTOCOL")
+	switch protocol {
+	case "":
+	case BACKEND_PROTOCOL_RAW, BACKEND_PROTOCOL_FRAMED:
+		PTY_BACKEND_PROTOCOL = protocol
+	default:
+		log.Printf("Unknown PTY_BACKEND_PROTOCOL %q, keeping %q", protocol, PTY_BACKEND_PROTOCOL)
+	}
+
+	if network := os.Getenv("PTY_CONTROL_NETWORK"); network != "" {
+		PTY_CONTROL_NETWORK = network
+	}
+	if addr := os.Getenv("PTY_CONTROL_ADDR"); addr != "" {
+		PTY_CONTROL_ADDR = addr
+	}
+}
+
+// Write keystrokes to the session's shell
+func (s *ptySession) Write(p []byte) (int, error) {
+	if s.recorder != nil {
+		s.recorder.input(p)
+	}
+
+	if !s.framed {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		return s.backend.Write(p)
+	}
+
+	if err := s.writeFrame(FRAME_DATA, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Apply a terminal window size to the session's shell
+func (s *ptySession) resize(size resizeRequest) error {
+	if !s.framed {
+		return fmt.Errorf("resize is not supported by the %s backend", BACKEND_PROTOCOL_RAW)
+	}
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], size.Rows)
+	binary.BigEndian.PutUint16(payload[2:4], size.Cols)
+	if err := s.writeFrame(FRAME_RESIZE, payload); err != nil {
+		return err
+	}
+
+	if s.recorder != nil {
+		s.recorder.resize(size)
+	}
+	return nil
+}
+
+func (s *ptySession) writeFrame(kind byte, payload []byte) error {
+	// Frames must not interleave
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeFrame(s.backend, kind, payload)
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read one frame from a framed pty-host connection
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds maximum size", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// Decode and validate a window size
+func parseResizeRequest(raw json.RawMessage) (resizeRequest, error) {
+	var size resizeRequest
+	if err := decodeMessageData(raw, &size); err != nil {
+		return size, fmt.Errorf("invalid resize payload: %w", err)
+	}
+	if size.Rows == 0 || size.Cols == 0 || size.Rows > maxTerminalDimension || size.Cols > maxTerminalDimension {
+		return size, fmt.Errorf("invalid terminal size %dx%d", size.Cols, size.Rows)
+	}
+	return size, nil
+}
+
+func (h *PtyHandler) handleResize(msg inboundMessage) {
+	session := h.sessionFor(msg)
+	if session == nil {
+		return
+	}
+
+	size, err := parseResizeRequest(msg.Data)
+	if err == nil {
+		err = session.resize(size)
+	}
+	if err != nil {
+		log.Printf("Resize of session %s failed: %v", session.id, err)
+		h.sendMessage(outboundMessage{Type: "session_error", Session: msg.Session, Data: map[string]any{"message": err.Error()}})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+)
+
+// Write with a session and return the bytes its backend received. The pty-host
+// reads the same bytes, see pty-host/frame_test.go
+func backendBytes(t *testing.T, framed bool, n int, write func(s *ptySession) error) []byte {
+	host, relay := net.Pipe()
+	defer host.Close()
+	defer relay.Close()
+	session := &ptySession{id: "test", backend: relay, framed: framed}
+
+	errs := make(chan error, 1)
+	go func() { errs <- write(session) }()
+
+	received := make([]byte, n)
+	if _, err := io.ReadFull(host, received); err != nil {
+		t.Fatalf("expected %d bytes on the backend; got %v", n, err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected the write to succeed; got %v", err)
+	}
+	return received
+}
+
+func TestFramedSessionWritesDataFrames(t *testing.T) {
+	received := backendBytes(t, true, 8, func(s *ptySession) error {
+		_, err := s.Write([]byte("ls\r"))
+		return err
+	})
+	if want := []byte{FRAME_DATA, 0, 0, 0, 3, 'l', 's', '\r'}; !bytes.Equal(received, want) {
+		t.Errorf("expected %v; got %v", want, received)
+	}
+}
+
+func TestFramedSessionWritesResizeFrames(t *testing.T) {
+	received := backendBytes(t, true, 9, func(s *ptySession) error {
+		return s.resize(resizeRequest{Rows: 24, Cols: 80})
+	})
+	if want := []byte{FRAME_RESIZE, 0, 0, 0, 4, 0, 24, 0, 80}; !bytes.Equal(received, want) {
+		t.Errorf("expected %v; got %v", want, received)
+	}
+}
+
+func TestRawSessionWritesKeystrokesAsIs(t *testing.T) {
+	received := backendBytes(t, false, 3, func(s *ptySession) error {
+		_, err := s.Write([]byte("ls\r"))
+		return err
+	})
+	if string(received) != "ls\r" {
+		t.Errorf("expected the keystrokes unframed; got %v", received)
+	}
+
+	session := &ptySession{id: "test"}
+	if err := session.resize(resizeRequest{Rows: 24, Cols: 80}); err == nil {
+		t.Errorf("expected the raw backend to refuse a resize")
+	}
+}
+
+func TestParseResizeRequest(t *testing.T) {
+	size, err := parseResizeRequest(json.RawMessage(`{"rows":24,"cols":80}`))
+	if err != nil || size != (resizeRequest{Rows: 24, Cols: 80}) {
+		t.Errorf("expected 24x80; got %+v, %v", size, err)
+	}
+
+	size, err = parseResizeRequest(json.RawMessage(`"{\"rows\":30,\"cols\":120}"`))
+	if err != nil || size != (resizeRequest{Rows: 30, Cols: 120}) {
+		t.Errorf("expected a JSON encoded string to parse as 30x120; got %+v, %v", size, err)
+	}
+
+	size, err = parseResizeRequest(json.RawMessage(`{"rows":1000,"cols":1000}`))
+	if err != nil || size != (resizeRequest{Rows: maxTerminalDimension, Cols: maxTerminalDimension}) {
+		t.Errorf("expected the largest window to parse; got %+v, %v", size, err)
+	}
+
+	for _, data := range []string{`{"rows":0,"cols":80}`, `{"rows":24}`, `{"rows":24,"cols":1001}`, `{"rows":-1,"cols":80}`, `rows`} {
+		if _, err := parseResizeRequest(json.RawMessage(data)); err == nil {
+			t.Errorf("expected %s to be refused", data)
+		}
+	}
+}
+
+// The message usePty sends when the terminal is resized
+func TestParseResizeRequestOfTheClient(t *testing.T) {
+	var msg inboundMessage
+	if err := json.Unmarshal([]byte(`{"type":"resize","data":{"cols":120,"rows":30}}`), &msg); err != nil {
+		t.Fatalf("expected the message to unmarshal; got %v", err)
+	}
+
+	size, err := parseResizeRequest(msg.Data)
+	if err != nil || size != (resizeRequest{Rows: 30, Cols: 120}) {
+		t.Errorf("expected 30 rows of 120 columns; got %+v, %v", size, err)
+	}
+}
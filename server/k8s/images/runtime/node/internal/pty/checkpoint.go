@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checkpoint tests
+//
+// Tests run through the pod-local test runner service (test-runner-service.js in the grader
+// sidecar, which alone has the tests and sees the workspace read-only), which runs Jest with
+// the DevsArena reporter. Requests carry GRADER_TOKEN, so nothing but the relay can ask for
+// results. The service streams the reporter's progress as JSON lines, then the runner's
+// output. The service refuses to run tests that do not match the manifest the server signed
+// for the lab (bundle_invalid, see k8s/bundle.go). Runs are queued, see queue.go.
+//
+// The learner's code runs in the same process as the reporter and may print anything. Every
+// request therefore carries a fresh nonce, which the service hands to the reporter on stdin,
+// and only the progress and result lines that carry it count (see resultLinePrefix).
+
+type TestStatus string
+
+// Statuses printed by jest.reporter.cjs
+const (
+	TestPassed          TestStatus = "PASSED"
+	TestFailedAssertion TestStatus = "FAILED_ASSERTION"
+	TestFailedRuntime   TestStatus = "FAILED_RUNTIME"
+	// Set by test-runner-service.js when it killed the run
+	TestTimeLimitExceeded   TestStatus = "TIME_LIMIT_EXCEEDED"
+	TestMemoryLimitExceeded TestStatus = "MEMORY_LIMIT_EXCEEDED"
+)
+
+const (
+	TEST_ERROR_INVALID_REQUEST    = "invalid_request"
+	TEST_ERROR_RUNNER_UNAVAILABLE = "runner_unavailable"
+	TEST_ERROR_TIMEOUT            = "timeout"
+	TEST_ERROR_RUNNER_FAILED      = "runner_failed"
+	TEST_ERROR_MALFORMED_OUTPUT   = "malformed_output"
+	TEST_ERROR_CANCELLED          = "cancelled"
+	TEST_ERROR_QUEUE_FULL         = "queue_full"
+	// The grader refused the checkpoint's tests: missing, or not what the server signed
+	TEST_ERROR_BUNDLE_INVALID = "bundle_invalid"
+)
+
+const maxTestRunnerOutput = 1024 * 1024 // 1 MB
+
+// Details of a failed check, as passed to failAssertion in jest.setup.cjs
+type TestError struct {
+	Scenario string `json:"scenario,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Received string `json:"received,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	Message  string `json:"message,omitempty"`
+	// Set for failed assertions, see assertion.go
+	Assertion *AssertionResult `json:"assertion,omitempty"`
+
+	payload *assertionPayload
+}
+
+type DevsArenaRunnerResult struct {
+	Checkpoint int        `json:"checkpoint"`
+	Status     TestStatus `json:"status"`
+	DurationMs int64      `json:"durationMs"`
+	Error      *TestError `json:"error,omitempty"`
+	// Set by the queue, identify the run in the lab's history and in submissions
+	RunID       string `json:"runId,omitempty"`
+	CompletedAt int64  `json:"completedAt,omitempty"`
+	// Hidden tests report counts instead of details, see hidden.go
+	Hidden bool        `json:"hidden,omitempty"`
+	Tests  *TestCounts `json:"tests,omitempty"`
+}
+
+type DevsArenaRunnerFinal struct {
+	Results []DevsArenaRunnerResult `json:"results"`
+}
+
+// Limits of a checkpoint's test run, enforced by the test runner service on the whole process
+// tree. Zero leaves the service's default.
+type TestLimits struct {
+	TimeMs   int `json:"timeMs"`   // Wall-clock
+	CPUMs    int `json:"cpuMs"`    // CPU time of every process together
+	MemoryMB int `json:"memoryMb"` // Resident memory of every process together
+}
+
+// How much longer than its time limit the relay waits for a run
+const testLimitGracePeriod = 30 * time.Second
+
+// Ask the service for the limits that are set
+func (l TestLimits) apply(query url.Values) {
+	if l.TimeMs > 0 {
+		query.Set("timeMs", strconv.Itoa(l.TimeMs))
+	}
+	if l.CPUMs > 0 {
+		query.Set("cpuMs", strconv.Itoa(l.CPUMs))
+	}
+	if l.MemoryMB > 0 {
+		query.Set("memoryMb", strconv.Itoa(l.MemoryMB))
+	}
+}
+
+// How long to wait for a run: TEST_RUNNER_TIMEOUT, or longer for a longer time limit
+func (l TestLimits) wait() time.Duration {
+	return max(TEST_RUNNER_TIMEOUT, time.Duration(l.TimeMs)*time.Millisecond+testLimitGracePeriod)
+}
+
+// A progress event of jest.reporter.cjs: run_started, suite_started, test_passed,
+// test_failed, test_skipped or suite_finished
+type TestProgress struct {
+	Event      string `json:"event"`
+	Suites     int    `json:"suites,omitempty"`
+	File       string `json:"file,omitempty"`
+	Name       string `json:"name,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	Passed     int    `json:"passed,omitempty"`
+	Failed     int    `json:"failed,omitempty"`
+	// The suite of a final submission the event belongs to, set by the relay
+	Suite string `json:"suite,omitempty"`
+	// The verdict of a judged case, see judge.go
+	Verdict string `json:"verdict,omitempty"`
+}
+
+// A line of the service's stream
+type testRunnerStreamLine struct {
+	Progress *TestProgress `json:"progress"`
+	Output   *string       `json:"output"`
+	Error    string        `json:"error"`
+	Code     string        `json:"code"`
+}
+
+type testRunnerError struct {
+	Code    string
+	Message string
+}
+
+func (e *testRunnerError) Error() string {
+	return e.Message
+}
+
+func newTestRunnerError(code, format string, args ...any) error {
+	return &testRunnerError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// The TEST_ERROR_* code of an error returned by RunCheckpointTestForClient
+func testErrorCode(err error) string {
+	var runnerErr *testRunnerError
+	if errors.As(err, &runnerErr) {
+		return runnerErr.Code
+	}
+	return TEST_ERROR_RUNNER_FAILED
+}
+
+// Read test runner overrides from the environment
+func loadTestRunnerConfig() {
+	host, port := "127.0.0.1", "9901"
+	if _, currentPort, err := net.SplitHostPort(TEST_RUNNER_ADDR); err == nil {
+		port = currentPort
+	}
+	if value := os.Getenv("TEST_RUNNER_HOST"); value != "" {
+		host = value
+	}
+	if value := os.Getenv("TEST_RUNNER_PORT"); value != "" {
+		port = value
+	}
+	TEST_RUNNER_ADDR = net.JoinHostPort(host, port)
+
+	if timeout := os.Getenv("TEST_RUNNER_TIMEOUT"); timeout != "" {
+		if duration, err := time.ParseDuration(timeout); err == nil && duration > 0 {
+			TEST_RUNNER_TIMEOUT = duration
+		} else {
+			log.Printf("Invalid TEST_RUNNER_TIMEOUT %q", timeout)
+		}
+	}
+
+	if count := os.Getenv("QUEST_CHECKPOINT_COUNT"); count != "" {
+		if parsed, err := strconv.Atoi(count); err == nil && parsed >= 0 {
+			QUEST_CHECKPOINT_COUNT = parsed
+		} else {
+			log.Printf("Invalid QUEST_CHECKPOINT_COUNT %q", count)
+		}
+	}
+	QUEST_FINAL_TESTS = os.Getenv("QUEST_FINAL_TESTS") == "true"
+	GRADER_TOKEN = os.Getenv("GRADER_TOKEN")
+
+	// Base64 encoded JSON of the limits by checkpoint: {"2": {"timeMs": 5000, "memoryMb": 256}}
+	if encoded := os.Getenv("QUEST_CHECKPOINT_LIMITS"); encoded != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			err = json.Unmarshal(decoded, &QUEST_CHECKPOINT_LIMITS)
+		}
+		if err != nil {
+			log.Printf("Invalid QUEST_CHECKPOINT_LIMITS: %v", err)
+		}
+	}
+}
+
+func parseCheckpoint(checkpointID string) (int, error) {
+	checkpoint, err := strconv.Atoi(strings.TrimSpace(checkpointID))
+	if err != nil || checkpoint < 0 {
+		return 0, newTestRunnerError(TEST_ERROR_INVALID_REQUEST, "invalid checkpoint %q", checkpointID)
+	}
+	return checkpoint, nil
+}
+
+// Run the tests of a checkpoint within its limits and wait for their result, at most
+// TEST_RUNNER_TIMEOUT. Cancelling ctx stops the run. onProgress, if set, gets the reporter's
+// progress. Results and progress of hidden suites are redacted.
+func RunCheckpointTestForClient(ctx context.Context, checkpointID, language string, onProgress func(TestProgress)) (DevsArenaRunnerFinal, error) {
+	checkpoint, err := parseCheckpoint(checkpointID)
+	if err != nil {
+		return DevsArenaRunnerFinal{}, err
+	}
+	query := url.Values{"checkpoint": {strconv.Itoa(checkpoint)}}
+	if !QUEST_HIDDEN_CHECKPOINTS[checkpoint] {
+		return runTestSuite(ctx, query, checkpoint, language, QUEST_CHECKPOINT_LIMITS[checkpoint], onProgress)
+	}
+
+	var counter testCounter
+	final, err := runTestSuite(ctx, query, checkpoint, language, QUEST_CHECKPOINT_LIMITS[checkpoint], func(progress TestProgress) {
+		counter.count(progress)
+		if onProgress != nil {
+			onProgress(hideTestProgress(progress))
+		}
+	})
+	for i := range final.Results {
+		hideTestResult(&final.Results[i], counter)
+	}
+	return final, err
+}
+
+// Ask the service for one run, at most limits.wait(). query selects the suite, results
+// without a checkpoint are given checkpoint.
+func runTestSuite(ctx context.Context, query url.Values, checkpoint int, language string, limits TestLimits, onProgress func(TestProgress)) (DevsArenaRunnerFinal, error) {
+	timeout := limits.wait()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	nonce, err := newResultNonce()
+	if err != nil {
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_RUNNER_FAILED, "%v", err)
+	}
+	query.Set("nonce", nonce)
+	limits.apply(query)
+	query.Set("stream", "1")
+	if language != "" {
+		query.Set("language", language)
+	}
+	endpoint := fmt.Sprintf("http://%s/run?%s", TEST_RUNNER_ADDR, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_INVALID_REQUEST, "invalid test request: %v", err)
+	}
+	if GRADER_TOKEN != "" {
+		req.Header.Set("Authorization", "Bearer "+GRADER_TOKEN)
+	}
+
+	started := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DevsArenaRunnerFinal{}, classifyTestRunnerError(ctx, err, timeout)
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		body, err = readTestRunnerStream(resp.Body, onProgress)
+	} else {
+		// A service that does not stream answers with the output alone
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxTestRunnerOutput))
+	}
+	if err != nil {
+		var runnerErr *testRunnerError
+		if errors.As(err, &runnerErr) {
+			return DevsArenaRunnerFinal{}, err
+		}
+		return DevsArenaRunnerFinal{}, classifyTestRunnerError(ctx, err, timeout)
+	}
+	duration := time.Since(started)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_RUNNER_UNAVAILABLE, "test runner rejected the grader token")
+	case resp.StatusCode == http.StatusConflict:
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_BUNDLE_INVALID, "%s", runnerMessage(body))
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_RUNNER_UNAVAILABLE, "test runner unavailable: %s", runnerMessage(body))
+	case resp.StatusCode != http.StatusOK:
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_RUNNER_FAILED, "test runner answered %d: %s", resp.StatusCode, runnerMessage(body))
+	}
+
+	result, err := parseTestRunnerOutput(body, nonce, checkpoint, duration)
+	if err != nil {
+		log.Printf("Unusable test runner output for checkpoint %d: %q", checkpoint, truncate(string(body), 2000))
+		return DevsArenaRunnerFinal{}, err
+	}
+	return result, nil
+}
+
+// Relay progress lines and return the runner's output
+func readTestRunnerStream(r io.Reader, onProgress func(TestProgress)) ([]byte, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxTestRunnerOutput+64*1024)
+	for scanner.Scan() {
+		var line testRunnerStreamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "invalid test runner stream: %v", err)
+		}
+		switch {
+		case line.Code == TEST_ERROR_BUNDLE_INVALID:
+			return nil, newTestRunnerError(TEST_ERROR_BUNDLE_INVALID, "%s", line.Error)
+		case line.Error != "":
+			return nil, newTestRunnerError(TEST_ERROR_RUNNER_UNAVAILABLE, "test runner unavailable: %s", line.Error)
+		case line.Output != nil:
+			return []byte(*line.Output), nil
+		case line.Progress != nil && line.Progress.Event != "" && onProgress != nil:
+			onProgress(*line.Progress)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, newTestRunnerError(TEST_ERROR_RUNNER_FAILED, "test runner stream ended without a result")
+}
+
+func classifyTestRunnerError(ctx context.Context, err error, timeout time.Duration) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return newTestRunnerError(TEST_ERROR_CANCELLED, "test run cancelled")
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return newTestRunnerError(TEST_ERROR_TIMEOUT, "tests did not finish within %v", timeout)
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return newTestRunnerError(TEST_ERROR_RUNNER_UNAVAILABLE, "test runner unavailable at %s", TEST_RUNNER_ADDR)
+	}
+	return newTestRunnerError(TEST_ERROR_RUNNER_FAILED, "test runner request failed: %v", err)
+}
+
+// Prefix of the line with a run's result: the prefix, the run's nonce, a colon and the result
+// as JSON, either the final result of several checkpoints or the reporter's single result
+const resultLinePrefix = "__DEVSARENA_RESULT__:"
+
+func newResultNonce() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate result nonce: %w", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Find the result line of the run with nonce in the runner's output. Anything else the run
+// printed, results included, comes from code under test and is ignored.
+func parseTestRunnerOutput(output []byte, nonce string, checkpoint int, duration time.Duration) (DevsArenaRunnerFinal, error) {
+	if len(bytes.TrimSpace(output)) == 0 {
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "test runner returned no output")
+	}
+
+	prefix := []byte(resultLinePrefix + nonce + ":")
+	var line []byte
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), maxTestRunnerOutput)
+	for scanner.Scan() {
+		if rest, found := bytes.CutPrefix(bytes.TrimSpace(scanner.Bytes()), prefix); found {
+			line = rest
+			break
+		}
+	}
+	if line == nil {
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "test runner output has no result")
+	}
+
+	var final DevsArenaRunnerFinal
+	if err := json.Unmarshal(line, &final); err != nil {
+		return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "invalid test result: %v", err)
+	}
+	if len(final.Results) == 0 {
+		var result DevsArenaRunnerResult
+		if err := json.Unmarshal(line, &result); err != nil || result.Status == "" {
+			return DevsArenaRunnerFinal{}, newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "test result has no status")
+		}
+		final.Results = []DevsArenaRunnerResult{result}
+	}
+	for i := range final.Results {
+		if err := completeTestResult(&final.Results[i], checkpoint, duration); err != nil {
+			return DevsArenaRunnerFinal{}, err
+		}
+	}
+	return final, nil
+}
+
+// Check the status and fill in what the reporter does not know
+func completeTestResult(result *DevsArenaRunnerResult, checkpoint int, duration time.Duration) error {
+	switch result.Status {
+	case TestPassed, TestFailedAssertion, TestFailedRuntime, TestTimeLimitExceeded, TestMemoryLimitExceeded:
+	default:
+		return newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "unknown test status %q", result.Status)
+	}
+	if result.Checkpoint == 0 {
+		result.Checkpoint = checkpoint
+	}
+	if result.DurationMs == 0 {
+		result.DurationMs = duration.Milliseconds()
+	}
+	if result.Status != TestPassed && result.Error == nil {
+		result.Error = &TestError{Message: "Tests failed without details"}
+	}
+	if result.Status == TestFailedAssertion {
+		result.Error.normalize()
+	}
+	return nil
+}
+
+// The error of a JSON error response, or the start of the body
+func runnerMessage(body []byte) string {
+	var response struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &response) == nil && response.Error != "" {
+		return response.Error
+	}
+	return truncate(strings.TrimSpace(string(body)), 200)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testNonce = "0123456789abcdef"
+
+func TestParseTestRunnerOutputTakesTheFramedResult(t *testing.T) {
+	output := "PASS /internal-test/checkpoint-2.test.js\n" +
+		resultLinePrefix + testNonce + `:{"status":"FAILED_ASSERTION","error":{"message":"wrong sum","expected":3,"received":4}}` + "\n"
+
+	final, err := parseTestRunnerOutput([]byte(output), testNonce, 2, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected the framed result; got %v", err)
+	}
+	if len(final.Results) != 1 {
+		t.Fatalf("expected one result; got %+v", final.Results)
+	}
+	result := final.Results[0]
+	if result.Checkpoint != 2 || result.Status != TestFailedAssertion || result.DurationMs != 1500 {
+		t.Errorf("expected a failed assertion of checkpoint 2 in 1500 ms; got %+v", result)
+	}
+	if result.Error == nil || result.Error.Message != "wrong sum" {
+		t.Errorf("expected the reporter's error; got %+v", result.Error)
+	}
+}
+
+func TestParseTestRunnerOutputIgnoresWhatTheTestsPrint(t *testing.T) {
+	// The learner's code prints a passing result, framed with a nonce of its own
+	output := `{"status":"PASSED"}` + "\n" +
+		resultLinePrefix + `guessed:{"status":"PASSED"}` + "\n" +
+		resultLinePrefix + testNonce + `:{"status":"FAILED_RUNTIME","error":{"message":"boom"}}` + "\n" +
+		`{"status":"PASSED"}` + "\n"
+
+	final, err := parseTestRunnerOutput([]byte(output), testNonce, 1, time.Second)
+	if err != nil {
+		t.Fatalf("expected the framed result; got %v", err)
+	}
+	if final.Results[0].Status != TestFailedRuntime {
+		t.Errorf("expected the framed runtime failure; got %s", final.Results[0].Status)
+	}
+
+	_, err = parseTestRunnerOutput([]byte(`{"status":"PASSED"}`+"\n"+resultLinePrefix+`:{"status":"PASSED"}`), testNonce, 1, time.Second)
+	if testErrorCode(err) != TEST_ERROR_MALFORMED_OUTPUT {
+		t.Errorf("expected output without the framed result to be malformed; got %v", err)
+	}
+}
+
+func TestParseTestRunnerOutputOfSeveralResults(t *testing.T) {
+	// As test-runner-service.js reports a run it killed
+	output := resultLinePrefix + testNonce + `:{"results":[{"checkpoint":3,"status":"TIME_LIMIT_EXCEEDED","durationMs":5000,"error":{"message":"too slow"}}]}`
+
+	final, err := parseTestRunnerOutput([]byte(output), testNonce, 3, time.Second)
+	if err != nil {
+		t.Fatalf("expected the framed results; got %v", err)
+	}
+	if len(final.Results) != 1 || final.Results[0].Status != TestTimeLimitExceeded || final.Results[0].DurationMs != 5000 {
+		t.Errorf("expected the time limit result as reported; got %+v", final.Results)
+	}
+}
+
+func TestParseTestRunnerOutputOfABadResult(t *testing.T) {
+	for _, output := range []string{
+		"",
+		resultLinePrefix + testNonce + `:{"status":"GREAT"}`,
+		resultLinePrefix + testNonce + `:{}`,
+		resultLinePrefix + testNonce + `:not json`,
+	} {
+		if _, err := parseTestRunnerOutput([]byte(output), testNonce, 1, time.Second); testErrorCode(err) != TEST_ERROR_MALFORMED_OUTPUT {
+			t.Errorf("expected %q to be malformed; got %v", output, err)
+		}
+	}
+}
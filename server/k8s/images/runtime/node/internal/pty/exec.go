@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Structured command execution
+//
+// `exec` runs a process in the app container through the pty-host control port, apart from
+// the learner's shell, with its own streams and exit status:
+//
+//	-> {"type": "exec", "data": {"id": "lint", "argv": ["npm", "run", "lint"], "cwd": "/workspace",
+//	    "env": {"CI": "1"}, "timeout": 120}}
+//	<- {"type": "exec_started", "data": {"id": "lint", "pid": 812}}
+//	<- {"type": "exec_output", "data": {"id": "lint", "stream": "stdout", "data": "..."}}
+//	<- {"type": "exec_exited", "data": {"id": "lint", "code": 0, "durationMs": 5120}}
+//
+// `command` may replace `argv` and runs through `sh -c`. `timeout` is in seconds. `stdin`
+// is written to the process and then closed, unless `openStdin` is set, in which case
+// `exec_input` {"id", "data", "eof"} feeds it. `exec_kill` {"id", "signal"} signals the
+// process group (SIGTERM by default). Failures are reported as `exec_error`. Processes are
+// killed when the connection that started them closes.
+
+const (
+	FRAME_EXEC    byte = 2
+	FRAME_SIGNAL  byte = 3
+	FRAME_STARTED byte = 4
+	FRAME_STDOUT  byte = 5
+	FRAME_STDERR  byte = 6
+	FRAME_EXIT    byte = 7
+)
+
+const maxExecsPerConnection = 8
+
+var execSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// What the pty-host needs to start the process
+type execRequest struct {
+	Argv    []string          `json:"argv,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Timeout int               `json:"timeout,omitempty"`
+}
+
+type execMessage struct {
+	ID string `json:"id"`
+	execRequest
+	Stdin     string `json:"stdin,omitempty"`
+	OpenStdin bool   `json:"openStdin,omitempty"`
+}
+
+type execInputMessage struct {
+	ID   string `json:"id"`
+	Data string `json:"data"`
+	EOF  bool   `json:"eof,omitempty"`
+}
+
+type execKillMessage struct {
+	ID     string `json:"id"`
+	Signal string `json:"signal,omitempty"`
+}
+
+type execExitStatus struct {
+	ID         string `json:"id"`
+	Code       int    `json:"code"`
+	Signal     string `json:"signal,omitempty"`
+	TimedOut   bool   `json:"timedOut,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type execProcess struct {
+	id      string
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (p *execProcess) send(kind byte, payload []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return writeFrame(p.conn, kind, payload)
+}
+
+func (h *PtyHandler) sendExecError(id, message string) {
+	h.sendMessage(outboundMessage{Type: "exec_error", Data: map[string]any{"id": id, "message": message}})
+}
+
+func (h *PtyHandler) handleExec(raw json.RawMessage) {
+	var req execMessage
+	if err := decodeMessageData(raw, &req); err != nil {
+		h.sendExecError("", "invalid exec payload: "+err.Error())
+		return
+	}
+	if !sessionIDPattern.MatchString(req.ID) {
+		h.sendExecError(req.ID, fmt.Sprintf("invalid exec id %q", req.ID))
+		return
+	}
+	if len(req.Argv) == 0 && req.Command == "" {
+		h.sendExecError(req.ID, "exec needs argv or command")
+		return
+	}
+
+	conn, err := net.DialTimeout(PTY_CONTROL_NETWORK, PTY_CONTROL_ADDR, 5*time.Second)
+	if err != nil {
+		h.sendExecError(req.ID, "app container unavailable")
+		log.Printf("Failed to connect to pty-host control (%s %s): %v", PTY_CONTROL_NETWORK, PTY_CONTROL_ADDR, err)
+		return
+	}
+	process := &execProcess{id: req.ID, conn: conn}
+
+	h.execsMu.Lock()
+	if _, exists := h.execs[req.ID]; exists {
+		h.execsMu.Unlock()
+		conn.Close()
+		h.sendExecError(req.ID, fmt.Sprintf("exec %q is already running", req.ID))
+		return
+	}
+	if len(h.execs) >= maxExecsPerConnection {
+		h.execsMu.Unlock()
+		conn.Close()
+		h.sendExecError(req.ID, "too many running execs")
+		return
+	}
+	h.execs[req.ID] = process
+	h.execsMu.Unlock()
+
+	request, _ := json.Marshal(req.execRequest)
+	err = process.send(FRAME_EXEC, request)
+	if err == nil && req.Stdin != "" {
+		err = process.send(FRAME_DATA, []byte(req.Stdin))
+	}
+	if err == nil && !req.OpenStdin {
+		err = process.send(FRAME_DATA, nil)
+	}
+	if err != nil {
+		h.forgetExec(process)
+		h.sendExecError(req.ID, "failed to start exec: "+err.Error())
+		return
+	}
+
+	go h.pumpExec(process)
+}
+
+// Relay the frames of a running exec until it exits
+func (h *PtyHandler) pumpExec(process *execProcess) {
+	defer h.forgetExec(process)
+
+	reader := bufio.NewReader(process.conn)
+	pending := map[byte][]byte{}
+	streams := map[byte]string{FRAME_STDOUT: "stdout", FRAME_STDERR: "stderr"}
+	sendOutput := func(kind byte, data []byte) {
+		if len(data) > 0 {
+			h.sendMessage(outboundMessage{Type: "exec_output", Data: map[string]any{
+				"id":     process.id,
+				"stream": streams[kind],
+				"data":   string(data),
+			}})
+		}
+	}
+
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			h.sendExecError(process.id, "exec connection lost")
+			log.Printf("Exec %s ended without exit status: %v", process.id, err)
+			return
+		}
+
+		switch kind {
+		case FRAME_STARTED:
+			var started struct {
+				Pid int `json:"pid"`
+			}
+			json.Unmarshal(payload, &started)
+			h.sendMessage(outboundMessage{Type: "exec_started", Data: map[string]any{"id": process.id, "pid": started.Pid}})
+
+		case FRAME_STDOUT, FRAME_STDERR:
+			// Keep runes split across frames together
+			chunk, rest := splitIncompleteRune(append(pending[kind], payload...))
+			sendOutput(kind, chunk)
+			pending[kind] = append([]byte(nil), rest...)
+
+		case FRAME_EXIT:
+			for kind, rest := range pending {
+				sendOutput(kind, rest)
+			}
+			var status execExitStatus
+			if err := json.Unmarshal(payload, &status); err != nil {
+				status = execExitStatus{Code: -1, Error: "invalid exit status"}
+			}
+			status.ID = process.id
+			h.sendMessage(outboundMessage{Type: "exec_exited", Data: status})
+			return
+		}
+	}
+}
+
+func (h *PtyHandler) exec(id string) *execProcess {
+	h.execsMu.Lock()
+	defer h.execsMu.Unlock()
+	return h.execs[id]
+}
+
+func (h *PtyHandler) forgetExec(process *execProcess) {
+	h.execsMu.Lock()
+	if h.execs[process.id] == process {
+		delete(h.execs, process.id)
+	}
+	h.execsMu.Unlock()
+	process.conn.Close()
+}
+
+func (h *PtyHandler) handleExecInput(raw json.RawMessage) {
+	var req execInputMessage
+	if err := decodeMessageData(raw, &req); err != nil {
+		h.sendExecError("", "invalid exec_input payload: "+err.Error())
+		return
+	}
+	process := h.exec(req.ID)
+	if process == nil {
+		h.sendExecError(req.ID, "unknown exec")
+		return
+	}
+
+	var err error
+	if req.Data != "" {
+		err = process.send(FRAME_DATA, []byte(req.Data))
+	}
+	if err == nil && req.EOF {
+		err = process.send(FRAME_DATA, nil)
+	}
+	if err != nil {
+		h.sendExecError(req.ID, "failed to write input: "+err.Error())
+	}
+}
+
+func (h *PtyHandler) handleExecKill(raw json.RawMessage) {
+	var req execKillMessage
+	if err := decodeMessageData(raw, &req); err != nil {
+		h.sendExecError("", "invalid exec_kill payload: "+err.Error())
+		return
+	}
+	process := h.exec(req.ID)
+	if process == nil {
+		h.sendExecError(req.ID, "unknown exec")
+		return
+	}
+
+	if req.Signal == "" {
+		req.Signal = "SIGTERM"
+	}
+	signal, ok := execSignals[req.Signal]
+	if !ok {
+		h.sendExecError(req.ID, fmt.Sprintf("unsupported signal %q", req.Signal))
+		return
+	}
+	if err := process.send(FRAME_SIGNAL, []byte{byte(signal)}); err != nil {
+		h.sendExecError(req.ID, "failed to signal exec: "+err.Error())
+	}
+}
+
+// Kill every exec started by a closing connection
+func (h *PtyHandler) killExecs() {
+	h.execsMu.Lock()
+	execs := h.execs
+	h.execs = make(map[string]*execProcess)
+	h.execsMu.Unlock()
+
+	// The host kills the process group when its control connection closes
+	for _, process := range execs {
+		process.conn.Close()
+	}
+}
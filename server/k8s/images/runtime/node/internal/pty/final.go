@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Final submission
+//
+// A final submission runs the tests of every checkpoint of the quest, then the quest's final
+// suite (Quest.FinalTestCode with Quest.FinalTestCases, staged in /internal-test/final), and
+// scores them together. It goes through the test queue like a checkpoint run:
+//
+//	-> {"type": "test", "data": {"type": "final", "language": "react"}}
+//	<- {"type": "test_queued", "data": {"jobId": "test-4", "checkpointId": "final", "position": 0}}
+//	<- {"type": "test_progress", "data": {"jobId": "test-4", "checkpointId": "final", "suite": "checkpoint-1",
+//	    "event": "test_passed", ...}}
+//	<- {"type": "test_completed", "data": {"jobId": "test-4", "checkpointId": "final", "mode": "final",
+//	    "report": {"passed": false, "score": 87.5, "testsPassed": 14, "testsTotal": 16, "suites": [...]}}}
+//
+// Every suite runs even when an earlier one failed, a run that fails to complete ends the
+// submission with test_error. The quest is complete only when every suite passed; the report
+// is stored with the lab instance either way. The final suite is always hidden, its progress
+// and result are redacted like those of a hidden checkpoint (see hidden.go).
+
+const FINAL_CHECKPOINT_ID = "final"
+
+const FINAL_SUITE = "final"
+
+type FinalSuiteResult struct {
+	Suite string `json:"suite"` // checkpoint-<n> or final
+	DevsArenaRunnerResult
+	TestsPassed int `json:"testsPassed"`
+	TestsFailed int `json:"testsFailed"`
+}
+
+type FinalTestReport struct {
+	Passed      bool               `json:"passed"`
+	Score       float64            `json:"score"` // Percent of the tests that passed
+	TestsPassed int                `json:"testsPassed"`
+	TestsTotal  int                `json:"testsTotal"`
+	DurationMs  int64              `json:"durationMs"`
+	Timestamp   int64              `json:"timestamp"`
+	Suites      []FinalSuiteResult `json:"suites"`
+}
+
+// Run every suite of the quest and score them. onProgress, if set, gets the progress of each
+// suite with its name.
+func RunFinalTestsForClient(ctx context.Context, language string, onProgress func(TestProgress)) (FinalTestReport, error) {
+	suites := finalSuites()
+	if len(suites) == 0 {
+		return FinalTestReport{}, newTestRunnerError(TEST_ERROR_INVALID_REQUEST, "this quest has no tests to submit")
+	}
+
+	started := time.Now()
+	report := FinalTestReport{Passed: true, Suites: []FinalSuiteResult{}}
+	for _, suite := range suites {
+		result := FinalSuiteResult{Suite: suite}
+		var counter testCounter
+		countProgress := func(progress TestProgress) {
+			counter.count(progress)
+			if onProgress != nil {
+				progress.Suite = suite
+				onProgress(progress)
+			}
+		}
+
+		final, err := runFinalSuite(ctx, suite, language, countProgress)
+		if err != nil {
+			return FinalTestReport{}, fmt.Errorf("%s: %w", suite, err)
+		}
+		result.DevsArenaRunnerResult = final.Results[len(final.Results)-1]
+		counter = counter.settle(result.Status)
+		result.TestsPassed, result.TestsFailed = counter.passed, counter.failed
+
+		report.Passed = report.Passed && result.Status == TestPassed
+		report.TestsPassed += result.TestsPassed
+		report.TestsTotal += result.TestsPassed + result.TestsFailed
+		report.Suites = append(report.Suites, result)
+	}
+
+	report.Score = math.Round(float64(report.TestsPassed)/float64(report.TestsTotal)*1000) / 10
+	report.DurationMs = time.Since(started).Milliseconds()
+	report.Timestamp = time.Now().Unix()
+	return report, nil
+}
+
+// checkpoint-1 to checkpoint-<QUEST_CHECKPOINT_COUNT>, then the final suite when there is one
+func finalSuites() []string {
+	suites := []string{}
+	for checkpoint := 1; checkpoint <= QUEST_CHECKPOINT_COUNT; checkpoint++ {
+		suites = append(suites, fmt.Sprintf("checkpoint-%d", checkpoint))
+	}
+	if QUEST_FINAL_TESTS {
+		suites = append(suites, FINAL_SUITE)
+	}
+	return suites
+}
+
+func runFinalSuite(ctx context.Context, suite, language string, onProgress func(TestProgress)) (DevsArenaRunnerFinal, error) {
+	if suite == FINAL_SUITE {
+		var counter testCounter
+		final, err := runTestSuite(ctx, url.Values{"suite": {FINAL_SUITE}}, 0, language, TestLimits{}, func(progress TestProgress) {
+			counter.count(progress)
+			if onProgress != nil {
+				onProgress(hideTestProgress(progress))
+			}
+		})
+		for i := range final.Results {
+			hideTestResult(&final.Results[i], counter)
+		}
+		return final, err
+	}
+
+	var checkpoint int
+	fmt.Sscanf(suite, "checkpoint-%d", &checkpoint)
+	return RunCheckpointTestForClient(ctx, strconv.Itoa(checkpoint), language, onProgress)
+}
+
+// Run a final submission job of the queue
+func (q *testQueue) runFinalJob(ctx context.Context, job *testJob) {
+	report, err := RunFinalTestsForClient(ctx, job.language, func(progress TestProgress) {
+		broadcast(nil, job.message("test_progress", progress))
+	})
+	switch {
+	case err != nil && testErrorCode(err) == TEST_ERROR_CANCELLED:
+		log.Printf("Final submission %s cancelled", job.id)
+		broadcast(nil, job.message("test_cancelled", nil))
+	case err != nil:
+		log.Printf("Final submission %s failed to run: %v", job.id, err)
+		broadcast(nil, job.message("test_error", map[string]any{"code": testErrorCode(err), "message": err.Error()}))
+	default:
+		log.Printf("Final submission %s: passed=%v, score %.1f%% (%d/%d tests)", job.id, report.Passed, report.Score, report.TestsPassed, report.TestsTotal)
+		if err := Reporter.StoreFinalResult(LabID, report); err != nil {
+			log.Printf("Failed to store final test report: %v", err)
+		}
+		broadcast(nil, job.message("test_completed", map[string]any{"mode": "final", "report": report}))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunFinalSuiteRedactsTheHiddenSuite(t *testing.T) {
+	runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		output := resultLinePrefix + r.URL.Query().Get("nonce") +
+			`:{"status":"FAILED_ASSERTION","error":{"message":"expected 3","expected":3,"received":4,"file":"src/sum.js","line":7}}` + "\n"
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(testRunnerStreamLine{Progress: &TestProgress{Event: "test_passed", File: "final.test.js", Name: "adds zero"}})
+		encoder.Encode(testRunnerStreamLine{Progress: &TestProgress{Event: "test_failed", File: "final.test.js", Name: "adds 1 and 2"}})
+		encoder.Encode(testRunnerStreamLine{Output: &output})
+	}))
+	defer runner.Close()
+	addr := TEST_RUNNER_ADDR
+	TEST_RUNNER_ADDR = strings.TrimPrefix(runner.URL, "http://")
+	defer func() { TEST_RUNNER_ADDR = addr }()
+
+	var progress []TestProgress
+	final, err := runFinalSuite(context.Background(), FINAL_SUITE, "", func(p TestProgress) {
+		progress = append(progress, p)
+	})
+	if err != nil {
+		t.Fatalf("expected a result; got %v", err)
+	}
+	if len(progress) != 2 {
+		t.Fatalf("expected two progress events; got %+v", progress)
+	}
+	for _, p := range progress {
+		if p.Name != "" {
+			t.Errorf("expected no test names in progress; got %q", p.Name)
+		}
+	}
+
+	result := final.Results[0]
+	if !result.Hidden || result.Tests == nil || result.Tests.Passed != 1 || result.Tests.Total != 2 {
+		t.Errorf("expected a hidden result with 1 of 2 passed; got %+v", result)
+	}
+	body, _ := json.Marshal(result)
+	for _, leak := range []string{"expected 3", "received", "src/sum.js"} {
+		if strings.Contains(string(body), leak) {
+			t.Errorf("expected no %q in the hidden result; got %s", leak, body)
+		}
+	}
+}
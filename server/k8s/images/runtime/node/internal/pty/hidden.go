@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Hidden tests
+//
+// A checkpoint can hide its test suite (Checkpoint.HiddenTests, listed in
+// QUEST_HIDDEN_CHECKPOINTS) and a judged checkpoint can hide single testcases
+// (Testcase.Hidden), so learners code to the requirements rather than to the tests. The
+// quest's final suite is always hidden (see final.go). Results
+// of hidden tests only say how many passed, with a generic hint: assertion details, test
+// names and the input and output of hidden cases never leave the relay. What is stored in the
+// lab's status and in submissions is redacted the same way.
+
+const HIDDEN_TEST_HINT = "Some of this checkpoint's tests are hidden. Re-read the requirements and check the edge cases."
+
+// How many tests of a run passed, set on results with hidden tests
+type TestCounts struct {
+	Passed int `json:"passed"`
+	Total  int `json:"total"`
+}
+
+// Read QUEST_HIDDEN_CHECKPOINTS, comma separated checkpoint numbers
+func loadHiddenTestConfig() {
+	for _, field := range strings.Split(os.Getenv("QUEST_HIDDEN_CHECKPOINTS"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		checkpoint, err := strconv.Atoi(field)
+		if err != nil || checkpoint < 1 {
+			log.Printf("Invalid checkpoint %q in QUEST_HIDDEN_CHECKPOINTS", field)
+			continue
+		}
+		QUEST_HIDDEN_CHECKPOINTS[checkpoint] = true
+	}
+}
+
+// Strip the test's name from a progress event of a hidden suite
+func hideTestProgress(progress TestProgress) TestProgress {
+	progress.Name = ""
+	return progress
+}
+
+// Replace the failure details of a hidden suite's result with its counts
+func hideTestResult(result *DevsArenaRunnerResult, counter testCounter) {
+	counter = counter.settle(result.Status)
+	result.Hidden = true
+	result.Tests = &TestCounts{Passed: counter.passed, Total: counter.passed + counter.failed}
+	if result.Status == TestPassed {
+		return
+	}
+
+	message := fmt.Sprintf("%d of %d hidden tests failed", counter.failed, counter.passed+counter.failed)
+	switch result.Status {
+	case TestFailedRuntime:
+		message = "The hidden tests could not run your code"
+	case TestTimeLimitExceeded, TestMemoryLimitExceeded:
+		// The limit's own message tells nothing about the tests
+		if result.Error != nil && result.Error.Message != "" {
+			message = result.Error.Message
+		}
+	}
+	result.Error = &TestError{Message: message, Hint: HIDDEN_TEST_HINT}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Judge
+//
+// Checkpoints of algorithm-style quests are judged on input and output instead of Jest. The
+// learner's program runs once per Testcase of the checkpoint in the app container, with the
+// case's input on stdin, and its stdout is compared with the case's output:
+//
+//	-> {"type": "test", "data": {"type": "judge", "checkpointId": "3", "language": "python"}}
+//	<- {"type": "test_queued", "data": {"jobId": "test-5", "checkpointId": "3", "mode": "judge", "position": 0}}
+//	<- {"type": "test_progress", "data": {"jobId": "test-5", "checkpointId": "3", "event": "test_passed",
+//	    "file": "judge", "name": "case 1", "verdict": "AC", "durationMs": 41}}
+//	<- {"type": "test_completed", "data": {"jobId": "test-5", "checkpointId": "3", "mode": "judge",
+//	    "runId": "lab1-9f2c...", "results": [{"checkpoint": 3, "status": "FAILED_ASSERTION", ...}],
+//	    "report": {"verdict": "WA", "passed": 4, "total": 5, "cases": [...]}}}
+//
+// The cases come from JUDGE_TEST_CASES, set from the quest when the lab starts, and never
+// reach the app container. Every case runs; the run's result is the verdict of the first case
+// that was not accepted and is stored and submitted like a checkpoint run. Hidden cases, and
+// every case of a checkpoint with hidden tests, are only counted in the report (see
+// hidden.go): their progress events have no name or verdict, and when only hidden cases
+// failed the run's verdict is WA.
+//
+// Verdicts: AC accepted, WA wrong answer, TLE over the checkpoint's time limit (see
+// TestLimits) or JUDGE_TIME_LIMIT, RE the program exited with an error, was killed or wrote
+// more than JUDGE_OUTPUT_LIMIT.
+//
+// JUDGE_COMPARE sets how stdout is compared with the expected output:
+//
+//	exact   byte for byte, except for \r\n line endings
+//	lines   line by line, ignoring trailing whitespace and trailing blank lines
+//	tokens  whitespace separated tokens, numbers within JUDGE_FLOAT_TOLERANCE (default)
+
+const (
+	JUDGE_ACCEPTED            = "AC"
+	JUDGE_WRONG_ANSWER        = "WA"
+	JUDGE_TIME_LIMIT_EXCEEDED = "TLE"
+	JUDGE_RUNTIME_ERROR       = "RE"
+)
+
+const (
+	JUDGE_COMPARE_EXACT  = "exact"
+	JUDGE_COMPARE_LINES  = "lines"
+	JUDGE_COMPARE_TOKENS = "tokens"
+)
+
+const (
+	judgeStdinChunk     = 64 * 1024
+	maxJudgeStderr      = 8 * 1024
+	maxJudgeReportField = 1000
+)
+
+// The learner's program by language, when JUDGE_COMMAND is not set
+var judgeCommands = map[string]string{
+	"python": "python3 main.py",
+	"node":   "node index.js",
+}
+
+// A Testcase of the quest
+type JudgeCase struct {
+	Input   string `json:"input"`
+	Output  string `json:"output"`
+	Message string `json:"message,omitempty"`
+	Hidden  bool   `json:"hidden,omitempty"`
+}
+
+// Cases by checkpoint, from JUDGE_TEST_CASES
+var judgeCases = map[int][]JudgeCase{}
+
+type JudgeCaseResult struct {
+	Case       int    `json:"case"` // From 1
+	Verdict    string `json:"verdict"`
+	DurationMs int64  `json:"durationMs"`
+	ExitCode   int    `json:"exitCode"`
+	Message    string `json:"message,omitempty"` // The Testcase's message
+	// Set for cases that were not accepted
+	Input    string `json:"input,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Received string `json:"received,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type JudgeReport struct {
+	Checkpoint int               `json:"checkpoint"`
+	Verdict    string            `json:"verdict"` // AC, or the verdict of the first failed case
+	Passed     int               `json:"passed"`
+	Total      int               `json:"total"`
+	Hidden     TestCounts        `json:"hidden"` // Hidden cases, part of Passed and Total
+	Compare    string            `json:"compare"`
+	TimeLimit  int64             `json:"timeLimitMs"`
+	DurationMs int64             `json:"durationMs"`
+	Cases      []JudgeCaseResult `json:"cases"` // Visible cases only
+}
+
+// Read judge settings and cases from the environment
+func loadJudgeConfig() {
+	JUDGE_COMMAND = strings.TrimSpace(os.Getenv("JUDGE_COMMAND"))
+
+	if limit := os.Getenv("JUDGE_TIME_LIMIT"); limit != "" {
+		if duration, err := time.ParseDuration(limit); err == nil && duration > 0 {
+			JUDGE_TIME_LIMIT = duration
+		} else {
+			log.Printf("Invalid JUDGE_TIME_LIMIT %q", limit)
+		}
+	}
+	if limit := os.Getenv("JUDGE_OUTPUT_LIMIT"); limit != "" {
+		if parsed, err := strconv.Atoi(limit); err == nil && parsed > 0 {
+			JUDGE_OUTPUT_LIMIT = parsed
+		} else {
+			log.Printf("Invalid JUDGE_OUTPUT_LIMIT %q", limit)
+		}
+	}
+	switch compare := os.Getenv("JUDGE_COMPARE"); compare {
+	case "":
+	case JUDGE_COMPARE_EXACT, JUDGE_COMPARE_LINES, JUDGE_COMPARE_TOKENS:
+		JUDGE_COMPARE = compare
+	default:
+		log.Printf("Invalid JUDGE_COMPARE %q", compare)
+	}
+	if tolerance := os.Getenv("JUDGE_FLOAT_TOLERANCE"); tolerance != "" {
+		if parsed, err := strconv.ParseFloat(tolerance, 64); err == nil && parsed >= 0 {
+			JUDGE_FLOAT_TOLERANCE = parsed
+		} else {
+			log.Printf("Invalid JUDGE_FLOAT_TOLERANCE %q", tolerance)
+		}
+	}
+
+	encoded := os.Getenv("JUDGE_TEST_CASES")
+	if encoded == "" {
+		return
+	}
+	// Base64 encoded JSON of the cases by checkpoint: {"1": [{"input", "output", "message"}]}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Printf("Invalid JUDGE_TEST_CASES: %v", err)
+		return
+	}
+	if err := json.Unmarshal(decoded, &judgeCases); err != nil {
+		log.Printf("Invalid JUDGE_TEST_CASES: %v", err)
+	}
+}
+
+func judgeCommand(language string) (string, error) {
+	if JUDGE_COMMAND != "" {
+		return JUDGE_COMMAND, nil
+	}
+	if command, ok := judgeCommands[language]; ok {
+		return command, nil
+	}
+	return "", newTestRunnerError(TEST_ERROR_INVALID_REQUEST, "no judge command for language %q", language)
+}
+
+// Run the cases of a checkpoint. onProgress, if set, gets a test_passed or test_failed event
+// per case.
+func RunJudgeForClient(ctx context.Context, checkpointID, language string, onProgress func(TestProgress)) (JudgeReport, error) {
+	checkpoint, err := parseCheckpoint(checkpointID)
+	if err != nil {
+		return JudgeReport{}, err
+	}
+	cases := judgeCases[checkpoint]
+	if len(cases) == 0 {
+		return JudgeReport{}, newTestRunnerError(TEST_ERROR_INVALID_REQUEST, "checkpoint %d has no judge test cases", checkpoint)
+	}
+	command, err := judgeCommand(language)
+	if err != nil {
+		return JudgeReport{}, err
+	}
+
+	timeLimit := JUDGE_TIME_LIMIT
+	if limit := QUEST_CHECKPOINT_LIMITS[checkpoint].TimeMs; limit > 0 {
+		timeLimit = time.Duration(limit) * time.Millisecond
+	}
+
+	started := time.Now()
+	report := JudgeReport{
+		Checkpoint: checkpoint,
+		Verdict:    JUDGE_ACCEPTED,
+		Total:      len(cases),
+		Compare:    JUDGE_COMPARE,
+		TimeLimit:  timeLimit.Milliseconds(),
+		Cases:      []JudgeCaseResult{},
+	}
+	// The verdict of the first visible case that was not accepted
+	firstFailure := JUDGE_ACCEPTED
+	for i, testcase := range cases {
+		result, err := judgeCase(ctx, command, testcase, timeLimit)
+		if err != nil {
+			return JudgeReport{}, fmt.Errorf("case %d: %w", i+1, err)
+		}
+		result.Case = i + 1
+		hidden := testcase.Hidden || QUEST_HIDDEN_CHECKPOINTS[checkpoint]
+		accepted := result.Verdict == JUDGE_ACCEPTED
+
+		if accepted {
+			report.Passed++
+		}
+		progress := TestProgress{Event: "test_passed", File: "judge", DurationMs: result.DurationMs}
+		if !accepted {
+			progress.Event = "test_failed"
+		}
+		if hidden {
+			report.Hidden.Total++
+			if accepted {
+				report.Hidden.Passed++
+			}
+		} else {
+			if !accepted && firstFailure == JUDGE_ACCEPTED {
+				firstFailure = result.Verdict
+			}
+			report.Cases = append(report.Cases, result)
+			progress.Name = fmt.Sprintf("case %d", result.Case)
+			progress.Verdict = result.Verdict
+		}
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+
+	switch {
+	case firstFailure != JUDGE_ACCEPTED:
+		report.Verdict = firstFailure
+	case report.Hidden.Passed < report.Hidden.Total:
+		report.Verdict = JUDGE_WRONG_ANSWER
+	}
+
+	report.DurationMs = time.Since(started).Milliseconds()
+	return report, nil
+}
+
+// Run the program once through the pty-host and judge its output
+func judgeCase(ctx context.Context, command string, testcase JudgeCase, timeLimit time.Duration) (JudgeCaseResult, error) {
+	conn, err := net.DialTimeout(PTY_CONTROL_NETWORK, PTY_CONTROL_ADDR, 5*time.Second)
+	if err != nil {
+		return JudgeCaseResult{}, newTestRunnerError(TEST_ERROR_RUNNER_UNAVAILABLE, "app container unavailable: %v", err)
+	}
+	// The host kills the process group when the connection closes
+	defer conn.Close()
+	process := &execProcess{id: "judge", conn: conn}
+
+	// The host's timeout only backs up the relay's own
+	request, _ := json.Marshal(execRequest{
+		Command: command,
+		Cwd:     "/workspace",
+		Timeout: int(timeLimit/time.Second) + 2,
+	})
+	if err := process.send(FRAME_EXEC, request); err != nil {
+		return JudgeCaseResult{}, newTestRunnerError(TEST_ERROR_RUNNER_FAILED, "failed to start program: %v", err)
+	}
+	go func() {
+		input := []byte(testcase.Input)
+		for len(input) > 0 {
+			chunk := input[:min(len(input), judgeStdinChunk)]
+			if process.send(FRAME_DATA, chunk) != nil {
+				return
+			}
+			input = input[len(chunk):]
+		}
+		process.send(FRAME_DATA, nil)
+	}()
+
+	kill := func() { process.send(FRAME_SIGNAL, []byte{byte(syscall.SIGKILL)}) }
+	var timedOut atomic.Bool
+	var overLimit bool
+	var timer *time.Timer
+	stopWatch := context.AfterFunc(ctx, kill)
+	defer func() {
+		stopWatch()
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	var stdout, stderr []byte
+	reader := bufio.NewReader(conn)
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			if ctx.Err() != nil {
+				return JudgeCaseResult{}, newTestRunnerError(TEST_ERROR_CANCELLED, "judge run cancelled")
+			}
+			return JudgeCaseResult{}, newTestRunnerError(TEST_ERROR_RUNNER_FAILED, "program ended without exit status: %v", err)
+		}
+
+		switch kind {
+		case FRAME_STARTED:
+			timer = time.AfterFunc(timeLimit, func() {
+				timedOut.Store(true)
+				kill()
+			})
+
+		case FRAME_STDOUT:
+			if len(stdout)+len(payload) > JUDGE_OUTPUT_LIMIT {
+				if !overLimit {
+					overLimit = true
+					kill()
+				}
+				continue
+			}
+			stdout = append(stdout, payload...)
+
+		case FRAME_STDERR:
+			if room := maxJudgeStderr - len(stderr); room > 0 {
+				stderr = append(stderr, payload[:min(len(payload), room)]...)
+			}
+
+		case FRAME_EXIT:
+			if ctx.Err() != nil {
+				return JudgeCaseResult{}, newTestRunnerError(TEST_ERROR_CANCELLED, "judge run cancelled")
+			}
+			var status execExitStatus
+			if err := json.Unmarshal(payload, &status); err != nil {
+				return JudgeCaseResult{}, newTestRunnerError(TEST_ERROR_MALFORMED_OUTPUT, "invalid exit status")
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+
+			result := JudgeCaseResult{
+				DurationMs: status.DurationMs,
+				ExitCode:   status.Code,
+				Message:    testcase.Message,
+			}
+			switch {
+			case timedOut.Load() || status.TimedOut:
+				result.Verdict = JUDGE_TIME_LIMIT_EXCEEDED
+				result.Error = fmt.Sprintf("exceeded the time limit of %s", timeLimit)
+			case overLimit:
+				result.Verdict = JUDGE_RUNTIME_ERROR
+				result.Error = fmt.Sprintf("wrote more than %d bytes of output", JUDGE_OUTPUT_LIMIT)
+			case status.Error != "":
+				result.Verdict = JUDGE_RUNTIME_ERROR
+				result.Error = status.Error
+			case status.Signal != "":
+				result.Verdict = JUDGE_RUNTIME_ERROR
+				result.Error = "killed by " + status.Signal
+			case status.Code != 0:
+				result.Verdict = JUDGE_RUNTIME_ERROR
+				result.Error = fmt.Sprintf("exited with code %d", status.Code)
+			case outputMatches(string(stdout), testcase.Output):
+				result.Verdict = JUDGE_ACCEPTED
+			default:
+				result.Verdict = JUDGE_WRONG_ANSWER
+			}
+
+			if result.Verdict != JUDGE_ACCEPTED {
+				result.Input = truncate(testcase.Input, maxJudgeReportField)
+				result.Expected = truncate(testcase.Output, maxJudgeReportField)
+				result.Received = truncate(string(stdout), maxJudgeReportField)
+				result.Stderr = truncate(string(stderr), maxJudgeReportField)
+			}
+			return result, nil
+		}
+	}
+}
+
+// Compare output with the expected output as JUDGE_COMPARE says
+func outputMatches(output, expected string) bool {
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	expected = strings.ReplaceAll(expected, "\r\n", "\n")
+
+	switch JUDGE_COMPARE {
+	case JUDGE_COMPARE_EXACT:
+		return output == expected
+
+	case JUDGE_COMPARE_LINES:
+		trimLines := func(s string) []string {
+			lines := strings.Split(s, "\n")
+			for i := range lines {
+				lines[i] = strings.TrimRight(lines[i], " \t")
+			}
+			for len(lines) > 0 && lines[len(lines)-1] == "" {
+				lines = lines[:len(lines)-1]
+			}
+			return lines
+		}
+		got, want := trimLines(output), trimLines(expected)
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+
+	default:
+		got, want := strings.Fields(output), strings.Fields(expected)
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if got[i] != want[i] && !numbersMatch(got[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Both tokens are numbers within JUDGE_FLOAT_TOLERANCE, absolute or relative to the expected
+// value
+func numbersMatch(got, want string) bool {
+	if JUDGE_FLOAT_TOLERANCE == 0 {
+		return false
+	}
+	a, errA := strconv.ParseFloat(got, 64)
+	b, errB := strconv.ParseFloat(want, 64)
+	if errA != nil || errB != nil || math.IsNaN(a) || math.IsNaN(b) {
+		return false
+	}
+	return math.Abs(a-b) <= JUDGE_FLOAT_TOLERANCE*math.Max(1, math.Abs(b))
+}
+
+// The checkpoint result of a judge run, as stored and submitted
+func (report JudgeReport) result() DevsArenaRunnerResult {
+	result := DevsArenaRunnerResult{
+		Checkpoint: report.Checkpoint,
+		Status:     TestPassed,
+		DurationMs: report.DurationMs,
+	}
+	for _, failed := range report.Cases {
+		if failed.Verdict == JUDGE_ACCEPTED {
+			continue
+		}
+		switch failed.Verdict {
+		case JUDGE_WRONG_ANSWER:
+			result.Status = TestFailedAssertion
+		case JUDGE_TIME_LIMIT_EXCEEDED:
+			result.Status = TestTimeLimitExceeded
+		default:
+			result.Status = TestFailedRuntime
+		}
+		result.Error = &TestError{
+			Scenario: fmt.Sprintf("case %d", failed.Case),
+			Expected: failed.Expected,
+			Received: failed.Received,
+			Hint:     failed.Message,
+			Message:  fmt.Sprintf("%s on case %d of %d", failed.Verdict, failed.Case, report.Total),
+		}
+		if failed.Error != "" {
+			result.Error.Message += ": " + failed.Error
+		}
+		if failed.Verdict == JUDGE_WRONG_ANSWER {
+			result.Error.Assertion = outputAssertion(failed.Expected, failed.Received, failed.Message)
+		}
+		break
+	}
+
+	if report.Hidden.Total > 0 {
+		result.Hidden = true
+		result.Tests = &TestCounts{Passed: report.Passed, Total: report.Total}
+	}
+	if failedHidden := report.Hidden.Total - report.Hidden.Passed; failedHidden > 0 && result.Error == nil {
+		result.Status = TestFailedAssertion
+		result.Error = &TestError{
+			Message: fmt.Sprintf("%d of %d hidden cases failed", failedHidden, report.Hidden.Total),
+			Hint:    HIDDEN_TEST_HINT,
+		}
+	}
+	return result
+}
+
+// Run a judge job of the queue
+func (q *testQueue) runJudgeJob(ctx context.Context, job *testJob) {
+	runID := newRunID()
+	var counter testCounter
+	report, err := RunJudgeForClient(ctx, job.checkpointID, job.language, func(progress TestProgress) {
+		counter.count(progress)
+		broadcast(nil, job.message("test_progress", progress))
+	})
+	switch {
+	case err != nil && testErrorCode(err) == TEST_ERROR_CANCELLED:
+		log.Printf("Judge run %s cancelled", job.id)
+		broadcast(nil, job.message("test_cancelled", nil))
+	case err != nil:
+		log.Printf("Judge run of checkpoint %s failed: %v", job.checkpointID, err)
+		broadcast(nil, job.message("test_error", map[string]any{"code": testErrorCode(err), "message": err.Error()}))
+	default:
+		log.Printf("Judge run %s of checkpoint %d: %s (%d/%d cases)", job.id, report.Checkpoint, report.Verdict, report.Passed, report.Total)
+		result := report.result()
+		result.RunID = runID
+		result.CompletedAt = time.Now().Unix()
+		final := DevsArenaRunnerFinal{Results: []DevsArenaRunnerResult{result}}
+		if err := Reporter.StoreTestResult(LabID, final); err != nil {
+			log.Printf("Failed to store judge result: %v", err)
+		}
+		submitTestRun(runID, result, counter)
+		broadcast(nil, job.message("test_completed", map[string]any{"runId": runID, "results": final.Results, "report": report}))
+	}
+}
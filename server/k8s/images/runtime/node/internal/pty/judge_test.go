@@ -0,0 +1,167 @@
+package main
+
+import "testing"
+
+// Compare judged output the given way for the rest of the test
+func compareWith(t *testing.T, compare string, tolerance float64) {
+	previousCompare, previousTolerance := JUDGE_COMPARE, JUDGE_FLOAT_TOLERANCE
+	JUDGE_COMPARE, JUDGE_FLOAT_TOLERANCE = compare, tolerance
+	t.Cleanup(func() {
+		JUDGE_COMPARE, JUDGE_FLOAT_TOLERANCE = previousCompare, previousTolerance
+	})
+}
+
+func TestOutputMatchesExactly(t *testing.T) {
+	compareWith(t, JUDGE_COMPARE_EXACT, 0)
+
+	if !outputMatches("1 2\r\n", "1 2\n") {
+		t.Errorf("expected CRLF line endings to match LF")
+	}
+	if outputMatches("1 2 \n", "1 2\n") {
+		t.Errorf("expected trailing spaces to count")
+	}
+	if outputMatches("1 2", "1 2\n") {
+		t.Errorf("expected a missing trailing newline to count")
+	}
+}
+
+func TestOutputMatchesLines(t *testing.T) {
+	compareWith(t, JUDGE_COMPARE_LINES, 0)
+
+	if !outputMatches("a \nb\t\n\n\n", "a\nb") {
+		t.Errorf("expected trailing whitespace and blank lines to be ignored")
+	}
+	if outputMatches(" a\nb", "a\nb") {
+		t.Errorf("expected leading whitespace to count")
+	}
+	if outputMatches("a b", "a\nb") {
+		t.Errorf("expected line breaks to count")
+	}
+	if outputMatches("a", "a\nb") {
+		t.Errorf("expected a missing line to count")
+	}
+}
+
+func TestOutputMatchesTokens(t *testing.T) {
+	compareWith(t, JUDGE_COMPARE_TOKENS, 1e-6)
+
+	if !outputMatches("  1\n2\t3 ", "1 2 3") {
+		t.Errorf("expected tokens to match across any whitespace")
+	}
+	if outputMatches("2 1", "1 2") || outputMatches("1 2 3", "1 2") {
+		t.Errorf("expected the order and number of tokens to count")
+	}
+	if !outputMatches("0.3333333", "0.333333333") {
+		t.Errorf("expected numbers within the tolerance to match")
+	}
+	if outputMatches("0.334", "0.333") {
+		t.Errorf("expected numbers outside the tolerance not to match")
+	}
+	if !outputMatches("", "\n") {
+		t.Errorf("expected empty output to match an empty line")
+	}
+
+	compareWith(t, JUDGE_COMPARE_TOKENS, 0)
+	if outputMatches("0.3333333", "0.333333333") {
+		t.Errorf("expected numbers to compare as text without a tolerance")
+	}
+}
+
+func TestNumbersMatch(t *testing.T) {
+	compareWith(t, JUDGE_COMPARE_TOKENS, 1e-6)
+
+	for _, pair := range [][2]string{{"1.0000001", "1"}, {"1000000.5", "1000000"}, {"1e3", "1000"}} {
+		if !numbersMatch(pair[0], pair[1]) {
+			t.Errorf("expected %s to match %s", pair[0], pair[1])
+		}
+	}
+	for _, pair := range [][2]string{{"1.001", "1"}, {"abc", "1"}, {"NaN", "NaN"}} {
+		if numbersMatch(pair[0], pair[1]) {
+			t.Errorf("expected %s not to match %s", pair[0], pair[1])
+		}
+	}
+}
+
+func TestJudgeReportResult(t *testing.T) {
+	accepted := JudgeCaseResult{Case: 1, Verdict: JUDGE_ACCEPTED}
+
+	result := JudgeReport{Checkpoint: 2, Verdict: JUDGE_ACCEPTED, Passed: 1, Total: 1, DurationMs: 40, Cases: []JudgeCaseResult{accepted}}.result()
+	if result.Checkpoint != 2 || result.Status != TestPassed || result.Error != nil || result.DurationMs != 40 {
+		t.Errorf("expected checkpoint 2 to pass; got %+v", result)
+	}
+
+	result = JudgeReport{Checkpoint: 2, Verdict: JUDGE_WRONG_ANSWER, Passed: 1, Total: 3, Cases: []JudgeCaseResult{
+		accepted,
+		{Case: 2, Verdict: JUDGE_WRONG_ANSWER, Expected: "3", Received: "4", Message: "adds the numbers"},
+		{Case: 3, Verdict: JUDGE_RUNTIME_ERROR, Error: "exit status 1"},
+	}}.result()
+	if result.Status != TestFailedAssertion || result.Error == nil {
+		t.Fatalf("expected a failed assertion; got %+v", result)
+	}
+	if result.Error.Message != "WA on case 2 of 3" || result.Error.Scenario != "case 2" {
+		t.Errorf("expected the first failed case to be reported; got %+v", result.Error)
+	}
+	if result.Error.Expected != "3" || result.Error.Received != "4" || result.Error.Hint != "adds the numbers" {
+		t.Errorf("expected the case's output and message; got %+v", result.Error)
+	}
+
+	result = JudgeReport{Checkpoint: 1, Verdict: JUDGE_RUNTIME_ERROR, Total: 1, Cases: []JudgeCaseResult{
+		{Case: 1, Verdict: JUDGE_RUNTIME_ERROR, Error: "exit status 1"},
+	}}.result()
+	if result.Status != TestFailedRuntime || result.Error == nil || result.Error.Message != "RE on case 1 of 1: exit status 1" {
+		t.Errorf("expected a runtime failure with its error; got %+v", result.Error)
+	}
+}
+
+func TestJudgeReportResultOfATimeout(t *testing.T) {
+	result := JudgeReport{Checkpoint: 1, Verdict: JUDGE_TIME_LIMIT_EXCEEDED, Total: 1, Cases: []JudgeCaseResult{
+		{Case: 1, Verdict: JUDGE_TIME_LIMIT_EXCEEDED},
+	}}.result()
+	if result.Status != TestTimeLimitExceeded || result.Error == nil || result.Error.Message != "TLE on case 1 of 1" {
+		t.Errorf("expected the time limit to be exceeded; got %+v", result)
+	}
+}
+
+func TestJudgeReportResultWithHiddenCases(t *testing.T) {
+	accepted := JudgeCaseResult{Case: 1, Verdict: JUDGE_ACCEPTED}
+
+	// Only the visible cases are in the report, a failed hidden one shows in the counts
+	result := JudgeReport{Checkpoint: 1, Verdict: JUDGE_WRONG_ANSWER, Passed: 2, Total: 3, Hidden: TestCounts{Passed: 1, Total: 2}, Cases: []JudgeCaseResult{accepted}}.result()
+	if result.Status != TestFailedAssertion || !result.Hidden {
+		t.Fatalf("expected a hidden failed assertion; got %+v", result)
+	}
+	if result.Tests == nil || result.Tests.Passed != 2 || result.Tests.Total != 3 {
+		t.Errorf("expected 2 of 3 cases passed; got %+v", result.Tests)
+	}
+	if result.Error == nil || result.Error.Message != "1 of 2 hidden cases failed" || result.Error.Hint != HIDDEN_TEST_HINT {
+		t.Errorf("expected the hidden cases' message and hint; got %+v", result.Error)
+	}
+	if result.Error != nil && (result.Error.Expected != "" || result.Error.Received != "") {
+		t.Errorf("expected no output of hidden cases; got %+v", result.Error)
+	}
+
+	result = JudgeReport{Checkpoint: 1, Verdict: JUDGE_ACCEPTED, Passed: 2, Total: 2, Hidden: TestCounts{Passed: 1, Total: 1}, Cases: []JudgeCaseResult{accepted}}.result()
+	if result.Status != TestPassed || result.Error != nil || !result.Hidden {
+		t.Errorf("expected a hidden pass; got %+v", result)
+	}
+}
+
+func TestJudgeReportResultAssertion(t *testing.T) {
+	result := JudgeReport{Checkpoint: 1, Verdict: JUDGE_WRONG_ANSWER, Total: 1, Cases: []JudgeCaseResult{
+		{Case: 1, Verdict: JUDGE_WRONG_ANSWER, Expected: "1\n2", Received: "1\n3", Message: "counts up"},
+	}}.result()
+	assertion := result.Error.Assertion
+	if assertion == nil || assertion.Kind != ASSERTION_KIND_STRING || assertion.Hint != "counts up" {
+		t.Fatalf("expected a string assertion with the case's message; got %+v", assertion)
+	}
+	if len(assertion.Diff) != 3 || assertion.Diff[1].Op != DIFF_DELETE || assertion.Diff[2].Op != DIFF_INSERT {
+		t.Errorf("expected line 2 to differ; got %+v", assertion.Diff)
+	}
+
+	result = JudgeReport{Checkpoint: 1, Verdict: JUDGE_RUNTIME_ERROR, Total: 1, Cases: []JudgeCaseResult{
+		{Case: 1, Verdict: JUDGE_RUNTIME_ERROR, Error: "exit status 1"},
+	}}.result()
+	if result.Error.Assertion != nil {
+		t.Errorf("expected no assertion for a runtime error; got %+v", result.Error.Assertion)
+	}
+}
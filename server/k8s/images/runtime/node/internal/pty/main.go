@@ -9,9 +9,63 @@ import (
 
 var LabID = os.Getenv("LAB_ID")
 
+// Bearer token of the relay's requests to the API at API_BASE_URL, generated for every lab
+var LabAPISecret = os.Getenv("LAB_API_SECRET")
+
+var (
+	PTY_MAX_SESSIONS         = 4
+	PTY_BACKEND_PROTOCOL     = BACKEND_PROTOCOL_RAW
+	PTY_CONTROL_NETWORK      = "tcp"
+	PTY_CONTROL_ADDR         = "127.0.0.1:54322"
+	PTY_SCROLLBACK_BYTES     = 64 * 1024 // 64 KB of output kept per session
+	PTY_SESSION_IDLE_TIMEOUT = 10 * time.Minute
+	PTY_RECORDING_ENABLED    = false
+	PTY_RECORDING_DIR        = "/tmp/pty/recordings"
+	PTY_RECORDING_MAX_BYTES  = int64(20 * 1024 * 1024) // 20 MB per recording
+	PTY_PORT_POLL_INTERVAL   = time.Second
+	PTY_USAGE_INTERVAL       = 2 * time.Second
+	// Percent of the app container's memory limit to warn at
+	PTY_MEMORY_WARN_PERCENT     = 80.0
+	PTY_MEMORY_CRITICAL_PERCENT = 95.0
+	// The pod-local test runner service, in the grader sidecar
+	TEST_RUNNER_ADDR    = "127.0.0.1:9901"
+	TEST_RUNNER_TIMEOUT = 2 * time.Minute
+	GRADER_TOKEN        = "" // Shared with the grader only
+	// Suites of a final submission: checkpoints 1 to QUEST_CHECKPOINT_COUNT, then the final suite
+	QUEST_CHECKPOINT_COUNT = 0
+	QUEST_FINAL_TESTS      = false
+	// Limits of checkpoint test runs by checkpoint, unset ones use the runner's defaults
+	QUEST_CHECKPOINT_LIMITS = map[int]TestLimits{}
+	// Checkpoints whose test suites are hidden
+	QUEST_HIDDEN_CHECKPOINTS = map[int]bool{}
+	// Judged checkpoints, see judge.go
+	JUDGE_COMMAND         = ""
+	JUDGE_TIME_LIMIT      = 2 * time.Second // Per case
+	JUDGE_OUTPUT_LIMIT    = 1024 * 1024     // Bytes of stdout per case
+	JUDGE_COMPARE         = JUDGE_COMPARE_TOKENS
+	JUDGE_FLOAT_TOLERANCE = 1e-6
+	// The runner, this relay, the grader's test runner and the pty-host
+	PTY_PORT_IGNORE = map[int]bool{8081: true, 8082: true, 9901: true, 54321: true, 54322: true}
+)
+
 func main() {
-	// Initialize Redis first
-	InitRedis()
+	// Initialize the status reporter first
+	if err := InitStatusReporter(); err != nil {
+		log.Fatal("Failed to initialize status reporter: ", err)
+	}
+	loadSessionConfig()
+	loadBackendConfig()
+	loadRecordingConfig()
+	loadPortConfig()
+	loadUsageConfig()
+	loadTestRunnerConfig()
+	loadJudgeConfig()
+	loadHiddenTestConfig()
+	go reapDetachedSessions()
+	go ports.run()
+	go watchRunSupervisor()
+	go usage.run()
+	go tests.run()
 
 	ptyMux := http.NewServeMux()
 	ptyMux.HandleFunc("/pty", servePty)
@@ -20,7 +74,7 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
-	UpdateLabInstanceProgress(LabID, LabProgressEntry{
+	Reporter.UpdateLabInstanceProgress(LabID, LabProgressEntry{
 		Timestamp:   time.Now().Unix(),
 		Status:      Active,
 		Message:     "Pseudo-terminal Service Started",
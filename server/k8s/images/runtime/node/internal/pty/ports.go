@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port watching
+//
+// The relay shares the pod's network namespace with the app container, so every socket the
+// learner's app listens on shows up in /proc/net/tcp and /proc/net/tcp6. The relay polls them
+// every PTY_PORT_POLL_INTERVAL, probes new ports over HTTP and tells every connection:
+//
+//	<- {"type": "port_opened", "data": {"port": 5173, "address": "0.0.0.0", "http": true, "url": "http://localhost:5173"}}
+//	<- {"type": "port_closed", "data": {"port": 5173}}
+//
+// HTTP ports are also announced with `server_ready` carrying the URL. A new connection gets
+// port_opened for every port that is already open. Ports of the lab's own services,
+// PTY_PORT_IGNORE, are never reported.
+
+const (
+	tcpStateListen = "0A"
+	// A port that accepts connections but does not speak HTTP yet gets a few more tries
+	httpProbeAttempts = 3
+	httpProbeTimeout  = 2 * time.Second
+)
+
+var procNetTCPFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+type listeningPort struct {
+	Port    int    `json:"port"`
+	Address string `json:"address"`
+	HTTP    bool   `json:"http"`
+	URL     string `json:"url,omitempty"`
+}
+
+type portWatcher struct {
+	// Ports seen by the last scan, with their address
+	listening map[int]string
+	// Reported ports, and new ones waiting for their HTTP probe
+	open    map[int]listeningPort
+	probing map[int]bool
+	mu      sync.Mutex
+}
+
+var ports = &portWatcher{
+	listening: make(map[int]string),
+	open:      make(map[int]listeningPort),
+	probing:   make(map[int]bool),
+}
+
+// Read port watching overrides from the environment
+func loadPortConfig() {
+	if interval := os.Getenv("PTY_PORT_POLL_INTERVAL"); interval != "" {
+		if duration, err := time.ParseDuration(interval); err == nil {
+			PTY_PORT_POLL_INTERVAL = duration
+		} else {
+			log.Printf("Invalid PTY_PORT_POLL_INTERVAL %q: %v", interval, err)
+		}
+	}
+
+	if ignore, set := os.LookupEnv("PTY_PORT_IGNORE"); set {
+		PTY_PORT_IGNORE = map[int]bool{}
+		for _, field := range strings.Split(ignore, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if port, err := strconv.Atoi(field); err == nil {
+				PTY_PORT_IGNORE[port] = true
+			} else {
+				log.Printf("Invalid port %q in PTY_PORT_IGNORE", field)
+			}
+		}
+	}
+}
+
+// Start watching, unless disabled with a zero interval
+func (w *portWatcher) run() {
+	if PTY_PORT_POLL_INTERVAL <= 0 {
+		log.Printf("Port watching disabled")
+		return
+	}
+
+	ticker := time.NewTicker(PTY_PORT_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.scan()
+	}
+}
+
+func (w *portWatcher) scan() {
+	listening, err := readListeningPorts()
+	if err != nil {
+		log.Printf("Failed to read listening ports: %v", err)
+		return
+	}
+
+	w.mu.Lock()
+	w.listening = listening
+	for port, address := range listening {
+		if _, known := w.open[port]; !known && !w.probing[port] && !PTY_PORT_IGNORE[port] {
+			w.probing[port] = true
+			go w.announce(listeningPort{Port: port, Address: address})
+		}
+	}
+	var closed []int
+	for port := range w.open {
+		if _, still := listening[port]; !still {
+			closed = append(closed, port)
+			delete(w.open, port)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, port := range closed {
+		log.Printf("Port %d closed", port)
+		broadcast(nil, outboundMessage{Type: "port_closed", Data: map[string]int{"port": port}})
+	}
+}
+
+// Probe a new port and report it, unless it closed in the meantime
+func (w *portWatcher) announce(port listeningPort) {
+	port.HTTP = probeHTTP(port)
+	if port.HTTP {
+		port.URL = fmt.Sprintf("http://localhost:%d", port.Port)
+	}
+
+	w.mu.Lock()
+	delete(w.probing, port.Port)
+	_, still := w.listening[port.Port]
+	if still {
+		w.open[port.Port] = port
+	}
+	w.mu.Unlock()
+
+	if still {
+		log.Printf("Port %d opened on %s (http: %v)", port.Port, port.Address, port.HTTP)
+		broadcast(nil, portOpenedMessages(port)...)
+	}
+}
+
+func portOpenedMessages(port listeningPort) []outboundMessage {
+	messages := []outboundMessage{{Type: "port_opened", Data: port}}
+	if port.HTTP {
+		messages = append(messages, outboundMessage{Type: "server_ready", Data: port.URL})
+	}
+	return messages
+}
+
+// Tell a new connection about the ports that are already open
+func (w *portWatcher) replay(h *PtyHandler) {
+	w.mu.Lock()
+	open := make([]listeningPort, 0, len(w.open))
+	for _, port := range w.open {
+		open = append(open, port)
+	}
+	w.mu.Unlock()
+
+	sort.Slice(open, func(i, j int) bool { return open[i].Port < open[j].Port })
+	for _, port := range open {
+		for _, msg := range portOpenedMessages(port) {
+			h.sendMessage(msg)
+		}
+	}
+}
+
+// Listening TCP ports of the pod, with the address each is bound to
+func readListeningPorts() (map[int]string, error) {
+	listening := make(map[int]string)
+	read := 0
+	for _, path := range procNetTCPFiles {
+		file, err := os.Open(path)
+		if err != nil {
+			// tcp6 is missing when IPv6 is disabled
+			continue
+		}
+		read++
+
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // Header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != tcpStateListen {
+				continue
+			}
+			address, port, err := parseProcNetAddress(fields[1])
+			if err != nil {
+				continue
+			}
+			if _, seen := listening[port]; !seen {
+				listening[port] = address
+			}
+		}
+		file.Close()
+	}
+
+	if read == 0 {
+		return nil, fmt.Errorf("none of %s is readable", strings.Join(procNetTCPFiles, ", "))
+	}
+	return listening, nil
+}
+
+// Decode a /proc/net/tcp address such as 0100007F:1F90. The address is stored as
+// host-endian 32-bit words, little-endian on every platform the labs run on.
+func parseProcNetAddress(field string) (string, int, error) {
+	hexAddress, hexPort, found := strings.Cut(field, ":")
+	if !found {
+		return "", 0, fmt.Errorf("invalid address %q", field)
+	}
+
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", 0, err
+	}
+
+	raw, err := hex.DecodeString(hexAddress)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", 0, fmt.Errorf("invalid address %q", field)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return net.IP(raw).String(), int(port), nil
+}
+
+// Check whether the port answers HTTP requests
+func probeHTTP(port listeningPort) bool {
+	host := port.Address
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	client := &http.Client{
+		Timeout: httpProbeTimeout,
+		// Any response means HTTP, redirects included
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort(host, strconv.Itoa(port.Port)))
+	for attempt := 1; attempt <= httpProbeAttempts; attempt++ {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return false
+}
@@ -5,49 +5,50 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// --- CONSTANTS FOR MARKERS ---
-const (
-	MarkerStartPrefix = "__DEV_START:"
-	MarkerEndPrefix   = "__DEV_END:"
-)
+// How long a client gets to take one message
+const writeWait = 10 * time.Second
 
 type PtyHandler struct {
-	conn *websocket.Conn
-	mu   sync.Mutex
+	conn       *websocket.Conn
+	sessions   map[string]*ptySession
+	sessionsMu sync.Mutex
+	execs      map[string]*execProcess
+	execsMu    sync.Mutex
+	done       chan struct{}
+	mu         sync.Mutex
+
+	// Receives run_log messages
+	runLogSubscribed atomic.Bool
 }
 
 type inboundMessage struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data,omitempty"`
+	Type    string          `json:"type"`
+	Session string          `json:"session,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 type outboundMessage struct {
-	Type string `json:"type"`
-	Data any    `json:"data,omitempty"`
+	Type    string `json:"type"`
+	Session string `json:"session,omitempty"`
+	Data    any    `json:"data,omitempty"`
 }
 
 type testRequestEnvelope struct {
-	Type         string `json:"type"` // currently: "checkpoint"
+	Type         string `json:"type"` // "checkpoint", "final" for a final submission or "judge"
 	CheckpointID string `json:"checkpointId"`
 	Language     string `json:"language"`
 }
 
-type runRequestEnvelope struct {
-	InitCommands []string `json:"initCommands"`
-	RunCommand   string   `json:"runCommand"`
-}
-
 func servePty(w http.ResponseWriter, r *http.Request) {
 	conn, err := websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -55,132 +56,61 @@ func servePty(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	handler := &PtyHandler{conn: conn}
-	go handler.start()
-}
-
-func (h *PtyHandler) start() {
-	defer h.conn.Close()
-
-	backendNetwork := os.Getenv("PTY_BACKEND_NETWORK")
-	if backendNetwork == "" {
-		backendNetwork = "unix"
-	}
-
-	backendAddr := os.Getenv("PTY_BACKEND_ADDR")
-	if backendAddr == "" {
-		backendAddr = "/tmp/pty/shell.sock"
-	}
-
-	// Retry logic for connecting to the PTY backend (socat might be starting)
-	var backendConn net.Conn
-	var err error
-	// Try a few times to connect in case the container is just coming up
-	for i := 0; i < 5; i++ {
-		backendConn, err = net.Dial(backendNetwork, backendAddr)
-		if err == nil {
-			break
-		}
-		time.Sleep(500 * time.Millisecond)
-	}
-
-	if err != nil {
-		log.Printf("Failed to connect to PTY backend (%s %s): %v", backendNetwork, backendAddr, err)
-		h.sendMessage(outboundMessage{Type: "error", Data: "PTY backend unavailable"})
-		return
+	handler := &PtyHandler{
+		conn:     conn,
+		sessions: make(map[string]*ptySession),
+		execs:    make(map[string]*execProcess),
+		done:     make(chan struct{}),
 	}
-	defer backendConn.Close()
-
-	// Use a WaitGroup to ensure we don't close the socket while writing/reading
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		h.handlePtyOutput(backendConn)
-	}()
-
-	go func() {
-		defer wg.Done()
-		h.handleWebSocketMessages(backendConn)
-	}()
-
-	go h.sendHeartbeat()
-
-	wg.Wait()
+	go handler.start(r.URL.Query()["token"])
 }
 
-func (h *PtyHandler) scanForEvents(chunk []byte) {
-	s := string(chunk)
-
-	// 1. Check for Command Start Marker
-	if strings.Contains(s, MarkerStartPrefix) {
-		parts := strings.Split(s, MarkerStartPrefix)
-		if len(parts) > 1 {
-			rest := parts[1]
-			endOfLine := strings.Index(rest, "'")
-			if endOfLine != -1 {
-				cmdName := rest[:endOfLine]
-				h.sendMessage(outboundMessage{Type: "run_executing", Data: map[string]string{"step": cmdName}})
-			}
-		}
-	}
-
-	if strings.Contains(s, MarkerEndPrefix) {
-		re := regexp.MustCompile(MarkerEndPrefix + `(.*?):(\d+)`)
-		matches := re.FindStringSubmatch(s)
-		if len(matches) == 3 {
-			cmdName := matches[1]
-			exitCode := matches[2]
-			status := "success"
-			if exitCode != "0" {
-				status = "error"
-			}
-			h.sendMessage(outboundMessage{Type: "run_completed", Data: map[string]string{
-				"step":   cmdName,
-				"status": status,
-				"code":   exitCode,
-			}})
+func (h *PtyHandler) start(tokens []string) {
+	defer h.conn.Close()
+	defer close(h.done)
+	defer h.detachAll()
+	defer h.killExecs()
+	defer unregisterHandler(h)
+
+	// Re-attach the sessions of a previous connection
+	for _, token := range tokens {
+		if _, err := h.attachByToken(token); err != nil {
+			h.sendMessage(outboundMessage{Type: "session_error", Data: map[string]any{"message": err.Error()}})
 		}
 	}
-	//TODO: Should be updated with an optimal approach later
-	if strings.Contains(s, "Local:") || strings.Contains(s, "Listening on") || strings.Contains(s, "http://localhost") {
-		h.sendMessage(outboundMessage{Type: "server_ready", Data: s})
-	}
-}
 
-func (h *PtyHandler) handlePtyOutput(backend io.Reader) {
-	buf := make([]byte, 4096) // Larger buffer for efficiency
-	for {
-		n, err := backend.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("PTY read error: %v", err)
-			}
+	if h.session(DEFAULT_SESSION_ID) == nil {
+		if _, err := h.openSession(DEFAULT_SESSION_ID); err != nil {
+			log.Printf("Failed to open default terminal session: %v", err)
+			h.sendMessage(outboundMessage{Type: "error", Data: "PTY backend unavailable"})
 			return
 		}
+	}
 
-		h.mu.Lock()
-		h.conn.WriteMessage(websocket.TextMessage, buf[:n])
-		h.mu.Unlock()
+	registerHandler(h)
+	ports.replay(h)
+	usage.replay(h)
+	go h.sendHeartbeat()
 
-		chunkCopy := make([]byte, n)
-		copy(chunkCopy, buf[:n])
-		go h.scanForEvents(chunkCopy)
-	}
+	h.handleWebSocketMessages()
 }
 
 func (h *PtyHandler) sendHeartbeat() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		heartbeat := outboundMessage{Type: "heartbeat"}
-		h.sendMessage(heartbeat)
+	for {
+		select {
+		case <-ticker.C:
+			heartbeat := outboundMessage{Type: "heartbeat"}
+			h.sendMessage(heartbeat)
+		case <-h.done:
+			return
+		}
 	}
 }
 
-func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
+func (h *PtyHandler) handleWebSocketMessages() {
 	log.Printf("Starting WebSocket message handler")
 	for {
 		_, msg, err := h.conn.ReadMessage()
@@ -194,12 +124,14 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 		if err := json.Unmarshal(msg, &wsMsg); err != nil {
 			log.Printf("Failed to unmarshal WebSocket message: %v", err)
 			log.Printf("Treating as raw input, writing to PTY")
-			backend.Write(msg)
+			if session := h.session(DEFAULT_SESSION_ID); session != nil {
+				session.Write(msg)
+			}
 			continue
 		}
 
 		// Only log interesting messages to keep logs clean
-		if wsMsg.Type != "input" && wsMsg.Type != "heartbeat_response" {
+		if wsMsg.Type != "input" && wsMsg.Type != "exec_input" && wsMsg.Type != "heartbeat_response" {
 			log.Printf("Received WebSocket message: %+v", wsMsg)
 		}
 
@@ -209,10 +141,35 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 			if len(wsMsg.Data) > 0 {
 				_ = json.Unmarshal(wsMsg.Data, &data)
 			}
-			io.WriteString(backend, data)
+			if session := h.sessionFor(wsMsg); session != nil {
+				io.WriteString(session, data)
+			}
+
+		case "session_open":
+			h.handleSessionOpen(wsMsg)
+
+		case "session_attach":
+			h.handleSessionAttach(wsMsg)
+
+		case "session_close":
+			h.handleSessionClose(wsMsg.Session)
+
+		case "resize":
+			h.handleResize(wsMsg)
 
 		case "kill_user_processes":
-			h.handleKillUserProcesses(backend)
+			if session := h.sessionFor(wsMsg); session != nil {
+				h.handleKillUserProcesses(session)
+			}
+
+		case "exec":
+			h.handleExec(wsMsg.Data)
+
+		case "exec_input":
+			h.handleExecInput(wsMsg.Data)
+
+		case "exec_kill":
+			h.handleExecKill(wsMsg.Data)
 
 		case "heartbeat":
 			// Server-side heartbeat handling if client sends one
@@ -224,8 +181,26 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 		case "test":
 			h.handleTestMessage(wsMsg.Data)
 
-		case "run":
-			h.handleRunMessage(wsMsg.Data, backend)
+		case "test_cancel":
+			h.handleTestCancel(wsMsg.Data)
+
+		case "run", "run_start":
+			h.handleRunControl("start", wsMsg.Data)
+
+		case "run_stop":
+			h.handleRunControl("stop", nil)
+
+		case "run_restart":
+			h.handleRunControl("restart", wsMsg.Data)
+
+		case "run_status":
+			h.handleRunControl("status", nil)
+
+		case "run_subscribe":
+			h.subscribeRunLogs()
+
+		case "run_unsubscribe":
+			h.runLogSubscribed.Store(false)
 
 		default:
 			log.Printf("Unknown message type: %s", wsMsg.Type)
@@ -233,143 +208,141 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 	}
 }
 
-func (h *PtyHandler) handleTestMessage(raw json.RawMessage) {
-	// client sends: { type: "test", data: JSON.stringify({...}) }
-	// so `data` is a JSON string containing a JSON object.
-	var payloadStr string
-	if len(raw) > 0 {
-		_ = json.Unmarshal(raw, &payloadStr)
-	}
+func (h *PtyHandler) sendTestError(checkpointID, code, message string) {
+	h.sendMessage(outboundMessage{Type: "test_error", Data: map[string]any{"checkpointId": checkpointID, "code": code, "message": message}})
+}
 
-	if strings.TrimSpace(payloadStr) == "" {
-		h.sendMessage(outboundMessage{Type: "test_error", Data: map[string]any{"message": "missing test payload"}})
+func (h *PtyHandler) handleTestMessage(raw json.RawMessage) {
+	// client sends: { type: "test", data: JSON.stringify({...}) }, an object works as well
+	var req testRequestEnvelope
+	if err := decodeMessageData(raw, &req); err != nil {
+		h.sendTestError("", TEST_ERROR_INVALID_REQUEST, "invalid test payload: "+err.Error())
 		return
 	}
 
-	var req testRequestEnvelope
-	if err := json.Unmarshal([]byte(payloadStr), &req); err != nil {
-		h.sendMessage(outboundMessage{Type: "test_error", Data: map[string]any{"message": "invalid test payload: " + err.Error()}})
+	switch req.Type {
+	case TEST_MODE_CHECKPOINT:
+		if _, err := parseCheckpoint(req.CheckpointID); err != nil {
+			h.sendTestError(req.CheckpointID, testErrorCode(err), err.Error())
+			return
+		}
+	case TEST_MODE_JUDGE:
+		checkpoint, err := parseCheckpoint(req.CheckpointID)
+		if err != nil {
+			h.sendTestError(req.CheckpointID, testErrorCode(err), err.Error())
+			return
+		}
+		if len(judgeCases[checkpoint]) == 0 {
+			h.sendTestError(req.CheckpointID, TEST_ERROR_INVALID_REQUEST, fmt.Sprintf("checkpoint %d has no judge test cases", checkpoint))
+			return
+		}
+	case TEST_MODE_FINAL:
+		if len(finalSuites()) == 0 {
+			h.sendTestError(FINAL_CHECKPOINT_ID, TEST_ERROR_INVALID_REQUEST, "this quest has no tests to submit")
+			return
+		}
+		req.CheckpointID = FINAL_CHECKPOINT_ID
+	default:
+		h.sendTestError(req.CheckpointID, TEST_ERROR_INVALID_REQUEST, "unsupported test request")
 		return
 	}
 
-	fmt.Printf("\n Received the test request, %v", req)
-	if req.Type != "checkpoint" || strings.TrimSpace(req.CheckpointID) == "" {
-		h.sendMessage(outboundMessage{Type: "test_error", Data: map[string]any{"message": "unsupported test request"}})
+	job, position, err := tests.enqueue(req.Type, strings.TrimSpace(req.CheckpointID), req.Language)
+	if err != nil {
+		h.sendTestError(req.CheckpointID, testErrorCode(err), err.Error())
 		return
 	}
+	broadcast(nil, job.message("test_queued", map[string]any{"position": position}))
+}
 
-	fmt.Printf("Valid checkpoint ID found: %s\n, starting tests", req.CheckpointID)
-
-	h.sendMessage(outboundMessage{Type: "test_started", Data: map[string]any{"checkpointId": req.CheckpointID}})
+// Interrupt the foreground job of the session and stop the supervised run
+func (h *PtyHandler) handleKillUserProcesses(session *ptySession) {
+	log.Printf("Handling kill_user_processes")
 
-	go func() {
-		// Calling the existing external function provided in your project context
-		result, err := RunCheckpointTestForClient(req.CheckpointID, req.Language)
-		if err != nil {
-			h.sendMessage(outboundMessage{Type: "test_error", Data: map[string]any{"checkpointId": req.CheckpointID, "message": err.Error()}})
-			return
-		}
-		// Calling the existing external function provided in your project context
-		StoreTestResultInLab(os.Getenv("LAB_ID"), result)
-		h.sendMessage(outboundMessage{Type: "test_completed", Data: result})
-	}()
-}
-func wrapCommand(name, cmd string) string {
-	return fmt.Sprintf("echo '%s%s'; %s; echo '%s%s:$?'", MarkerStartPrefix, name, cmd, MarkerEndPrefix, name)
+	_, _ = session.Write([]byte{3})
+	h.handleRunControl("stop", nil)
 }
 
-func (h *PtyHandler) handleRunMessage(raw json.RawMessage, backend io.Writer) {
-	var payloadStr string
-	if len(raw) > 0 {
-		_ = json.Unmarshal(raw, &payloadStr)
+// Decode message data sent either as an object or as a JSON encoded string
+func decodeMessageData(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("missing data")
 	}
 
-	if strings.TrimSpace(payloadStr) == "" {
-		h.sendMessage(outboundMessage{Type: "run_error", Data: map[string]any{"message": "missing run payload"}})
-		return
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), `"`) {
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return err
+		}
+		raw = json.RawMessage(encoded)
 	}
+	return json.Unmarshal(raw, v)
+}
 
-	var req runRequestEnvelope
-	if err := json.Unmarshal([]byte(payloadStr), &req); err != nil {
-		h.sendMessage(outboundMessage{Type: "run_error", Data: map[string]any{"message": "invalid run payload: " + err.Error()}})
-		return
-	}
-
-	log.Printf("Received run request: init=%v, run=%s", req.InitCommands, req.RunCommand)
-	h.sendMessage(outboundMessage{Type: "run_started", Data: map[string]any{"message": "Starting commands..."}})
-
-	// Check if node_modules exists (Optional check kept from original, but inline)
-	checkNodeModules := "[ -d /workspace/node_modules ] && echo 'EXISTS' || echo 'MISSING'\n"
-	_, _ = io.WriteString(backend, checkNodeModules)
-	time.Sleep(100 * time.Millisecond)
-
-	// Execute init commands if provided (e.g. npm install)
-	for i, initCmd := range req.InitCommands {
-		if strings.TrimSpace(initCmd) != "" {
-			log.Printf("Executing init command: %s", initCmd)
-			stepName := fmt.Sprintf("init_%d", i)
-			// WRAP THE COMMAND
-			wrapped := wrapCommand(stepName, initCmd)
-			_, _ = io.WriteString(backend, wrapped+"\n")
-			time.Sleep(200 * time.Millisecond)
-		}
+// Resolve the session a message targets, telling the client when it does not exist
+func (h *PtyHandler) sessionFor(msg inboundMessage) *ptySession {
+	session := h.session(msg.Session)
+	if session == nil {
+		h.sendMessage(outboundMessage{Type: "session_error", Session: msg.Session, Data: map[string]any{"message": "unknown session"}})
 	}
+	return session
+}
 
-	// Execute run command (e.g. npm run dev)
-	if strings.TrimSpace(req.RunCommand) != "" {
-		log.Printf("Executing run command: %s", req.RunCommand)
-		// WRAP THE COMMAND
-		wrapped := wrapCommand("main_run", req.RunCommand)
-		_, _ = io.WriteString(backend, wrapped+"\n")
-		// We rely on scanForEvents to send the "run_executing" message now
+func (h *PtyHandler) updateLabActivity() {
+	if labID := os.Getenv("LAB_ID"); labID != "" {
+		Reporter.UpdateLabMonitorQueue(labID)
 	}
 }
 
-func (h *PtyHandler) handleKillUserProcesses(backend io.Writer) {
-	log.Printf("Handling kill_user_processes (Fire & Forget)")
-
-	_, _ = backend.Write([]byte{3, 3})
-
-	cleanupScript := `
-{
-  stty -echo  # Silence output
-  
-  # 1. Kill any background jobs (like the one we just Ctrl+C'd)
-  kill -9 $(jobs -p) 2>/dev/null || true
-  
-  # 2. Kill all processes owned by this user
-  me=$$
-  my_uid=$(id -u)
-  
-  # Get all PIDs for this user
-  pids=$(pgrep -u $my_uid)
-  
-  for pid in $pids; do
-    # Protect the shell ($me) and the PTY bridge ($PPID)
-    if [ "$pid" != "$me" ] && [ "$pid" != "$PPID" ]; then
-       kill -9 $pid 2>/dev/null || true
-    fi
-  done
-  
-  stty echo   # Restore echo for the next session
-  clear       # Wipe the screen
+// Every open connection, for lab-wide events
+var (
+	handlers   = make(map[*PtyHandler]struct{})
+	handlersMu sync.Mutex
+)
+
+func registerHandler(h *PtyHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[h] = struct{}{}
 }
-`
-	// Execute immediately
-	_, _ = io.WriteString(backend, cleanupScript+"\n")
+
+func unregisterHandler(h *PtyHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	delete(handlers, h)
 }
 
-func (h *PtyHandler) updateLabActivity() {
-	if labID := os.Getenv("LAB_ID"); labID != "" {
-		// External function provided in project context
-		UpdateLabMonitorQueue(labID)
+// Send messages to every connection that matches the filter, or to all with a nil filter
+func broadcast(filter func(*PtyHandler) bool, messages ...outboundMessage) {
+	handlersMu.Lock()
+	targets := make([]*PtyHandler, 0, len(handlers))
+	for handler := range handlers {
+		if filter == nil || filter(handler) {
+			targets = append(targets, handler)
+		}
+	}
+	handlersMu.Unlock()
+
+	for _, handler := range targets {
+		for _, msg := range messages {
+			handler.sendMessage(msg)
+		}
 	}
 }
 
 func (h *PtyHandler) sendMessage(msg outboundMessage) {
+	data, _ := json.Marshal(msg)
+	h.writeText(data)
+}
+
+// Write one text frame. A client that does not take it within writeWait is disconnected,
+// so that it can't hold up broadcasts to everyone else.
+func (h *PtyHandler) writeText(data []byte) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	data, _ := json.Marshal(msg)
-	h.conn.WriteMessage(websocket.TextMessage, data)
+	h.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := h.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		h.conn.Close()
+	}
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Test queue
+//
+// Test runs of the lab go through one queue and run one at a time, whichever connection
+// asked for them:
+//
+//	-> {"type": "test", "data": {"type": "checkpoint", "checkpointId": "2", "language": "react"}}
+//	<- {"type": "test_queued", "data": {"jobId": "test-3", "checkpointId": "2", "position": 1}}
+//	<- {"type": "test_started", "data": {"jobId": "test-3", "checkpointId": "2"}}
+//	<- {"type": "test_progress", "data": {"jobId": "test-3", "checkpointId": "2", "event": "test_passed",
+//	    "file": "checkpoint-2.test.js", "name": "renders the form", "durationMs": 35}}
+//	<- {"type": "test_completed", "data": {"jobId": "test-3", "runId": "lab1-9f2c...", "results": [{"checkpoint": 2, "status": "PASSED", ...}]}}
+//
+// A request for a checkpoint that is already queued or running joins that job. position is
+// 0 for the running job; queued jobs are sent their new position when the queue moves.
+// `test_cancel` {"jobId"} or {"checkpointId"} cancels a job, with no data every job; the job
+// ends with `test_cancelled`. Failures to run are `test_error` {"jobId", "checkpointId",
+// "code", "message"}. Every test event goes to every connection of the lab. Final
+// submissions are jobs of checkpoint "final", see final.go. Events of final and judge jobs
+// (see judge.go) carry their mode.
+
+const maxQueuedTests = 8
+
+// Modes of a test job, the type of its request
+const (
+	TEST_MODE_CHECKPOINT = "checkpoint"
+	TEST_MODE_FINAL      = "final"
+	TEST_MODE_JUDGE      = "judge"
+)
+
+type testJob struct {
+	id           string
+	mode         string
+	checkpointID string
+	language     string
+	// Set while running
+	cancel context.CancelFunc
+}
+
+type testQueue struct {
+	jobs    []*testJob // Waiting, the next one first
+	running *testJob
+	nextID  int
+	wake    chan struct{}
+	mu      sync.Mutex
+}
+
+var tests = &testQueue{wake: make(chan struct{}, 1)}
+
+// Add a job, or join the queued or running job of the same mode and checkpoint
+func (q *testQueue) enqueue(mode, checkpointID, language string) (*testJob, int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	same := func(job *testJob) bool {
+		return job.mode == mode && job.checkpointID == checkpointID && job.language == language
+	}
+	if job := q.running; job != nil && same(job) {
+		return job, 0, nil
+	}
+	// With nothing running the first waiting job is about to start
+	offset := 1
+	if q.running == nil {
+		offset = 0
+	}
+	for i, job := range q.jobs {
+		if same(job) {
+			return job, i + offset, nil
+		}
+	}
+	if len(q.jobs) >= maxQueuedTests {
+		return nil, 0, newTestRunnerError(TEST_ERROR_QUEUE_FULL, "too many queued test runs")
+	}
+
+	q.nextID++
+	job := &testJob{id: fmt.Sprintf("test-%d", q.nextID), mode: mode, checkpointID: checkpointID, language: language}
+	q.jobs = append(q.jobs, job)
+	position := len(q.jobs) - 1 + offset
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, position, nil
+}
+
+// Run the queued jobs one after the other, for the lifetime of the relay
+func (q *testQueue) run() {
+	for range q.wake {
+		for {
+			job, ctx := q.next()
+			if job == nil {
+				break
+			}
+			q.runJob(ctx, job)
+
+			q.mu.Lock()
+			job.cancel()
+			q.running = nil
+			q.mu.Unlock()
+		}
+	}
+}
+
+// Move the next job to running and tell the waiting ones their new position
+func (q *testQueue) next() (*testJob, context.Context) {
+	q.mu.Lock()
+	if len(q.jobs) == 0 {
+		q.mu.Unlock()
+		return nil, nil
+	}
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job.cancel = cancel
+	q.running = job
+
+	positions := make([]outboundMessage, len(q.jobs))
+	for i, waiting := range q.jobs {
+		positions[i] = waiting.message("test_queued", map[string]any{"position": i + 1})
+	}
+	q.mu.Unlock()
+
+	// Slow clients must not hold up the queue
+	broadcast(nil, positions...)
+	return job, ctx
+}
+
+func (q *testQueue) runJob(ctx context.Context, job *testJob) {
+	log.Printf("Running %s tests of checkpoint %s (%s) as %s", job.mode, job.checkpointID, job.language, job.id)
+	broadcast(nil, job.message("test_started", nil))
+	switch job.mode {
+	case TEST_MODE_FINAL:
+		q.runFinalJob(ctx, job)
+		return
+	case TEST_MODE_JUDGE:
+		q.runJudgeJob(ctx, job)
+		return
+	}
+
+	runID := newRunID()
+	var counter testCounter
+	result, err := RunCheckpointTestForClient(ctx, job.checkpointID, job.language, func(progress TestProgress) {
+		counter.count(progress)
+		broadcast(nil, job.message("test_progress", progress))
+	})
+	switch {
+	case err != nil && testErrorCode(err) == TEST_ERROR_CANCELLED:
+		log.Printf("Test run %s cancelled", job.id)
+		broadcast(nil, job.message("test_cancelled", nil))
+	case err != nil:
+		log.Printf("Tests of checkpoint %s failed to run: %v", job.checkpointID, err)
+		broadcast(nil, job.message("test_error", map[string]any{"code": testErrorCode(err), "message": err.Error()}))
+	default:
+		for i := range result.Results {
+			result.Results[i].RunID = runID
+			if len(result.Results) > 1 {
+				result.Results[i].RunID = fmt.Sprintf("%s-%d", runID, result.Results[i].Checkpoint)
+			}
+			result.Results[i].CompletedAt = time.Now().Unix()
+		}
+		if err := Reporter.StoreTestResult(os.Getenv("LAB_ID"), result); err != nil {
+			log.Printf("Failed to store test result: %v", err)
+		}
+		for _, checkpointResult := range result.Results {
+			submitTestRun(checkpointResult.RunID, checkpointResult, counter)
+		}
+		broadcast(nil, job.message("test_completed", map[string]any{"runId": runID, "results": result.Results}))
+	}
+}
+
+// Cancel the job with the given id or checkpoint, or every job when both are empty.
+// Reports whether a job was found.
+func (q *testQueue) cancel(jobID, checkpointID string) bool {
+	matches := func(job *testJob) bool {
+		return (jobID == "" && checkpointID == "") || (jobID != "" && job.id == jobID) ||
+			(jobID == "" && job.checkpointID == checkpointID)
+	}
+
+	q.mu.Lock()
+	found := false
+	var cancelled []outboundMessage
+	remaining := q.jobs[:0]
+	for _, job := range q.jobs {
+		if matches(job) {
+			found = true
+			cancelled = append(cancelled, job.message("test_cancelled", nil))
+			continue
+		}
+		remaining = append(remaining, job)
+	}
+	q.jobs = remaining
+
+	// The runner reports the cancellation when the run is gone
+	if job := q.running; job != nil && matches(job) {
+		found = true
+		job.cancel()
+	}
+	q.mu.Unlock()
+
+	broadcast(nil, cancelled...)
+	return found
+}
+
+// A test event of the job, with data merged into its identifiers
+func (job *testJob) message(kind string, data any) outboundMessage {
+	fields := map[string]any{}
+	if data != nil {
+		encoded, _ := json.Marshal(data)
+		json.Unmarshal(encoded, &fields)
+	}
+	fields["jobId"] = job.id
+	fields["checkpointId"] = job.checkpointID
+	if job.mode != TEST_MODE_CHECKPOINT {
+		fields["mode"] = job.mode
+	}
+	return outboundMessage{Type: kind, Data: fields}
+}
+
+type testCancelRequest struct {
+	JobID        string `json:"jobId"`
+	CheckpointID string `json:"checkpointId"`
+}
+
+func (h *PtyHandler) handleTestCancel(raw json.RawMessage) {
+	var req testCancelRequest
+	if len(raw) > 0 && strings.TrimSpace(string(raw)) != "null" {
+		if err := decodeMessageData(raw, &req); err != nil {
+			h.sendTestError("", TEST_ERROR_INVALID_REQUEST, "invalid test_cancel payload: "+err.Error())
+			return
+		}
+	}
+
+	if !tests.cancel(req.JobID, req.CheckpointID) && (req.JobID != "" || req.CheckpointID != "") {
+		h.sendMessage(outboundMessage{Type: "test_error", Data: map[string]any{
+			"jobId":        req.JobID,
+			"checkpointId": req.CheckpointID,
+			"code":         TEST_ERROR_INVALID_REQUEST,
+			"message":      "no such test run",
+		}})
+	}
+}
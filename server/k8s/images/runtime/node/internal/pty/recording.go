@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session recording
+//
+// When PTY_RECORDING_ENABLED is set (the quest's privacy flag) every session is recorded
+// as an asciicast v2 file: a JSON header line followed by one [time, code, data] event per
+// line, where code is "o" for output, "i" for input and "r" for a resize ("COLSxROWS").
+//
+// Recordings are spooled to PTY_RECORDING_DIR while the session runs. When it ends the file
+// is uploaded to recordings/<lab id>/<session>-<start>.cast through a presigned URL issued
+// by the API at API_BASE_URL. Events past PTY_RECORDING_MAX_BYTES are dropped.
+
+const asciicastContentType = "application/x-asciicast"
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type sessionRecorder struct {
+	name      string
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	started   time.Time
+	written   int64
+	truncated bool
+	closed    bool
+	mu        sync.Mutex
+}
+
+type recordingUploadResponse struct {
+	Success bool   `json:"success"`
+	URL     string `json:"url"`
+	Key     string `json:"key"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Read recording settings from the environment
+func loadRecordingConfig() {
+	if enabled := os.Getenv("PTY_RECORDING_ENABLED"); enabled != "" {
+		if parsed, err := strconv.ParseBool(enabled); err == nil {
+			PTY_RECORDING_ENABLED = parsed
+		} else {
+			log.Printf("Invalid PTY_RECORDING_ENABLED %q", enabled)
+		}
+	}
+
+	if dir := os.Getenv("PTY_RECORDING_DIR"); dir != "" {
+		PTY_RECORDING_DIR = dir
+	}
+
+	if size := os.Getenv("PTY_RECORDING_MAX_BYTES"); size != "" {
+		if parsed, err := strconv.ParseInt(size, 10, 64); err == nil && parsed > 0 {
+			PTY_RECORDING_MAX_BYTES = parsed
+		} else {
+			log.Printf("Invalid PTY_RECORDING_MAX_BYTES %q", size)
+		}
+	}
+
+	if PTY_RECORDING_ENABLED {
+		if os.Getenv("API_BASE_URL") == "" {
+			log.Printf("Session recording is enabled but API_BASE_URL is not set, recordings stay in %s", PTY_RECORDING_DIR)
+		}
+		log.Printf("Session recording enabled, spooling to %s", PTY_RECORDING_DIR)
+	}
+}
+
+// Start recording a session, writing the asciicast header
+func newSessionRecorder(sessionID string) (*sessionRecorder, error) {
+	if err := os.MkdirAll(PTY_RECORDING_DIR, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	started := time.Now()
+	name := fmt.Sprintf("%s-%s.cast", sessionID, started.UTC().Format("20060102T150405.000Z"))
+	path := filepath.Join(PTY_RECORDING_DIR, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording %s: %w", name, err)
+	}
+
+	recorder := &sessionRecorder{
+		name:    name,
+		path:    path,
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		started: started,
+	}
+
+	// The pty-host starts shells at 80x24, the client's size follows as a resize event
+	header, _ := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     80,
+		Height:    24,
+		Timestamp: started.Unix(),
+		Title:     fmt.Sprintf("%s/%s", LabID, sessionID),
+		Env:       map[string]string{"TERM": "xterm-256color", "SHELL": "/bin/bash"},
+	})
+	recorder.writeLine(header)
+	return recorder, nil
+}
+
+func (r *sessionRecorder) output(p []byte) {
+	r.event("o", string(p))
+}
+
+func (r *sessionRecorder) input(p []byte) {
+	r.event("i", string(p))
+}
+
+func (r *sessionRecorder) resize(size resizeRequest) {
+	r.event("r", fmt.Sprintf("%dx%d", size.Cols, size.Rows))
+}
+
+func (r *sessionRecorder) event(code, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.truncated {
+		return
+	}
+
+	// Microsecond precision is plenty for playback
+	elapsed := math.Round(time.Since(r.started).Seconds()*1e6) / 1e6
+	line, err := json.Marshal([]any{elapsed, code, data})
+	if err != nil {
+		return
+	}
+
+	if r.written+int64(len(line))+1 > PTY_RECORDING_MAX_BYTES {
+		r.truncated = true
+		log.Printf("Recording %s reached %d bytes, dropping further events", r.name, PTY_RECORDING_MAX_BYTES)
+		return
+	}
+	r.writeLine(line)
+}
+
+func (r *sessionRecorder) writeLine(line []byte) {
+	r.writer.Write(line)
+	r.writer.WriteByte('\n')
+	r.written += int64(len(line)) + 1
+}
+
+// Close the recording and upload it. The local file is kept when the upload fails.
+func (r *sessionRecorder) finish() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to write recording %s: %v", r.name, err)
+		return
+	}
+
+	baseURL := os.Getenv("API_BASE_URL")
+	if baseURL == "" {
+		return
+	}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err = uploadRecording(baseURL, r.path, r.name); err == nil {
+			break
+		}
+		log.Printf("Upload of recording %s failed (attempt %d): %v", r.name, attempt, err)
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+	if err != nil {
+		return
+	}
+
+	if err := os.Remove(r.path); err != nil {
+		log.Printf("Failed to remove uploaded recording %s: %v", r.name, err)
+	}
+	log.Printf("Recording %s uploaded", r.name)
+}
+
+// Ask the API for an upload URL and PUT the recording to it
+func uploadRecording(baseURL, path, name string) error {
+	client := &http.Client{Timeout: 2 * time.Minute}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The URL is signed for this size
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "size": info.Size()})
+	endpoint := fmt.Sprintf("%s/v1/recordings/%s/upload-url", strings.TrimRight(baseURL, "/"), url.PathEscape(LabID))
+	uploadReq, err := newAPIRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	uploadReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(uploadReq)
+	if err != nil {
+		return fmt.Errorf("failed to request upload URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var upload recordingUploadResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&upload); err != nil {
+		return fmt.Errorf("invalid upload URL response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || !upload.Success || upload.URL == "" {
+		return fmt.Errorf("upload URL request failed with status %d: %s", resp.StatusCode, upload.Error)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, upload.URL, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", asciicastContentType)
+
+	putResp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload recording: %w", err)
+	}
+	defer putResp.Body.Close()
+
+	if putResp.StatusCode < 200 || putResp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(putResp.Body, 1024))
+		return fmt.Errorf("object storage returned status %d: %s", putResp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
@@ -5,17 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	RedisClient *redis.Client
-	Context     context.Context
-)
-
 type LabProgressEntry struct {
 	Timestamp   int64
 	Status      LabStatus
@@ -53,6 +47,13 @@ type LabInstanceEntry struct {
 	LastUpdatedAt    int64                   `json:"lastUpdatedAt"`
 	ProgressLogs     []LabProgressEntry      `json:"progressLogs"`
 	TestResults      []DevsArenaRunnerResult `json:"testResults"`
+	// The latest final submission; Completed once one passed
+	FinalReport *FinalTestReport `json:"finalReport,omitempty"`
+	Completed   bool             `json:"completed"`
+	CompletedAt int64            `json:"completedAt,omitempty"`
+	// Set by the API server when the lab starts, kept as is
+	UserID    string `json:"userId,omitempty"`
+	QuestSlug string `json:"questSlug,omitempty"`
 }
 
 type LabMonitoringEntry struct {
@@ -62,60 +63,41 @@ type LabMonitoringEntry struct {
 	CreatedAt     int64
 }
 
-func InitRedis() {
-	redisURI := os.Getenv("REDIS_URI")
+// RedisStatusReporter reports lab status to the shared Redis instance used by the API server
+type RedisStatusReporter struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+func NewRedisStatusReporter(redisURI string) (*RedisStatusReporter, error) {
 	log.Printf("Connecting to Redis at: %s", redisURI)
 	opt, err := redis.ParseURL(redisURI)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid REDIS_URI: %w", err)
 	}
 
-	RedisClient = redis.NewClient(opt)
-	Context = context.Background()
+	client := redis.NewClient(opt)
+	ctx := context.Background()
 
 	// Test connection
-	_, err = RedisClient.Ping(Context).Result()
-	if err != nil {
-		panic(err)
+	if _, err := client.Ping(ctx).Result(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
 	}
 
 	log.Println("Redis connection established")
+	return &RedisStatusReporter{client: client, ctx: ctx}, nil
 }
 
-func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
-	if RedisClient == nil {
-		log.Fatalf("Redis client is not initialized")
-	}
-
-	// Get existing instance
-	data, err := RedisClient.HGet(Context, "lab_instances", labID).Result()
-	if err != nil {
-		log.Printf("Failed to fetch lab instance %s: %v", labID, err)
-		return
-	}
-
-	var instance LabInstanceEntry
-	err = json.Unmarshal([]byte(data), &instance)
+func (r *RedisStatusReporter) UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
+	instance, err := r.getLabInstance(labID)
 	if err != nil {
-		log.Printf("Failed to unmarshal lab instance: %v", err)
 		return
 	}
 
 	// Update progress logs and status
-	instance.ProgressLogs = append(instance.ProgressLogs, progress)
-	instance.Status = progress.Status
-	instance.LastUpdatedAt = progress.Timestamp
-
-	// Save updated instance
-	updatedData, err := json.Marshal(instance)
-	if err != nil {
-		log.Printf("Failed to marshal lab instance: %v", err)
-		return
-	}
+	applyProgress(&instance, progress)
 
-	err = RedisClient.HSet(Context, "lab_instances", labID, updatedData).Err()
-	if err != nil {
-		log.Printf("Failed to update lab instance %s: %v", labID, err)
+	if err := r.saveLabInstance(labID, instance); err != nil {
 		return
 	}
 
@@ -123,16 +105,11 @@ func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
 }
 
 // UpdateLabMonitorQueue updates the updatedAt field for a lab in the lab_monitor queue
-func UpdateLabMonitorQueue(labID string) {
-	if RedisClient == nil {
-		log.Printf("Redis client not initialized, skipping lab monitor update")
-		return
-	}
-
+func (r *RedisStatusReporter) UpdateLabMonitorQueue(labID string) {
 	currentTime := time.Now().Unix()
 
 	// Get all items from the lab_monitor queue
-	monitorItems, err := RedisClient.LRange(Context, "labs_monitor", 0, -1).Result()
+	monitorItems, err := r.client.LRange(r.ctx, "labs_monitor", 0, -1).Result()
 	if err != nil {
 		log.Printf("Failed to get lab monitor queue: %v", err)
 		return
@@ -159,7 +136,7 @@ func UpdateLabMonitorQueue(labID string) {
 			}
 
 			// Update the list item
-			err = RedisClient.LSet(Context, "labs_monitor", int64(i), updatedData).Err()
+			err = r.client.LSet(r.ctx, "labs_monitor", int64(i), updatedData).Err()
 			if err != nil {
 				log.Printf("Failed to update lab monitor entry for %s: %v", labID, err)
 			} else {
@@ -172,58 +149,70 @@ func UpdateLabMonitorQueue(labID string) {
 	log.Printf("Lab %s not found in monitor queue, skipping update", labID)
 }
 
-// StoreTestResultInLab stores a test result in the lab instance
-func StoreTestResultInLab(labID string, testResults DevsArenaRunnerFinal) error {
-	if RedisClient == nil {
-		return fmt.Errorf("redis client not initialized")
+// StoreTestResult stores a test result in the lab instance
+func (r *RedisStatusReporter) StoreTestResult(labID string, testResults DevsArenaRunnerFinal) error {
+	if len(testResults.Results) == 0 {
+		return fmt.Errorf("no test results to store for lab %s", labID)
 	}
 
-	// Get existing instance
-	data, err := RedisClient.HGet(Context, "lab_instances", labID).Result()
+	instance, err := r.getLabInstance(labID)
 	if err != nil {
-		log.Printf("Failed to fetch lab instance %s: %v", labID, err)
 		return err
 	}
 
-	var instance LabInstanceEntry
-	err = json.Unmarshal([]byte(data), &instance)
-	if err != nil {
-		log.Printf("Failed to unmarshal lab instance: %v", err)
+	applyTestResults(&instance, testResults)
+
+	if err := r.saveLabInstance(labID, instance); err != nil {
 		return err
 	}
 
-	// Initialize tests array if nil
-	if instance.TestResults == nil {
-		instance.TestResults = []DevsArenaRunnerResult{}
+	log.Printf("Test result stored for lab %s, checkpoint %d", labID, instance.TestResults[len(instance.TestResults)-1].Checkpoint)
+	return nil
+}
+
+// StoreFinalResult stores a final submission in the lab instance
+func (r *RedisStatusReporter) StoreFinalResult(labID string, report FinalTestReport) error {
+	instance, err := r.getLabInstance(labID)
+	if err != nil {
+		return err
 	}
 
-	testResult := testResults.Results[len(testResults.Results)-1]
+	applyFinalReport(&instance, report)
 
-	for _, result := range testResults.Results {
-		instance.TestResults = append(instance.TestResults, result)
+	if err := r.saveLabInstance(labID, instance); err != nil {
+		return err
 	}
 
-	instance.ActiveCheckpoint = testResult.Checkpoint
+	log.Printf("Final submission stored for lab %s: passed=%v, score %.1f%%", labID, report.Passed, report.Score)
+	return nil
+}
+
+func (r *RedisStatusReporter) getLabInstance(labID string) (LabInstanceEntry, error) {
+	var instance LabInstanceEntry
+
+	data, err := r.client.HGet(r.ctx, "lab_instances", labID).Result()
+	if err != nil {
+		log.Printf("Failed to fetch lab instance %s: %v", labID, err)
+		return instance, err
+	}
 
-	if testResult.Status == TestPassed {
-		instance.ActiveCheckpoint++
+	if err := json.Unmarshal([]byte(data), &instance); err != nil {
+		log.Printf("Failed to unmarshal lab instance: %v", err)
+		return instance, err
 	}
-	// Update last updated timestamp
-	instance.LastUpdatedAt = time.Now().Unix()
+	return instance, nil
+}
 
-	// Save updated instance
+func (r *RedisStatusReporter) saveLabInstance(labID string, instance LabInstanceEntry) error {
 	updatedData, err := json.Marshal(instance)
 	if err != nil {
 		log.Printf("Failed to marshal lab instance: %v", err)
 		return err
 	}
 
-	err = RedisClient.HSet(Context, "lab_instances", labID, updatedData).Err()
-	if err != nil {
+	if err := r.client.HSet(r.ctx, "lab_instances", labID, updatedData).Err(); err != nil {
 		log.Printf("Failed to update lab instance %s: %v", labID, err)
 		return err
 	}
-
-	log.Printf("Test result stored for lab %s, checkpoint %d", labID, testResult.Checkpoint)
 	return nil
 }
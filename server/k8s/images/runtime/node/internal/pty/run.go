@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Supervised run
+//
+// The learner's run command is owned by the run supervisor of the pty-host instead of being
+// typed into their shell:
+//
+//	-> {"type": "run_start", "data": {"initCommands": ["npm install"], "runCommand": "npm run dev", "autoRestart": true}}
+//	-> {"type": "run_stop"} | {"type": "run_restart"} | {"type": "run_status"}
+//	<- {"type": "run_status", "data": {"state": "running", "step": "main_run", "pid": 120, "restarts": 0, ...}}
+//
+// `run` is an alias of `run_start`, and `run_restart` may carry a new spec. Every connection
+// is told about status changes with `run_status`; steps are also reported with
+// `run_executing` {"step"} and `run_completed` {"step", "status", "code"}. Output of the
+// supervised processes goes as `run_log` {"stream", "data"} to connections that sent
+// `run_subscribe`, starting with the last PTY_SCROLLBACK_BYTES of it marked "replay": true.
+// Failures are reported as `run_error`.
+
+const (
+	FRAME_RUN        byte = 8
+	FRAME_RUN_STATUS byte = 9
+	FRAME_SUBSCRIBE  byte = 10
+
+	FRAME_USAGE_SUBSCRIBE byte = 11
+	FRAME_USAGE           byte = 12
+)
+
+// Long enough for a stop that ends in SIGKILL
+const runRequestTimeout = 30 * time.Second
+
+type runSpec struct {
+	InitCommands []string          `json:"initCommands,omitempty"`
+	RunCommand   string            `json:"runCommand"`
+	Cwd          string            `json:"cwd,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	AutoRestart  bool              `json:"autoRestart,omitempty"`
+}
+
+type runStatus struct {
+	State       string `json:"state"`
+	Step        string `json:"step,omitempty"`
+	Pid         int    `json:"pid,omitempty"`
+	RunCommand  string `json:"runCommand,omitempty"`
+	ExitCode    *int   `json:"exitCode,omitempty"`
+	Restarts    int    `json:"restarts"`
+	AutoRestart bool   `json:"autoRestart"`
+	StartedAt   int64  `json:"startedAt,omitempty"`
+}
+
+type runEvent struct {
+	Event  string    `json:"event"`
+	Status runStatus `json:"status"`
+}
+
+type runRequest struct {
+	Op   string   `json:"op"`
+	Spec *runSpec `json:"spec,omitempty"`
+}
+
+type runReply struct {
+	Status runStatus `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var (
+	// Recent output of the supervised processes, for run_subscribe
+	runLogs   *ringBuffer
+	runLogsMu sync.Mutex
+)
+
+// Send one request to the supervisor and wait for its reply
+func sendRunRequest(req runRequest) (runReply, error) {
+	var reply runReply
+
+	conn, err := net.DialTimeout(PTY_CONTROL_NETWORK, PTY_CONTROL_ADDR, 5*time.Second)
+	if err != nil {
+		return reply, fmt.Errorf("app container unavailable: %w", err)
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(req)
+	if err := writeFrame(conn, FRAME_RUN, payload); err != nil {
+		return reply, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(runRequestTimeout))
+	kind, data, err := readFrame(conn)
+	if err != nil {
+		return reply, fmt.Errorf("no reply from the run supervisor: %w", err)
+	}
+	if kind != FRAME_RUN_STATUS {
+		return reply, fmt.Errorf("unexpected reply frame %d", kind)
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return reply, fmt.Errorf("invalid run reply: %w", err)
+	}
+	return reply, nil
+}
+
+func (h *PtyHandler) handleRunControl(op string, raw json.RawMessage) {
+	req := runRequest{Op: op}
+	if op == "start" || (op == "restart" && len(raw) > 0) {
+		var spec runSpec
+		if err := decodeMessageData(raw, &spec); err != nil {
+			h.sendMessage(outboundMessage{Type: "run_error", Data: map[string]any{"message": "invalid run payload: " + err.Error()}})
+			return
+		}
+		req.Spec = &spec
+	}
+
+	if op == "start" {
+		log.Printf("Received run request: init=%v, run=%s", req.Spec.InitCommands, req.Spec.RunCommand)
+		h.sendMessage(outboundMessage{Type: "run_started", Data: map[string]any{"message": "Starting commands..."}})
+	}
+
+	// A stop can take a while, keep reading messages meanwhile
+	go func() {
+		reply, err := sendRunRequest(req)
+		if err == nil && reply.Error != "" {
+			err = fmt.Errorf("%s", reply.Error)
+		}
+		if err != nil {
+			log.Printf("Run %s failed: %v", op, err)
+			h.sendMessage(outboundMessage{Type: "run_error", Data: map[string]any{"message": err.Error()}})
+			return
+		}
+		// Changes reach every connection through the subscription, only a status query is
+		// answered directly
+		if op == "status" {
+			h.sendMessage(outboundMessage{Type: "run_status", Data: reply.Status})
+		}
+	}()
+}
+
+// Start sending run_log to this connection, beginning with the recent output
+func (h *PtyHandler) subscribeRunLogs() {
+	runLogsMu.Lock()
+	defer runLogsMu.Unlock()
+
+	if h.runLogSubscribed.Swap(true) {
+		return
+	}
+	if runLogs == nil {
+		return
+	}
+	if history := runLogs.Bytes(); len(history) > 0 {
+		h.sendMessage(outboundMessage{Type: "run_log", Data: map[string]any{
+			"stream": "stdout",
+			"data":   string(history),
+			"replay": true,
+		}})
+	}
+}
+
+// Follow the supervisor for the lifetime of the relay, reconnecting when the app container
+// restarts
+func watchRunSupervisor() {
+	runLogsMu.Lock()
+	runLogs = newRingBuffer(PTY_SCROLLBACK_BYTES)
+	runLogsMu.Unlock()
+
+	// Log a lost subscription, but only the first of a series of failed dials
+	failing := false
+	for {
+		connected, err := followRunSupervisor()
+		if connected || !failing {
+			log.Printf("Run supervisor subscription ended: %v", err)
+		}
+		failing = !connected
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Relay supervisor events until the subscription breaks. connected reports whether it was
+// established at all.
+func followRunSupervisor() (connected bool, err error) {
+	conn, err := net.DialTimeout(PTY_CONTROL_NETWORK, PTY_CONTROL_ADDR, 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := writeFrame(conn, FRAME_SUBSCRIBE, nil); err != nil {
+		return false, err
+	}
+
+	reader := bufio.NewReader(conn)
+	pending := map[byte][]byte{}
+	streams := map[byte]string{FRAME_STDOUT: "stdout", FRAME_STDERR: "stderr"}
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			return true, err
+		}
+
+		switch kind {
+		case FRAME_RUN_STATUS:
+			var event runEvent
+			if err := json.Unmarshal(payload, &event); err != nil {
+				log.Printf("Invalid run event: %v", err)
+				continue
+			}
+			broadcast(nil, runStatusMessages(event)...)
+
+		case FRAME_STDOUT, FRAME_STDERR:
+			// Keep runes split across frames together
+			chunk, rest := splitIncompleteRune(append(pending[kind], payload...))
+			pending[kind] = append([]byte(nil), rest...)
+			if len(chunk) == 0 {
+				continue
+			}
+
+			runLogsMu.Lock()
+			runLogs.Write(chunk)
+			broadcast(func(h *PtyHandler) bool { return h.runLogSubscribed.Load() }, outboundMessage{
+				Type: "run_log",
+				Data: map[string]any{"stream": streams[kind], "data": string(chunk)},
+			})
+			runLogsMu.Unlock()
+		}
+	}
+}
+
+// A status change, plus the step messages clients relied on before the supervisor
+func runStatusMessages(event runEvent) []outboundMessage {
+	messages := []outboundMessage{{Type: "run_status", Data: event.Status}}
+
+	switch event.Event {
+	case "step_started":
+		messages = append(messages, outboundMessage{Type: "run_executing", Data: map[string]string{"step": event.Status.Step}})
+	case "step_finished":
+		code := -1
+		if event.Status.ExitCode != nil {
+			code = *event.Status.ExitCode
+		}
+		status := "success"
+		if code != 0 {
+			status = "error"
+		}
+		messages = append(messages, outboundMessage{Type: "run_completed", Data: map[string]string{
+			"step":   event.Status.Step,
+			"status": status,
+			"code":   fmt.Sprintf("%d", code),
+		}})
+	}
+	return messages
+}
@@ -0,0 +1,52 @@
+package main
+
+import "unicode/utf8"
+
+// ringBuffer keeps the most recent output of a session for replay on re-attach
+type ringBuffer struct {
+	data  []byte
+	start int
+	size  int
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, capacity)}
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	capacity := len(r.data)
+	if capacity == 0 {
+		return
+	}
+
+	// Only the tail of an oversized write can survive
+	if len(p) >= capacity {
+		copy(r.data, p[len(p)-capacity:])
+		r.start = 0
+		r.size = capacity
+		return
+	}
+
+	end := (r.start + r.size) % capacity
+	n := copy(r.data[end:], p)
+	copy(r.data, p[n:])
+
+	r.size += len(p)
+	if r.size > capacity {
+		r.start = (r.start + r.size - capacity) % capacity
+		r.size = capacity
+	}
+}
+
+// Bytes returns a copy of the buffered output, oldest first. Bytes cut in the middle of a
+// UTF-8 sequence by wrapping are dropped from the front.
+func (r *ringBuffer) Bytes() []byte {
+	out := make([]byte, r.size)
+	n := copy(out, r.data[r.start:min(r.start+r.size, len(r.data))])
+	copy(out[n:], r.data[:r.size-n])
+
+	for len(out) > 0 && !utf8.RuneStart(out[0]) {
+		out = out[1:]
+	}
+	return out
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Terminal sessions
+//
+// A connection can drive several shells at once. Every session owns its own backend
+// connection (the backend starts a fresh login shell per connection) and is addressed by the
+// `session` field of inbound and outbound messages:
+//
+//	-> {"type": "session_open", "session": "tests"}
+//	<- {"type": "session_opened", "session": "tests", "data": {"token": "..."}}
+//	-> {"type": "input", "session": "tests", "data": "npm test\n"}
+//	<- {"type": "output", "session": "tests", "data": "..."}
+//	-> {"type": "session_close", "session": "tests"}
+//	<- {"type": "session_closed", "session": "tests", "data": {"reason": "closed"}}
+//
+// `session_open` and `resize` may carry the terminal size as {"rows": 40, "cols": 120}.
+//
+// The "default" session is opened with the connection and keeps the original protocol:
+// messages without a `session` field target it and its output is sent as raw text frames.
+// PTY_MAX_SESSIONS caps the number of live sessions across every connection to the lab.
+//
+// Sessions outlive the WebSocket. When a connection drops its sessions are detached and
+// keep running, recording the last PTY_SCROLLBACK_BYTES of output. A client re-attaches
+// with the token from `session_opened`, either by connecting with `?token=<token>` (the
+// parameter may repeat) or by sending {"type": "session_attach", "data": {"token": "..."}}.
+// It receives `session_attached` followed by the scrollback. Sessions that stay detached
+// for PTY_SESSION_IDLE_TIMEOUT are closed.
+
+const DEFAULT_SESSION_ID = "default"
+
+var (
+	sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+	activeSessions   int
+	activeSessionsMu sync.Mutex
+
+	// Every live session, attached or not, by token
+	sessionsByToken   = make(map[string]*ptySession)
+	sessionsByTokenMu sync.Mutex
+
+	errSessionLimit = errors.New("terminal session limit reached")
+)
+
+type ptySession struct {
+	id      string
+	token   string
+	backend net.Conn
+	framed  bool
+	writeMu sync.Mutex
+
+	// Connection the session is attached to, nil while detached
+	handler    *PtyHandler
+	detachedAt time.Time
+	scrollback *ringBuffer
+	mu         sync.Mutex
+
+	// Asciicast recording, nil unless PTY_RECORDING_ENABLED
+	recorder *sessionRecorder
+
+	closeOnce sync.Once
+}
+
+type sessionAttachRequest struct {
+	Token string `json:"token"`
+}
+
+func acquireSessionSlot() bool {
+	activeSessionsMu.Lock()
+	defer activeSessionsMu.Unlock()
+
+	if activeSessions >= PTY_MAX_SESSIONS {
+		return false
+	}
+	activeSessions++
+	return true
+}
+
+func releaseSessionSlot() {
+	activeSessionsMu.Lock()
+	defer activeSessionsMu.Unlock()
+	activeSessions--
+}
+
+// Read session overrides from the environment
+func loadSessionConfig() {
+	if max := os.Getenv("PTY_MAX_SESSIONS"); max != "" {
+		if parsed, err := strconv.Atoi(max); err == nil && parsed > 0 {
+			PTY_MAX_SESSIONS = parsed
+		} else {
+			log.Printf("Invalid PTY_MAX_SESSIONS %q", max)
+		}
+	}
+
+	if size := os.Getenv("PTY_SCROLLBACK_BYTES"); size != "" {
+		if parsed, err := strconv.Atoi(size); err == nil && parsed >= 0 {
+			PTY_SCROLLBACK_BYTES = parsed
+		} else {
+			log.Printf("Invalid PTY_SCROLLBACK_BYTES %q", size)
+		}
+	}
+
+	if timeout := os.Getenv("PTY_SESSION_IDLE_TIMEOUT"); timeout != "" {
+		if duration, err := time.ParseDuration(timeout); err == nil {
+			PTY_SESSION_IDLE_TIMEOUT = duration
+		} else {
+			log.Printf("Invalid PTY_SESSION_IDLE_TIMEOUT %q: %v", timeout, err)
+		}
+	}
+}
+
+// Connect to the shell backend, retrying while the container is still coming up
+func dialBackend() (net.Conn, error) {
+	backendNetwork := os.Getenv("PTY_BACKEND_NETWORK")
+	if backendNetwork == "" {
+		backendNetwork = "unix"
+	}
+
+	backendAddr := os.Getenv("PTY_BACKEND_ADDR")
+	if backendAddr == "" {
+		backendAddr = "/tmp/pty/shell.sock"
+	}
+
+	var backendConn net.Conn
+	var err error
+	for i := 0; i < 5; i++ {
+		backendConn, err = net.Dial(backendNetwork, backendAddr)
+		if err == nil {
+			return backendConn, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("failed to connect to PTY backend (%s %s): %w", backendNetwork, backendAddr, err)
+}
+
+// Start a new shell session. It is registered but not attached to any connection.
+func newSession(id string) (*ptySession, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid session id %q", id)
+	}
+	if !acquireSessionSlot() {
+		return nil, errSessionLimit
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		releaseSessionSlot()
+		return nil, err
+	}
+
+	backendConn, err := dialBackend()
+	if err != nil {
+		releaseSessionSlot()
+		return nil, err
+	}
+
+	session := &ptySession{
+		id:         id,
+		token:      token,
+		backend:    backendConn,
+		framed:     PTY_BACKEND_PROTOCOL == BACKEND_PROTOCOL_FRAMED,
+		detachedAt: time.Now(),
+		scrollback: newRingBuffer(PTY_SCROLLBACK_BYTES),
+	}
+
+	// A session that cannot be recorded still runs
+	if PTY_RECORDING_ENABLED {
+		if session.recorder, err = newSessionRecorder(id); err != nil {
+			log.Printf("Recording of session %s disabled: %v", id, err)
+		}
+	}
+
+	sessionsByTokenMu.Lock()
+	sessionsByToken[token] = session
+	sessionsByTokenMu.Unlock()
+
+	go session.pump()
+
+	log.Printf("Terminal session %s started", id)
+	return session, nil
+}
+
+func newSessionToken() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %w", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func lookupSession(token string) *ptySession {
+	sessionsByTokenMu.Lock()
+	defer sessionsByTokenMu.Unlock()
+	return sessionsByToken[token]
+}
+
+// Copy shell output into the scrollback and to the attached connection, if any
+func (s *ptySession) pump() {
+	buf := make([]byte, 4096) // Larger buffer for efficiency
+	pending := 0
+	for {
+		n, err := s.backend.Read(buf[pending:])
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("PTY read error on session %s: %v", s.id, err)
+			}
+			break
+		}
+
+		// Hold back a rune split across reads so every frame is valid UTF-8
+		chunk, rest := splitIncompleteRune(buf[:pending+n])
+		if len(chunk) > 0 {
+			chunkCopy := make([]byte, len(chunk))
+			copy(chunkCopy, chunk)
+
+			if s.recorder != nil {
+				s.recorder.output(chunkCopy)
+			}
+
+			s.mu.Lock()
+			s.scrollback.Write(chunkCopy)
+			if s.handler != nil {
+				s.handler.writeOutput(s.id, chunkCopy)
+			}
+			s.mu.Unlock()
+		}
+		pending = copy(buf, rest)
+	}
+
+	// The shell exited on its own, unless the session was already closed
+	s.terminate("exited")
+}
+
+// Close the shell and tell the attached connection why
+func (s *ptySession) terminate(reason string) {
+	s.closeOnce.Do(func() {
+		sessionsByTokenMu.Lock()
+		delete(sessionsByToken, s.token)
+		sessionsByTokenMu.Unlock()
+
+		s.backend.Close()
+		releaseSessionSlot()
+
+		if s.recorder != nil {
+			go s.recorder.finish()
+		}
+
+		s.mu.Lock()
+		handler := s.handler
+		s.handler = nil
+		s.mu.Unlock()
+
+		if handler != nil {
+			handler.forgetSession(s)
+			handler.sendMessage(outboundMessage{Type: "session_closed", Session: s.id, Data: map[string]string{"reason": reason}})
+		}
+		log.Printf("Terminal session %s %s", s.id, reason)
+	})
+}
+
+// Attach a session to this connection. On re-attach the scrollback is replayed before any
+// new output. A session attached elsewhere is taken over.
+func (h *PtyHandler) attach(session *ptySession, replay bool) error {
+	h.sessionsMu.Lock()
+	if existing, exists := h.sessions[session.id]; exists && existing != session {
+		h.sessionsMu.Unlock()
+		return fmt.Errorf("session %q is already open", session.id)
+	}
+	h.sessions[session.id] = session
+	h.sessionsMu.Unlock()
+
+	session.mu.Lock()
+	previous := session.handler
+	session.handler = h
+	session.detachedAt = time.Time{}
+
+	if replay {
+		history := session.scrollback.Bytes()
+		h.sendMessage(outboundMessage{Type: "session_attached", Session: session.id, Data: map[string]any{
+			"token":    session.token,
+			"replayed": len(history),
+		}})
+		if len(history) > 0 {
+			h.writeOutput(session.id, history)
+		}
+	} else {
+		h.sendMessage(outboundMessage{Type: "session_opened", Session: session.id, Data: map[string]string{"token": session.token}})
+	}
+	session.mu.Unlock()
+
+	if previous != nil && previous != h {
+		previous.forgetSession(session)
+		previous.sendMessage(outboundMessage{Type: "session_detached", Session: session.id, Data: map[string]string{"reason": "attached_elsewhere"}})
+	}
+	return nil
+}
+
+// Detach every session from a closing connection, leaving the shells running
+func (h *PtyHandler) detachAll() {
+	h.sessionsMu.Lock()
+	sessions := h.sessions
+	h.sessions = make(map[string]*ptySession)
+	h.sessionsMu.Unlock()
+
+	for _, session := range sessions {
+		session.mu.Lock()
+		detached := session.handler == h
+		if detached {
+			session.handler = nil
+			session.detachedAt = time.Now()
+		}
+		session.mu.Unlock()
+
+		if detached && PTY_SESSION_IDLE_TIMEOUT <= 0 {
+			session.terminate("closed")
+		}
+	}
+}
+
+// Close sessions nobody re-attached to in time
+func reapDetachedSessions() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sessionsByTokenMu.Lock()
+		var expired []*ptySession
+		for _, session := range sessionsByToken {
+			session.mu.Lock()
+			if session.handler == nil && time.Since(session.detachedAt) > PTY_SESSION_IDLE_TIMEOUT {
+				expired = append(expired, session)
+			}
+			session.mu.Unlock()
+		}
+		sessionsByTokenMu.Unlock()
+
+		for _, session := range expired {
+			session.terminate("expired")
+		}
+	}
+}
+
+func (h *PtyHandler) openSession(id string) (*ptySession, error) {
+	if h.session(id) != nil {
+		return nil, fmt.Errorf("session %q is already open", id)
+	}
+
+	session, err := newSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.attach(session, false); err != nil {
+		session.terminate("closed")
+		return nil, err
+	}
+	return session, nil
+}
+
+func (h *PtyHandler) attachByToken(token string) (*ptySession, error) {
+	session := lookupSession(token)
+	if session == nil {
+		return nil, errors.New("unknown or expired session token")
+	}
+	if err := h.attach(session, true); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (h *PtyHandler) session(id string) *ptySession {
+	if id == "" {
+		id = DEFAULT_SESSION_ID
+	}
+
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	return h.sessions[id]
+}
+
+// Drop a session from this connection's view, if it is still there
+func (h *PtyHandler) forgetSession(session *ptySession) {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	if h.sessions[session.id] == session {
+		delete(h.sessions, session.id)
+	}
+}
+
+func (h *PtyHandler) handleSessionOpen(msg inboundMessage) {
+	id := msg.Session
+	session, err := h.openSession(id)
+	if err != nil {
+		log.Printf("Failed to open terminal session %s: %v", id, err)
+		h.sendMessage(outboundMessage{Type: "session_error", Session: id, Data: map[string]any{"message": err.Error()}})
+		return
+	}
+
+	// Start the shell at the size of the client's terminal
+	if len(msg.Data) > 0 && session.framed {
+		if size, err := parseResizeRequest(msg.Data); err == nil {
+			session.resize(size)
+		}
+	}
+}
+
+func (h *PtyHandler) handleSessionAttach(msg inboundMessage) {
+	var req sessionAttachRequest
+	if err := decodeMessageData(msg.Data, &req); err != nil || req.Token == "" {
+		h.sendMessage(outboundMessage{Type: "session_error", Session: msg.Session, Data: map[string]any{"message": "missing session token"}})
+		return
+	}
+
+	if _, err := h.attachByToken(req.Token); err != nil {
+		h.sendMessage(outboundMessage{Type: "session_error", Session: msg.Session, Data: map[string]any{"message": err.Error()}})
+	}
+}
+
+func (h *PtyHandler) handleSessionClose(id string) {
+	session := h.session(id)
+	if session == nil {
+		h.sendMessage(outboundMessage{Type: "session_error", Session: id, Data: map[string]any{"message": "unknown session"}})
+		return
+	}
+	session.terminate("closed")
+}
+
+// Send output to the client: raw frames for the default session, tagged messages otherwise
+func (h *PtyHandler) writeOutput(sessionID string, chunk []byte) {
+	if sessionID == DEFAULT_SESSION_ID {
+		h.writeText(chunk)
+		return
+	}
+	h.sendMessage(outboundMessage{Type: "output", Session: sessionID, Data: string(chunk)})
+}
+
+// Split off a trailing incomplete UTF-8 sequence
+func splitIncompleteRune(data []byte) ([]byte, []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		start := len(data) - i
+		if !utf8.RuneStart(data[start]) {
+			continue
+		}
+		if !utf8.FullRune(data[start:]) {
+			return data[:start], data[start:]
+		}
+		break
+	}
+	return data, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatusReporter publishes lab progress, terminal activity, checkpoint results and final
+// submissions.
+// STATUS_REPORTER picks the backend (redis, memory or none); when unset, Redis is used
+// only if REDIS_URI is configured, so the relay also runs outside the cluster.
+type StatusReporter interface {
+	UpdateLabInstanceProgress(labID string, progress LabProgressEntry)
+	UpdateLabMonitorQueue(labID string)
+	StoreTestResult(labID string, testResults DevsArenaRunnerFinal) error
+	StoreFinalResult(labID string, report FinalTestReport) error
+}
+
+const (
+	STATUS_REPORTER_REDIS  = "redis"
+	STATUS_REPORTER_MEMORY = "memory"
+	STATUS_REPORTER_NONE   = "none"
+)
+
+var Reporter StatusReporter = NoopStatusReporter{}
+
+func InitStatusReporter() error {
+	kind := os.Getenv("STATUS_REPORTER")
+	if kind == "" {
+		kind = STATUS_REPORTER_NONE
+		if os.Getenv("REDIS_URI") != "" {
+			kind = STATUS_REPORTER_REDIS
+		}
+	}
+
+	switch kind {
+	case STATUS_REPORTER_REDIS:
+		redisURI := os.Getenv("REDIS_URI")
+		if redisURI == "" {
+			return fmt.Errorf("STATUS_REPORTER is %q but REDIS_URI is not set", kind)
+		}
+		reporter, err := NewRedisStatusReporter(redisURI)
+		if err != nil {
+			return err
+		}
+		Reporter = reporter
+	case STATUS_REPORTER_MEMORY:
+		Reporter = NewMemoryStatusReporter()
+	case STATUS_REPORTER_NONE:
+		Reporter = NoopStatusReporter{}
+	default:
+		return fmt.Errorf("unknown STATUS_REPORTER %q", kind)
+	}
+
+	log.Printf("Lab status reporter: %s", kind)
+	return nil
+}
+
+// NoopStatusReporter drops every update
+type NoopStatusReporter struct{}
+
+func (NoopStatusReporter) UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {}
+
+func (NoopStatusReporter) UpdateLabMonitorQueue(labID string) {}
+
+func (NoopStatusReporter) StoreTestResult(labID string, testResults DevsArenaRunnerFinal) error {
+	return nil
+}
+
+func (NoopStatusReporter) StoreFinalResult(labID string, report FinalTestReport) error {
+	return nil
+}
+
+// MemoryStatusReporter keeps lab state in-process with the same semantics as Redis
+type MemoryStatusReporter struct {
+	instances map[string]*LabInstanceEntry
+	monitor   map[string]LabMonitoringEntry
+	mu        sync.Mutex
+}
+
+func NewMemoryStatusReporter() *MemoryStatusReporter {
+	return &MemoryStatusReporter{
+		instances: make(map[string]*LabInstanceEntry),
+		monitor:   make(map[string]LabMonitoringEntry),
+	}
+}
+
+func (m *MemoryStatusReporter) UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	applyProgress(m.instance(labID), progress)
+}
+
+func (m *MemoryStatusReporter) UpdateLabMonitorQueue(labID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.monitor[labID]
+	entry.LabID = labID
+	entry.Status = Active
+	entry.LastUpdatedAt = time.Now().Unix()
+	m.monitor[labID] = entry
+}
+
+func (m *MemoryStatusReporter) StoreTestResult(labID string, testResults DevsArenaRunnerFinal) error {
+	if len(testResults.Results) == 0 {
+		return fmt.Errorf("no test results to store for lab %s", labID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	applyTestResults(m.instance(labID), testResults)
+	return nil
+}
+
+func (m *MemoryStatusReporter) StoreFinalResult(labID string, report FinalTestReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	applyFinalReport(m.instance(labID), report)
+	return nil
+}
+
+// LabInstance returns a copy of the recorded state of a lab
+func (m *MemoryStatusReporter) LabInstance(labID string) (LabInstanceEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instance, exists := m.instances[labID]
+	if !exists {
+		return LabInstanceEntry{}, false
+	}
+	copied := *instance
+	copied.ProgressLogs = append([]LabProgressEntry(nil), instance.ProgressLogs...)
+	copied.TestResults = append([]DevsArenaRunnerResult(nil), instance.TestResults...)
+	if instance.FinalReport != nil {
+		report := *instance.FinalReport
+		report.Suites = append([]FinalSuiteResult(nil), instance.FinalReport.Suites...)
+		copied.FinalReport = &report
+	}
+	return copied, true
+}
+
+func (m *MemoryStatusReporter) instance(labID string) *LabInstanceEntry {
+	instance, exists := m.instances[labID]
+	if !exists {
+		now := time.Now().Unix()
+		instance = &LabInstanceEntry{
+			LabID:         labID,
+			CreatedAt:     now,
+			Status:        Active,
+			LastUpdatedAt: now,
+		}
+		m.instances[labID] = instance
+	}
+	return instance
+}
+
+func applyProgress(instance *LabInstanceEntry, progress LabProgressEntry) {
+	instance.ProgressLogs = append(instance.ProgressLogs, progress)
+	instance.Status = progress.Status
+	instance.LastUpdatedAt = progress.Timestamp
+}
+
+// Append a run's results and move the lab to the next checkpoint once the last one passed
+func applyTestResults(instance *LabInstanceEntry, testResults DevsArenaRunnerFinal) {
+	if instance.TestResults == nil {
+		instance.TestResults = []DevsArenaRunnerResult{}
+	}
+	instance.TestResults = append(instance.TestResults, testResults.Results...)
+
+	testResult := testResults.Results[len(testResults.Results)-1]
+	instance.ActiveCheckpoint = testResult.Checkpoint
+	if testResult.Status == TestPassed {
+		instance.ActiveCheckpoint++
+	}
+	instance.LastUpdatedAt = time.Now().Unix()
+}
+
+// Keep the latest final submission and complete the quest once one passed. A completed
+// quest stays completed.
+func applyFinalReport(instance *LabInstanceEntry, report FinalTestReport) {
+	instance.FinalReport = &report
+	if report.Passed && !instance.Completed {
+		instance.Completed = true
+		instance.CompletedAt = report.Timestamp
+	}
+	instance.LastUpdatedAt = time.Now().Unix()
+}
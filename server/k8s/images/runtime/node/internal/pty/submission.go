@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Submissions
+//
+// Every completed checkpoint run is reported to the API at API_BASE_URL, which stores it as
+// a Submission of the lab's user. Runs have an id of their own, a retried report is stored
+// once. Without API_BASE_URL results only go to the lab's status (see status.go).
+
+type testSubmission struct {
+	RunID       string     `json:"runId"`
+	Checkpoint  int        `json:"checkpoint"`
+	Status      TestStatus `json:"status"`
+	TestsPassed int        `json:"testsPassed"`
+	TestsTotal  int        `json:"testsTotal"`
+	DurationMs  int64      `json:"durationMs"`
+	Message     string     `json:"message,omitempty"`
+	Hidden      bool       `json:"hidden,omitempty"`
+	SubmittedAt int64      `json:"submittedAt"`
+}
+
+// Counts the tests of a run from its progress
+type testCounter struct {
+	passed int
+	failed int
+}
+
+func (c *testCounter) count(progress TestProgress) {
+	switch progress.Event {
+	case "test_passed":
+		c.passed++
+	case "test_failed":
+		c.failed++
+	}
+}
+
+// The counts of a run with the given status. A suite that failed to load counts as a failed
+// test, one without tests as one.
+func (c testCounter) settle(status TestStatus) testCounter {
+	if status != TestPassed && c.failed == 0 {
+		c.failed = 1
+	}
+	if status == TestPassed && c.passed == 0 {
+		c.passed = 1
+	}
+	return c
+}
+
+func newRunID() string {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Sprintf("%s-%d", LabID, time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s-%s", LabID, hex.EncodeToString(raw))
+}
+
+// Report a completed run in the background
+func submitTestRun(runID string, result DevsArenaRunnerResult, counter testCounter) {
+	baseURL := os.Getenv("API_BASE_URL")
+	if baseURL == "" || LabID == "" || result.Checkpoint < 1 {
+		return
+	}
+
+	counter = counter.settle(result.Status)
+	submission := testSubmission{
+		RunID:       runID,
+		Checkpoint:  result.Checkpoint,
+		Status:      result.Status,
+		TestsPassed: counter.passed,
+		TestsTotal:  counter.passed + counter.failed,
+		DurationMs:  result.DurationMs,
+		Hidden:      result.Hidden,
+		SubmittedAt: time.Now().Unix(),
+	}
+	if result.Error != nil {
+		submission.Message = truncate(result.Error.Message, 2000)
+	}
+
+	go func() {
+		var err error
+		for attempt := 1; attempt <= 3; attempt++ {
+			if err = postSubmission(baseURL, submission); err == nil {
+				log.Printf("Submission %s stored", runID)
+				return
+			}
+			log.Printf("Storing submission %s failed (attempt %d): %v", runID, attempt, err)
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+	}()
+}
+
+func postSubmission(baseURL string, submission testSubmission) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	body, _ := json.Marshal(submission)
+	endpoint := fmt.Sprintf("%s/v1/submissions/%s", strings.TrimRight(baseURL, "/"), url.PathEscape(LabID))
+	req, err := newAPIRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// A request to the API, authenticated as this lab
+func newAPIRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if LabAPISecret != "" {
+		req.Header.Set("Authorization", "Bearer "+LabAPISecret)
+	}
+	return req, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Resource usage
+//
+// The app container's memory and CPU are sampled by the pty-host, which sees its cgroup and
+// processes, and streamed to every connection every PTY_USAGE_INTERVAL:
+//
+//	<- {"type": "resource_usage", "data": {"timestamp": 1718000000000,
+//	    "memory": {"usageBytes": ..., "workingSetBytes": ..., "limitBytes": 268435456, "percent": 61.2},
+//	    "cpu": {"percent": 43.5, "limitCores": 0.5, "throttledPeriods": 12, "throttledPercent": 60, "throttledMs": 310},
+//	    "oomKills": 0, "processes": [{"pid": 120, "command": "node server.js", "rssBytes": ..., "cpuPercent": 40.1}]}}
+//
+// Memory crossing PTY_MEMORY_WARN_PERCENT or PTY_MEMORY_CRITICAL_PERCENT of the limit is
+// reported once per crossing:
+//
+//	<- {"type": "resource_warning", "data": {"resource": "memory", "level": "warning", "percent": 82.4, ...}}
+//
+// and a kill by the kernel's OOM killer with the processes that went missing with it:
+//
+//	<- {"type": "oom_killed", "data": {"count": 1, "total": 1, "limitBytes": 268435456, "processes": [...]}}
+//
+// A new connection gets the latest sample right away.
+
+const (
+	MEMORY_LEVEL_NORMAL   = 0
+	MEMORY_LEVEL_WARNING  = 1
+	MEMORY_LEVEL_CRITICAL = 2
+	// How far usage has to drop below a threshold before it is reported again
+	memoryWarningHysteresis = 5.0
+)
+
+var memoryLevelNames = map[int]string{
+	MEMORY_LEVEL_WARNING:  "warning",
+	MEMORY_LEVEL_CRITICAL: "critical",
+}
+
+type memoryUsage struct {
+	UsageBytes      uint64  `json:"usageBytes"`
+	WorkingSetBytes uint64  `json:"workingSetBytes"`
+	LimitBytes      uint64  `json:"limitBytes"`
+	Percent         float64 `json:"percent"`
+}
+
+type cpuUsage struct {
+	Percent          float64 `json:"percent"`
+	LimitCores       float64 `json:"limitCores"`
+	ThrottledPeriods uint64  `json:"throttledPeriods"`
+	ThrottledPercent float64 `json:"throttledPercent"`
+	ThrottledMs      uint64  `json:"throttledMs"`
+}
+
+type processUsage struct {
+	Pid        int     `json:"pid"`
+	Command    string  `json:"command"`
+	RSSBytes   uint64  `json:"rssBytes"`
+	CPUPercent float64 `json:"cpuPercent"`
+}
+
+type usageSample struct {
+	Timestamp int64          `json:"timestamp"`
+	Memory    memoryUsage    `json:"memory"`
+	CPU       cpuUsage       `json:"cpu"`
+	OOMKills  uint64         `json:"oomKills"`
+	Processes []processUsage `json:"processes"`
+}
+
+type usageWatcher struct {
+	// Latest sample of the current subscription, nil until the first one
+	last        *usageSample
+	memoryLevel int
+	mu          sync.Mutex
+}
+
+var usage = &usageWatcher{}
+
+// Read usage overrides from the environment
+func loadUsageConfig() {
+	if interval := os.Getenv("PTY_USAGE_INTERVAL"); interval != "" {
+		if duration, err := time.ParseDuration(interval); err == nil {
+			PTY_USAGE_INTERVAL = duration
+		} else {
+			log.Printf("Invalid PTY_USAGE_INTERVAL %q: %v", interval, err)
+		}
+	}
+	if warn := os.Getenv("PTY_MEMORY_WARN_PERCENT"); warn != "" {
+		if parsed, err := strconv.ParseFloat(warn, 64); err == nil && parsed > 0 {
+			PTY_MEMORY_WARN_PERCENT = parsed
+		} else {
+			log.Printf("Invalid PTY_MEMORY_WARN_PERCENT %q", warn)
+		}
+	}
+	if critical := os.Getenv("PTY_MEMORY_CRITICAL_PERCENT"); critical != "" {
+		if parsed, err := strconv.ParseFloat(critical, 64); err == nil && parsed > 0 {
+			PTY_MEMORY_CRITICAL_PERCENT = parsed
+		} else {
+			log.Printf("Invalid PTY_MEMORY_CRITICAL_PERCENT %q", critical)
+		}
+	}
+}
+
+// Follow the pty-host's samples for the lifetime of the relay, unless disabled with a zero
+// interval
+func (w *usageWatcher) run() {
+	if PTY_USAGE_INTERVAL <= 0 {
+		log.Printf("Resource usage disabled")
+		return
+	}
+
+	failing := false
+	for {
+		connected, err := w.follow()
+		if connected || !failing {
+			log.Printf("Resource usage subscription ended: %v", err)
+		}
+		failing = !connected
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Relay samples until the subscription breaks. connected reports whether it was established
+// at all.
+func (w *usageWatcher) follow() (connected bool, err error) {
+	conn, err := net.DialTimeout(PTY_CONTROL_NETWORK, PTY_CONTROL_ADDR, 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	request, _ := json.Marshal(map[string]int64{"interval": PTY_USAGE_INTERVAL.Milliseconds()})
+	if err := writeFrame(conn, FRAME_USAGE_SUBSCRIBE, request); err != nil {
+		return false, err
+	}
+
+	// Counters of a restarted app container start over
+	w.mu.Lock()
+	w.last = nil
+	w.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			return true, err
+		}
+		if kind != FRAME_USAGE {
+			continue
+		}
+
+		var sample usageSample
+		if err := json.Unmarshal(payload, &sample); err != nil {
+			log.Printf("Invalid usage sample: %v", err)
+			continue
+		}
+		broadcast(nil, w.record(sample)...)
+	}
+}
+
+// Keep a sample and return the messages it calls for
+func (w *usageWatcher) record(sample usageSample) []outboundMessage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	messages := []outboundMessage{{Type: "resource_usage", Data: sample}}
+
+	if w.last != nil && sample.OOMKills > w.last.OOMKills {
+		// The kernel does not say whom it killed, the likely victims are the big processes
+		// of the previous sample that are gone now
+		victims := []processUsage{}
+		for _, process := range w.last.Processes {
+			if !hasProcess(sample.Processes, process.Pid) {
+				victims = append(victims, process)
+			}
+		}
+		count := sample.OOMKills - w.last.OOMKills
+		log.Printf("OOM killer fired %d time(s), limit %d bytes, likely victims: %v", count, sample.Memory.LimitBytes, victims)
+		messages = append(messages, outboundMessage{Type: "oom_killed", Data: map[string]any{
+			"count":      count,
+			"total":      sample.OOMKills,
+			"limitBytes": sample.Memory.LimitBytes,
+			"processes":  victims,
+			"message":    fmt.Sprintf("Out of memory: a process was killed for exceeding the %s memory limit", formatBytes(sample.Memory.LimitBytes)),
+		}})
+	}
+
+	if warning, ok := w.memoryWarning(sample.Memory); ok {
+		messages = append(messages, warning)
+	}
+
+	w.last = &sample
+	return messages
+}
+
+// A warning when memory reached a higher level than last reported. Callers hold w.mu.
+func (w *usageWatcher) memoryWarning(memory memoryUsage) (outboundMessage, bool) {
+	if memory.LimitBytes == 0 {
+		return outboundMessage{}, false
+	}
+
+	level := MEMORY_LEVEL_NORMAL
+	switch {
+	case memory.Percent >= PTY_MEMORY_CRITICAL_PERCENT:
+		level = MEMORY_LEVEL_CRITICAL
+	case memory.Percent >= PTY_MEMORY_WARN_PERCENT:
+		level = MEMORY_LEVEL_WARNING
+	}
+
+	if level <= w.memoryLevel {
+		// Re-arm a level once usage dropped clearly below it
+		if w.memoryLevel == MEMORY_LEVEL_CRITICAL && memory.Percent < PTY_MEMORY_CRITICAL_PERCENT-memoryWarningHysteresis {
+			w.memoryLevel = MEMORY_LEVEL_WARNING
+		}
+		if w.memoryLevel == MEMORY_LEVEL_WARNING && memory.Percent < PTY_MEMORY_WARN_PERCENT-memoryWarningHysteresis {
+			w.memoryLevel = MEMORY_LEVEL_NORMAL
+		}
+		return outboundMessage{}, false
+	}
+
+	w.memoryLevel = level
+	log.Printf("Memory %s: %.1f%% of %d bytes", memoryLevelNames[level], memory.Percent, memory.LimitBytes)
+	return outboundMessage{Type: "resource_warning", Data: map[string]any{
+		"resource":   "memory",
+		"level":      memoryLevelNames[level],
+		"percent":    memory.Percent,
+		"usageBytes": memory.WorkingSetBytes,
+		"limitBytes": memory.LimitBytes,
+		"message": fmt.Sprintf("Memory usage is at %.0f%% of the %s limit, processes may be killed when it is reached",
+			memory.Percent, formatBytes(memory.LimitBytes)),
+	}}, true
+}
+
+// Send the latest sample to a new connection
+func (w *usageWatcher) replay(h *PtyHandler) {
+	w.mu.Lock()
+	last := w.last
+	w.mu.Unlock()
+
+	if last != nil {
+		h.sendMessage(outboundMessage{Type: "resource_usage", Data: *last})
+	}
+}
+
+func hasProcess(processes []processUsage, pid int) bool {
+	for _, process := range processes {
+		if process.Pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func formatBytes(n uint64) string {
+	if n >= 1<<30 {
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	}
+	return fmt.Sprintf("%d MiB", n>>20)
+}
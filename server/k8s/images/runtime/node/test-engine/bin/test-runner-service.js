@@ -1,32 +1,297 @@
 #!/usr/bin/env node
 
+const crypto = require("crypto");
+const fs = require("fs");
 const http = require("http");
+const path = require("path");
 const { spawn } = require("child_process");
 
 const host = process.env.TEST_RUNNER_HOST || "127.0.0.1";
 const port = Number(process.env.TEST_RUNNER_PORT || "9901");
 
-function run({ checkpoint, language }) {
+const ENGINE_ROOT = "/opt/devsarena/test-engine";
+// The quest's final suite, staged by the pod's init container with the cases it checks
+const FINAL_TESTS_DIR = "/internal-test/final";
+
+// The service runs in the grader sidecar, next to the learner's containers on the pod's
+// network. Only the PTY relay knows the token, so only the relay gets to run tests and read
+// their results. Without one every request is served.
+const GRADER_TOKEN = process.env.GRADER_TOKEN || "";
+
+function authorized(req) {
+  if (!GRADER_TOKEN) return true;
+  const given = Buffer.from(req.headers["authorization"] || "");
+  const expected = Buffer.from(`Bearer ${GRADER_TOKEN}`);
+  return given.length === expected.length && crypto.timingSafeEqual(given, expected);
+}
+
+// The environment of a run, without the grader's own secrets: the learner's code runs in it.
+// Anything the grader alone is configured with goes by one of these prefixes.
+const GRADER_ONLY_ENV = ["GRADER_", "TEST_BUNDLE_"];
+
+function runEnv() {
+  const env = { ...process.env };
+  for (const name of Object.keys(env)) {
+    if (GRADER_ONLY_ENV.some((prefix) => name.startsWith(prefix))) delete env[name];
+  }
+  return env;
+}
+
+// The tests staged by the init container, with the manifest of their hashes signed by the
+// server. Only the server had the private key, the grader checks the signature with the
+// public one. A run whose bundle is missing, unlisted or does not match fails with
+// bundle_invalid rather than grading against the wrong tests. Without a key nothing is checked.
+const TESTS_DIR = "/internal-test";
+const TEST_BUNDLE_PUBLIC_KEY = process.env.TEST_BUNDLE_PUBLIC_KEY || "";
+const MANIFEST_FILES = new Set(["manifest.json", "manifest.sig"]);
+
+function sha256(buffer) {
+  return crypto.createHash("sha256").update(buffer).digest("hex");
+}
+
+// Paths of the files under dir, relative to it
+function listFiles(dir, prefix = "") {
+  let files = [];
+  for (const entry of fs.readdirSync(path.join(dir, prefix), { withFileTypes: true })) {
+    const relative = path.posix.join(prefix, entry.name);
+    if (entry.isDirectory()) files = files.concat(listFiles(dir, relative));
+    else files.push(relative);
+  }
+  return files;
+}
+
+// Why the bundle of a run can't be trusted, or null when it can
+function verifyBundle({ suite, checkpoint }) {
+  if (!TEST_BUNDLE_PUBLIC_KEY) return null;
+
+  let raw, signature;
+  try {
+    raw = fs.readFileSync(path.join(TESTS_DIR, "manifest.json"));
+    signature = Buffer.from(fs.readFileSync(path.join(TESTS_DIR, "manifest.sig"), "utf8").trim(), "hex");
+  } catch (e) {
+    return `test bundle manifest missing: ${e.message}`;
+  }
+  let signed;
+  try {
+    const key = crypto.createPublicKey({ key: Buffer.from(TEST_BUNDLE_PUBLIC_KEY, "base64"), format: "der", type: "spki" });
+    signed = crypto.verify(null, raw, key, signature);
+  } catch (e) {
+    return `invalid test bundle key: ${e.message}`;
+  }
+  if (!signed) return "test bundle manifest signature does not match";
+
+  let manifest;
+  try {
+    manifest = JSON.parse(raw.toString());
+  } catch (e) {
+    return `invalid test bundle manifest: ${e.message}`;
+  }
+  const bundles = manifest.bundles || {};
+  const name = suite === "final" ? "final" : `checkpoint-${checkpoint}`;
+  if (!bundles[name]) return `no test bundle for ${name}`;
+
+  for (const file of bundles[name]) {
+    let content;
+    try {
+      content = fs.readFileSync(path.join(TESTS_DIR, file.path));
+    } catch (_) {
+      return `test bundle ${name}: ${file.path} is missing`;
+    }
+    if (content.length !== file.size || sha256(content) !== file.sha256) {
+      return `test bundle ${name}: ${file.path} does not match its manifest`;
+    }
+  }
+
+  // Jest picks up every test file it finds, so nothing may be there that was not signed
+  const listed = new Set(Object.values(bundles).flat().map((file) => file.path));
+  const unlisted = listFiles(TESTS_DIR).filter((file) => !listed.has(file) && !MANIFEST_FILES.has(file));
+  if (unlisted.length > 0) return `test bundle has unlisted files: ${unlisted.join(", ")}`;
+  return null;
+}
+
+const LIMITS_POLL_MS = 200;
+
+// Limits of a run when the request sets none. 0 turns a limit off.
+const DEFAULT_LIMITS = {
+  timeMs: Number(process.env.TEST_TIME_LIMIT_MS || "90000"),
+  cpuMs: Number(process.env.TEST_CPU_LIMIT_MS || "0"),
+  memoryMb: Number(process.env.TEST_MEMORY_LIMIT_MB || "0")
+};
+const PAGE_SIZE = 4096;
+const CLOCK_TICKS = 100; // USER_HZ
+
+// CPU milliseconds and resident memory of a process group, from /proc. Children that were
+// waited for count through their parent's cutime and cstime.
+function groupUsage(pgid) {
+  let cpuMs = 0;
+  let rssBytes = 0;
+  let entries = [];
+  try {
+    entries = fs.readdirSync("/proc");
+  } catch (_) {
+    return null;
+  }
+  for (const entry of entries) {
+    if (!/^\d+$/.test(entry)) continue;
+    let stat;
+    try {
+      stat = fs.readFileSync(`/proc/${entry}/stat`, "utf8");
+    } catch (_) {
+      continue; // Gone meanwhile
+    }
+    // The fields after the command name, which may contain spaces, starting at the state
+    const fields = stat.slice(stat.lastIndexOf(")") + 2).split(" ");
+    if (Number(fields[2]) !== pgid) continue;
+    const ticks = Number(fields[11]) + Number(fields[12]) + Number(fields[13]) + Number(fields[14]);
+    cpuMs += (ticks * 1000) / CLOCK_TICKS;
+    rssBytes += Number(fields[21]) * PAGE_SIZE;
+  }
+  return { cpuMs, memoryMb: rssBytes / (1024 * 1024) };
+}
+
+// The result of a run that was killed for going over a limit, as the runner would print it
+function limitResult(nonce, checkpoint, exceeded, durationMs) {
+  return `__DEVSARENA_RESULT__:${nonce}:` + JSON.stringify({
+    results: [{
+      checkpoint: checkpoint > 0 ? checkpoint : 0,
+      status: exceeded.status,
+      durationMs,
+      error: {
+        message: exceeded.message,
+        hint: exceeded.status === "MEMORY_LIMIT_EXCEEDED"
+          ? "Look for data that keeps growing, like a list filled in a loop"
+          : "Look for a loop that never ends or work repeated more than needed"
+      }
+    }]
+  });
+}
+
+// The command of a run: a checkpoint through the runner, or the final suite with Jest
+function command({ suite, checkpoint, language }) {
+  if (suite === "final") {
+    return [process.execPath, [
+      path.join(ENGINE_ROOT, "node_modules/jest/bin/jest.js"),
+      `--config=${path.join(ENGINE_ROOT, "jest.config.cjs")}`,
+      `--roots=${FINAL_TESTS_DIR}`,
+      "--testMatch=**/*.js",
+      "--runInBand"
+    ]];
+  }
+  return ["/usr/local/bin/devsarena-test-runner", [
+    `--checkpoint=${checkpoint}`,
+    `--language=${language}`
+  ]];
+}
+
+// Resolves with the runner's output, or with { error } when it could not be started and
+// { error, code: "bundle_invalid" } when its tests failed verification.
+// onProgress receives the reporter's progress events while the run is going.
+// The process tree is killed when it goes over limits.timeMs of wall-clock time, limits.cpuMs
+// of CPU time or limits.memoryMb of resident memory; the run then ends with a
+// TIME_LIMIT_EXCEEDED or MEMORY_LIMIT_EXCEEDED result.
+// The relay's nonce goes to the reporter on stdin, which the runner hands on to Jest: the
+// environment can be read by the code under test, a drained pipe can't. The reporter tags its
+// progress and result lines with it, so that neither can be told apart from anything the
+// tests printed. Any file the reporter could write progress to, the tests could write too.
+function run({ suite, checkpoint, language, nonce = "", limits = DEFAULT_LIMITS, signal, onProgress }) {
   return new Promise((resolve) => {
-    const child = spawn("/usr/local/bin/devsarena-test-runner", [
-      `--checkpoint=${checkpoint}`,
-      `--language=${language}`
-    ], {
+    if (suite === "final" && !fs.existsSync(FINAL_TESTS_DIR)) {
+      return resolve({ error: "this quest has no final tests" });
+    }
+    const invalid = verifyBundle({ suite, checkpoint });
+    if (invalid) {
+      console.log("TEST BUNDLE INVALID: " + invalid);
+      return resolve({ error: invalid, code: "bundle_invalid" });
+    }
+
+    const [file, args] = command({ suite, checkpoint, language });
+    const child = spawn(file, args, {
       env: {
-        ...process.env,
+        ...runEnv(),
         CI: "1",
         NODE_ENV: "test",
         DEVSARENA_LANGUAGE: language,
-        NODE_PATH: "/opt/devsarena/test-engine/node_modules:/workspace/node_modules"
-      }
+        DEVSARENA_RUN_NONCE_STDIN: "1",
+        DEVSARENA_FINAL_CASES: path.join(FINAL_TESTS_DIR, "cases.json"),
+        NODE_PATH: ENGINE_ROOT + "/node_modules:/workspace/node_modules"
+      },
+      // A process group of its own, so Jest's workers go with it
+      detached: true
     });
+    child.stdin.on("error", () => {});
+    child.stdin.end(nonce);
+
+    // The relay gave up waiting or cancelled, don't leave Jest running
+    const kill = () => {
+      try {
+        process.kill(-child.pid, "SIGKILL");
+      } catch (_) {
+        // Already gone
+      }
+    };
+    signal?.addEventListener("abort", kill);
+
+    const started = Date.now();
+    let exceeded = null;
+    const exceed = (status, message) => {
+      if (exceeded) return;
+      exceeded = { status, message };
+      console.log(`LIMIT EXCEEDED: ${message}`);
+      kill();
+    };
+    const checkLimits = () => {
+      if (limits.cpuMs > 0 || limits.memoryMb > 0) {
+        const usage = groupUsage(child.pid);
+        if (usage && limits.cpuMs > 0 && usage.cpuMs > limits.cpuMs) {
+          exceed("TIME_LIMIT_EXCEEDED", `Tests used more than ${limits.cpuMs} ms of CPU time`);
+        }
+        if (usage && limits.memoryMb > 0 && usage.memoryMb > limits.memoryMb) {
+          exceed("MEMORY_LIMIT_EXCEEDED", `Tests used more than ${limits.memoryMb} MB of memory`);
+        }
+      }
+    };
+    const wallClock = limits.timeMs > 0
+      ? setTimeout(() => exceed("TIME_LIMIT_EXCEEDED", `Tests did not finish within ${limits.timeMs} ms`), limits.timeMs)
+      : null;
 
+    const poll = setInterval(checkLimits, LIMITS_POLL_MS);
+
+    const finish = (result) => {
+      clearInterval(poll);
+      clearTimeout(wallClock);
+      signal?.removeEventListener("abort", kill);
+      resolve(result);
+    };
+
+    // Progress lines of the run go to onProgress, everything else is the output
+    const progressPrefix = `__DEVSARENA_PROGRESS__:${nonce}:`;
     let out = "";
     let err = "";
-    child.stdout.on("data", (d) => (out += d.toString()));
+    let partial = "";
+    child.stdout.on("data", (d) => {
+      const lines = (partial + d.toString()).split("\n");
+      partial = lines.pop();
+      for (const line of lines) {
+        if (!line.startsWith(progressPrefix)) {
+          out += line + "\n";
+          continue;
+        }
+        try {
+          onProgress?.(JSON.parse(line.slice(progressPrefix.length)));
+        } catch (_) {
+          // Not a progress event
+        }
+      }
+    });
     child.stderr.on("data", (d) => (err += d.toString()));
 
-    child.on("close", () => resolve(out.trim() || err.trim()));
+    child.on("error", (e) => finish({ error: e.message }));
+    child.on("close", () => {
+      if (exceeded) {
+        return finish({ output: limitResult(nonce, checkpoint, exceeded, Date.now() - started) });
+      }
+      finish({ output: (out + partial).trim() || err.trim() });
+    });
   });
 }
 
@@ -36,16 +301,57 @@ http
       res.writeHead(404);
       return res.end();
     }
+    if (!authorized(req)) {
+      res.writeHead(401, { "content-type": "application/json" });
+      return res.end(JSON.stringify({ error: "unauthorized" }));
+    }
 
     console.log("RECEIVED REQUEST " + req.url + " METHOD " + req.method)
     const url = new URL(req.url, "http://localhost");
+    // suite=final runs the quest's final suite instead of a checkpoint
+    const suite = url.searchParams.get("suite") || "checkpoint";
     const checkpoint = Number(url.searchParams.get("checkpoint") || "-1");
     const language = url.searchParams.get("language") || undefined;
-    console.log("CHECKPOINT: " + checkpoint + ", LANGUAGE: " + language);
-    const payload = await run({ checkpoint, language });
-    console.log("PAYLOAD: " + payload);
+    // Tags the result line of the run, see run()
+    const nonce = url.searchParams.get("nonce") || "";
+    // timeMs, cpuMs and memoryMb override the default limits, 0 turns one off
+    const limits = { ...DEFAULT_LIMITS };
+    for (const name of Object.keys(limits)) {
+      const value = Number(url.searchParams.get(name));
+      if (url.searchParams.has(name) && Number.isFinite(value) && value >= 0) limits[name] = value;
+    }
+    // stream=1: JSON lines of {"progress": {...}} followed by {"output": "..."} or {"error": "..."}
+    const stream = url.searchParams.get("stream") === "1";
+    console.log("SUITE: " + suite + ", CHECKPOINT: " + checkpoint + ", LANGUAGE: " + language + ", STREAM: " + stream + ", LIMITS: " + JSON.stringify(limits));
+
+    const abort = new AbortController();
+    res.on("close", () => abort.abort());
+
+    if (stream) {
+      res.writeHead(200, { "content-type": "application/x-ndjson" });
+      const result = await run({
+        suite,
+        checkpoint,
+        language,
+        nonce,
+        limits,
+        signal: abort.signal,
+        onProgress: (event) => res.write(JSON.stringify({ progress: event }) + "\n")
+      });
+      if (result.error) console.log("RUNNER UNAVAILABLE: " + result.error);
+      else console.log("PAYLOAD: " + result.output);
+      return res.end(JSON.stringify(result) + "\n");
+    }
+
+    const result = await run({ suite, checkpoint, language, nonce, limits, signal: abort.signal });
+    if (result.error) {
+      console.log("RUNNER UNAVAILABLE: " + result.error);
+      res.writeHead(result.code === "bundle_invalid" ? 409 : 503, { "content-type": "application/json" });
+      return res.end(JSON.stringify(result));
+    }
+    console.log("PAYLOAD: " + result.output);
     res.writeHead(200, { "content-type": "application/json" });
-    res.end(payload);
+    res.end(result.output);
   })
   .listen(port, host, () => {
     // Intentionally minimal: pod-local service.
@@ -1,4 +1,56 @@
+const fs = require("fs");
+const path = require("path");
+
+// The run's nonce, read from stdin before any test runs (see test-runner-service.js). The
+// progress and result lines carry it, anything else the tests print is ignored.
+const RUN_NONCE = process.env.DEVSARENA_RUN_NONCE_STDIN ? readNonce() : "";
+
+function readNonce() {
+  try {
+    return fs.readFileSync(0, "utf8").trim();
+  } catch (_) {
+    return "";
+  }
+}
+
+// Progress goes to stdout as tagged JSON lines while the run is going, the test runner
+// service streams it to the relay. Only file names are reported, never test sources.
+function progress(event) {
+  console.log(`__DEVSARENA_PROGRESS__:${RUN_NONCE}:` + JSON.stringify(event));
+}
+
+function report(result) {
+  console.log(`__DEVSARENA_RESULT__:${RUN_NONCE}:` + JSON.stringify(result));
+}
+
 class DevsArenaReporter {
+  onRunStart(results) {
+    progress({ event: "run_started", suites: results.numTotalTestSuites });
+  }
+
+  onTestFileStart(test) {
+    progress({ event: "suite_started", file: path.basename(test.path) });
+  }
+
+  onTestCaseResult(test, result) {
+    const events = { passed: "test_passed", failed: "test_failed" };
+    progress({
+      event: events[result.status] || "test_skipped",
+      file: path.basename(test.path),
+      name: result.fullName,
+      durationMs: result.duration || 0,
+    });
+  }
+
+  onTestFileResult(test, result) {
+    progress({
+      event: "suite_finished",
+      file: path.basename(test.path),
+      passed: result.numPassingTests,
+      failed: result.numFailingTests,
+    });
+  }
+
   onRunComplete(_, results) {
     try {
       // 1. Failed assertions / runtime inside tests
@@ -12,25 +64,22 @@ class DevsArenaReporter {
             // Structured failure
             if (msg.includes(marker)) {
               const payload = JSON.parse(msg.split(marker)[1].split("\n")[0]);
-              console.log(
-                JSON.stringify({
-                  status: "FAILED_ASSERTION",
-                  error: payload,
-                })
-              );
+              if (!payload.file) Object.assign(payload, learnerLocation(msg));
+              report({
+                status: "FAILED_ASSERTION",
+                error: payload,
+              });
               return;
             }
 
             // Unstructured failure (bad test / runtime error)
-            console.log(
-              JSON.stringify({
-                status: "FAILED_RUNTIME",
-                error: {
-                  message: msg,
-                  hint: "Internal test error",
-                },
-              })
-            );
+            report({
+              status: "FAILED_RUNTIME",
+              error: {
+                message: msg,
+                hint: "Internal test error",
+              },
+            });
             return;
           }
         }
@@ -38,38 +87,41 @@ class DevsArenaReporter {
 
       // 2. Suite-level crash (syntax error, transform error, import error)
       if (results.numFailedTestSuites > 0) {
-        console.log(
-          JSON.stringify({
-            status: "FAILED_RUNTIME",
-            error: {
-              message: simplify(
-                results.testResults[0]?.failureMessage ||
-                  "Test suite failed to run"
-              ),
-              hint: "Your code or test has a syntax/runtime error",
-            },
-          })
-        );
+        report({
+          status: "FAILED_RUNTIME",
+          error: {
+            message: simplify(
+              results.testResults[0]?.failureMessage ||
+                "Test suite failed to run"
+            ),
+            hint: "Your code or test has a syntax/runtime error",
+          },
+        });
         return;
       }
 
       // 3. No failures
-      console.log(JSON.stringify({ status: "PASSED" }));
+      report({ status: "PASSED" });
     } catch (err) {
       // 4. Reporter itself failed (never let this be silent)
-      console.log(
-        JSON.stringify({
-          status: "FAILED_RUNTIME",
-          error: {
-            message: "Reporter crashed",
-            hint: err?.message || "Unknown error",
-          },
-        })
-      );
+      report({
+        status: "FAILED_RUNTIME",
+        error: {
+          message: "Reporter crashed",
+          hint: err?.message || "Unknown error",
+        },
+      });
     }
   }
 }
 
+// The first frame of the learner's code in a failure's stack, relative to /workspace
+function learnerLocation(msg) {
+  const frame = /\/workspace\/((?!node_modules\/)[^\s():]+):(\d+):(\d+)/.exec(stripAnsi(msg));
+  if (!frame) return {};
+  return { file: frame[1], line: Number(frame[2]), column: Number(frame[3]) };
+}
+
 function simplify(msg) {
   return stripAnsi(String(msg || ""))
     .split("\n")
@@ -1,10 +1,13 @@
 // Enable React 18+ act() environment for testing
 globalThis.IS_REACT_ACT_ENVIRONMENT = true;
 
-globalThis.failAssertion = function ({ scenario, expected, received, hint }) {
+// expected and received can be any JSON value. file, line and column point at the learner's
+// code the check is about, relative to /workspace; without them the reporter looks for the
+// learner's code in the stack.
+globalThis.failAssertion = function ({ scenario, expected, received, hint, file, line, column }) {
   throw new Error(
     "__DEVSARENA_ASSERTION__:" +
-      JSON.stringify({ scenario, expected, received, hint })
+      JSON.stringify({ scenario, expected, received, hint, file, line, column })
   );
 };
 
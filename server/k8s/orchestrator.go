@@ -3,9 +3,17 @@ package k8s
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"lms_v0/internal/database"
 	"lms_v0/utils"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
@@ -41,6 +49,137 @@ type SpinUpQuestParams struct {
 	TestFilesKey          string
 	Namespace             string
 	ShouldCreateNamespace bool
+	RecordSessions        bool   // Record terminal sessions, from the quest's privacy flag
+	APIBaseURL            string // In-cluster API address the PTY relay uploads recordings through
+
+	// Final submission: the checkpoint suites plus the quest's final suite
+	CheckpointCount int
+	FinalTestURL    string // Quest.FinalTestCode, a URL or a key in S3Bucket
+	FinalTestCases  string // Quest.FinalTestCases as base64 encoded JSON
+
+	// Checkpoints judged on stdin and stdout, with their Testcases by checkpoint number
+	JudgeTestCases string // Base64 encoded JSON, empty without any
+
+	// Time and memory limits of checkpoint test runs by checkpoint number
+	CheckpointLimits string // Base64 encoded JSON, empty without any
+
+	// Comma separated numbers of the checkpoints whose tests are hidden
+	HiddenCheckpoints string
+
+	// Shared by the PTY relay and the grader sidecar, generated for every lab
+	GraderToken string
+
+	// The PTY relay's bearer token for the API, generated for every lab, see utils.CheckLabSecret
+	APISecret string
+
+	// Signed manifest of the quest's test bundles, see bundle.go
+	TestBundlePublicKey string // Base64 encoded DER of the Ed25519 key the manifest is signed with
+	TestBundleManifest  string // Base64 encoded JSON
+	TestBundleSignature string // Hex encoded Ed25519 signature of the manifest
+	TestBundleFiles     string // Base64 encoded "<path> <source>" lines for the init container
+	testBundleSources   []testBundleSource
+}
+
+// SetFinalTests fills in what a final submission of the quest runs
+func (p *SpinUpQuestParams) SetFinalTests(quest *database.Quest) {
+	p.CheckpointCount = len(quest.Checkpoints)
+	p.FinalTestURL = strings.TrimSpace(quest.FinalTestCode)
+
+	cases, err := json.Marshal(quest.FinalTestCases)
+	if err != nil {
+		log.Printf("Failed to encode final test cases of quest %s: %v", quest.Slug, err)
+		return
+	}
+	p.FinalTestCases = base64.StdEncoding.EncodeToString(cases)
+}
+
+// What the PTY relay's judge needs of a Testcase
+type judgeTestCase struct {
+	Input   string `json:"input"`
+	Output  string `json:"output"`
+	Message string `json:"message,omitempty"`
+	Hidden  bool   `json:"hidden,omitempty"`
+}
+
+// SetJudgeTests fills in the Testcases of the quest's checkpoints, in the order they were
+// created, for the PTY relay to judge the learner's program against
+func (p *SpinUpQuestParams) SetJudgeTests(quest *database.Quest) {
+	cases := map[int][]judgeTestCase{}
+	for i, checkpoint := range quest.Checkpoints {
+		testcases := append([]database.Testcase(nil), checkpoint.Testcases...)
+		sort.SliceStable(testcases, func(a, b int) bool {
+			return testcases[a].CreatedAt.Before(testcases[b].CreatedAt)
+		})
+		for _, testcase := range testcases {
+			cases[i+1] = append(cases[i+1], judgeTestCase{
+				Input:   testcase.Input,
+				Output:  testcase.Output,
+				Message: testcase.Message,
+				Hidden:  testcase.Hidden,
+			})
+		}
+	}
+	if len(cases) == 0 {
+		return
+	}
+
+	encoded, err := json.Marshal(cases)
+	if err != nil {
+		log.Printf("Failed to encode judge test cases of quest %s: %v", quest.Slug, err)
+		return
+	}
+	p.JudgeTestCases = base64.StdEncoding.EncodeToString(encoded)
+}
+
+// Limits of a checkpoint's test runs, as the PTY relay reads them
+type checkpointLimits struct {
+	TimeMs   int `json:"timeMs,omitempty"`
+	CPUMs    int `json:"cpuMs,omitempty"`
+	MemoryMB int `json:"memoryMb,omitempty"`
+}
+
+// SetTestLimits fills in the test run limits of the quest's checkpoints that have any
+func (p *SpinUpQuestParams) SetTestLimits(quest *database.Quest) {
+	limits := map[int]checkpointLimits{}
+	for i, checkpoint := range quest.Checkpoints {
+		if checkpoint.TimeLimitMs > 0 || checkpoint.CPULimitMs > 0 || checkpoint.MemoryLimitMB > 0 {
+			limits[i+1] = checkpointLimits{
+				TimeMs:   max(checkpoint.TimeLimitMs, 0),
+				CPUMs:    max(checkpoint.CPULimitMs, 0),
+				MemoryMB: max(checkpoint.MemoryLimitMB, 0),
+			}
+		}
+	}
+	if len(limits) == 0 {
+		return
+	}
+
+	encoded, err := json.Marshal(limits)
+	if err != nil {
+		log.Printf("Failed to encode checkpoint limits of quest %s: %v", quest.Slug, err)
+		return
+	}
+	p.CheckpointLimits = base64.StdEncoding.EncodeToString(encoded)
+}
+
+// SetHiddenTests lists the quest's checkpoints with hidden tests
+func (p *SpinUpQuestParams) SetHiddenTests(quest *database.Quest) {
+	hidden := []string{}
+	for i, checkpoint := range quest.Checkpoints {
+		if checkpoint.HiddenTests {
+			hidden = append(hidden, strconv.Itoa(i+1))
+		}
+	}
+	p.HiddenCheckpoints = strings.Join(hidden, ",")
+}
+
+// A random secret of a lab, hex encoded
+func newLabSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
 }
 
 type SpinUpWithInit struct {
@@ -261,9 +400,31 @@ func SpinUpQuestPod(params SpinUpQuestParams) error {
 		log.Printf("No init command required for language '%s'", params.Language)
 	}
 
-	// Update quest params to use new test file structure
-	// Test files are now located at: devsarena/projects/{projectSlug}/tests/
-	params.TestFilesKey = fmt.Sprintf("devsarena/projects/%s/tests/", params.ProjectSlug)
+	if params.GraderToken == "" {
+		token, err := newLabSecret()
+		if err != nil {
+			return fmt.Errorf("could not generate grader token: %w", err)
+		}
+		params.GraderToken = token
+	}
+
+	if params.APISecret == "" {
+		secret, err := newLabSecret()
+		if err != nil {
+			return fmt.Errorf("could not generate lab API secret: %w", err)
+		}
+		params.APISecret = secret
+	}
+	if err := utils.RedisUtilsInstance.SetLabSecret(params.LabID, params.APISecret); err != nil {
+		return fmt.Errorf("could not store lab API secret: %w", err)
+	}
+
+	// Checkpoints without a TestingCode fall back to the project's tests at projects/{projectSlug}/tests/
+	params.TestFilesKey = projectTestFilesKey(params.ProjectSlug)
+
+	if err := params.signTestBundles(); err != nil {
+		return fmt.Errorf("could not sign test bundles: %w", err)
+	}
 
 	// Convert quest params to deployment params
 	deploymentParams := SpinUpWithInit{
@@ -295,6 +456,11 @@ func SpinUpQuestPod(params SpinUpQuestParams) error {
 		}
 	}
 
+	// The lab's secrets, which the quest deployment reads its tokens from
+	if err := CreateLabSecret(params); err != nil {
+		return fmt.Errorf("could not create lab secret: %w", err)
+	}
+
 	// Create quest deployment using quest template
 	if err := CreateQuestDeploymentFromYamlIfDoesNotExists(params, requiresInitCmdPtr); err != nil {
 		return fmt.Errorf("could not create quest deployment: %w", err)
@@ -423,6 +589,39 @@ func CreateDeploymentFromYamlIfDoesNotExists(params SpinUpWithInit) error {
 }
 
 // CreateQuestDeploymentFromYamlIfDoesNotExists creates a quest-specific deployment with test runner support
+func labSecretName(labID string) string {
+	return fmt.Sprintf("%s-secrets", labID)
+}
+
+// CreateLabSecret stores the tokens of a quest lab in a Secret its containers read them from,
+// so they stay out of the deployment. A restarted lab gets the tokens it was just issued.
+func CreateLabSecret(params SpinUpQuestParams) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      labSecretName(params.LabID),
+			Namespace: params.Namespace,
+			Labels:    map[string]string{"app": fmt.Sprintf("%s-%s", params.Language, params.LabID)},
+		},
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			"grader-token": params.GraderToken,
+			"api-secret":   params.APISecret,
+		},
+	}
+
+	_, err := ClientSet.CoreV1().Secrets(params.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = ClientSet.CoreV1().Secrets(params.Namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		log.Printf("Error creating lab secret '%s': %v", secret.Name, err)
+		return err
+	}
+
+	log.Printf("Lab secret '%s' created successfully", secret.Name)
+	return nil
+}
+
 func CreateQuestDeploymentFromYamlIfDoesNotExists(params SpinUpQuestParams, requiresInitCommand *string) error {
 	yamlFilePath := "k8s/templates/deployment.quest.template.yaml"
 	deploymentName := fmt.Sprintf("%s-deployment", params.LabID)
@@ -461,8 +660,6 @@ func CreateQuestDeploymentFromYamlIfDoesNotExists(params SpinUpQuestParams, requ
 		return fmt.Errorf("error executing quest template: %w", err)
 	}
 
-	log.Printf("DEBUG: Processed quest deployment YAML for LabID '%s':\n%s", params.LabID, processedYaml.String())
-
 	var deployment appsv1.Deployment
 	if err := yaml.Unmarshal(processedYaml.Bytes(), &deployment); err != nil {
 		log.Printf("Error unmarshalling quest deployment YAML for LabID '%s': %v", params.LabID, err)
@@ -791,6 +988,14 @@ func TearDownPodWithLanguage(params SpinDownParams) error {
 		}
 	}
 
+	// Delete the lab's secrets, quest labs only have them
+	if err := ClientSet.CoreV1().Secrets(params.Namespace).Delete(context.TODO(), labSecretName(params.LabID), metav1.DeleteOptions{}); err != nil {
+		if !errors.IsNotFound(err) {
+			log.Printf("Failed to delete lab secret %s: %v", labSecretName(params.LabID), err)
+			return err
+		}
+	}
+
 	// Optionally delete namespace if desired - skipping to keep shared namespace
 	log.Printf("Teardown completed for LabID: %s", params.LabID)
 	return nil
@@ -133,6 +133,12 @@ func (s *service) GetQuestsByLanguage(string) ([]database.QuestMeta, error) {
 	return nil, fmt.Errorf("not implemented")
 }
 func (s *service) DeleteQuest(string) error { return fmt.Errorf("not implemented") }
+func (s *service) CreateSubmission(*database.Submission) (bool, error) {
+	return false, fmt.Errorf("not implemented")
+}
+func (s *service) GetSubmissions(database.SubmissionFilter) ([]database.Submission, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 
 func (s *service) AddQuest(req database.AddQuestRequest) (string, error) {
 	log.Printf("AddQuest started: Title=%s, Category=%s, Difficulty=%s", req.Title, req.Category, req.Difficulty)
@@ -276,6 +282,10 @@ func (s *service) AddQuest(req database.AddQuestRequest) (string, error) {
 			OrderIndex:      &order,
 			Requirements:    pq.StringArray(cp.Requirements),
 			TestingCode:     cp.TestFileUrl,
+			TimeLimitMs:     cp.TimeLimitMs,
+			CPULimitMs:      cp.CPULimitMs,
+			MemoryLimitMB:   cp.MemoryLimitMB,
+			HiddenTests:     cp.HiddenTests,
 			BoilerPlateCode: "", // Empty for now
 			QuestID:         questID,
 			CreatedAt:       time.Now(),
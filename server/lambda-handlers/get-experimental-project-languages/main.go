@@ -60,6 +60,12 @@ func (s *service) AddQuest(database.AddQuestRequest) (string, error) {
 	return "", fmt.Errorf("not implemented")
 }
 func (s *service) DeleteQuest(string) error { return fmt.Errorf("not implemented") }
+func (s *service) CreateSubmission(*database.Submission) (bool, error) {
+	return false, fmt.Errorf("not implemented")
+}
+func (s *service) GetSubmissions(database.SubmissionFilter) ([]database.Submission, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 
 func respond(status int, body interface{}) (events.APIGatewayProxyResponse, error) {
 	var data []byte
@@ -46,6 +46,12 @@ func (s *service) AddQuest(req database.AddQuestRequest) (string, error) {
 }
 
 func (s *service) DeleteQuest(string) error { return fmt.Errorf("not implemented") }
+func (s *service) CreateSubmission(*database.Submission) (bool, error) {
+	return false, fmt.Errorf("not implemented")
+}
+func (s *service) GetSubmissions(database.SubmissionFilter) ([]database.Submission, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 func (s *service) GetQuestsByLanguage(string) ([]database.QuestMeta, error) {
 	return nil, fmt.Errorf("not implemented")
 }
@@ -132,6 +138,7 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		}
 		return events.APIGatewayProxyResponse{StatusCode: 500, Headers: map[string]string{"Content-Type": "application/json", "Access-Control-Allow-Origin": "*", "Access-Control-Allow-Methods": "GET, POST, PUT, DELETE, OPTIONS", "Access-Control-Allow-Headers": "Content-Type, Authorization"}, Body: `{"error":"Internal server error"}`}, nil
 	}
+	quest.RedactHiddenTests()
 	bodyBytes, err := json.Marshal(quest)
 	if err != nil {
 		log.Printf("marshal quest: %v", err)
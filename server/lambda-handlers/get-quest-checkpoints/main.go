@@ -12,6 +12,9 @@ import (
 	"gorm.io/gorm"
 
 	"lms_v0/internal/database"
+	"lms_v0/internal/redis"
+	"lms_v0/internal/testresults"
+	"lms_v0/utils"
 )
 
 var svc database.Service
@@ -64,6 +67,12 @@ func (s *service) AddQuest(database.AddQuestRequest) (string, error) {
 	return "", fmt.Errorf("not implemented")
 }
 func (s *service) DeleteQuest(string) error { return fmt.Errorf("not implemented") }
+func (s *service) CreateSubmission(*database.Submission) (bool, error) {
+	return false, fmt.Errorf("not implemented")
+}
+func (s *service) GetSubmissions(filter database.SubmissionFilter) ([]database.Submission, error) {
+	return database.QuerySubmissions(s.db, filter)
+}
 
 func respond(status int, body interface{}) (events.APIGatewayProxyResponse, error) {
 	var data []byte
@@ -106,15 +115,37 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		return respond(404, map[string]string{"error": "Quest not found"})
 	}
 
+	// With ?labId= the statuses come from the lab's test history
+	var progress []testresults.CheckpointProgress
+	if labID := strings.TrimSpace(req.QueryStringParameters["labId"]); labID != "" {
+		redis.InitRedis()
+		utils.InitRedisUtils(redis.RedisClient, redis.Context)
+
+		summary, _, err := testresults.Load(labID, 0, svc.GetSubmissions)
+		if err != nil {
+			log.Printf("get-quest-checkpoints: error loading lab %s: %v", labID, err)
+			return respond(500, map[string]string{"error": "Failed to load lab progress"})
+		}
+		progress = testresults.QuestProgress(len(quest.Checkpoints), summary)
+	}
+
 	checkpoints := make([]map[string]interface{}, len(quest.Checkpoints))
 	for i, cp := range quest.Checkpoints {
 		checkpoints[i] = map[string]interface{}{
-			"id":           fmt.Sprintf("%d", i+1),
+			"id":           cp.ID.String(),
+			"number":       i + 1,
 			"title":        cp.Title,
 			"description":  cp.Description,
 			"requirements": cp.Requirements,
 			"status":       "pending",
 		}
+		if progress != nil {
+			checkpoints[i]["status"] = progress[i].Status
+			checkpoints[i]["attempts"] = progress[i].Attempts
+			checkpoints[i]["latestStatus"] = progress[i].LatestStatus
+			checkpoints[i]["firstPassedAt"] = progress[i].FirstPassedAt
+			checkpoints[i]["lastAttemptAt"] = progress[i].LastAttemptAt
+		}
 	}
 
 	resp := map[string]interface{}{
@@ -4,12 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"gorm.io/gorm"
+
+	"lms_v0/internal/database"
+	"lms_v0/internal/redis"
+	"lms_v0/internal/testresults"
+	"lms_v0/utils"
 )
 
+var db *gorm.DB
+
+func init() {
+	db = database.Connect("get_test_results")
+	redis.InitRedis()
+	utils.InitRedisUtils(redis.RedisClient, redis.Context)
+}
+
+func submissions(filter database.SubmissionFilter) ([]database.Submission, error) {
+	return database.QuerySubmissions(db, filter)
+}
+
 func respond(status int, body interface{}) (events.APIGatewayProxyResponse, error) {
 	var data []byte
 	switch v := body.(type) {
@@ -44,12 +63,28 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		return respond(400, map[string]string{"error": "Missing labId parameter"})
 	}
 
-	log.Printf("get-test-results: returning placeholder results for labId=%s", labID)
+	checkpoint := 0
+	if value := req.QueryStringParameters["checkpoint"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return respond(400, map[string]string{"error": "Invalid checkpoint parameter"})
+		}
+		checkpoint = parsed
+	}
+
+	summary, found, err := testresults.Load(labID, checkpoint, submissions)
+	if err != nil {
+		log.Printf("get-test-results: failed to load results for labId=%s: %v", labID, err)
+		return respond(500, map[string]string{"error": "Failed to load test results"})
+	}
+	if !found {
+		return respond(404, map[string]string{"error": "Lab not found"})
+	}
 
 	resp := map[string]interface{}{
 		"success": true,
 		"labId":   labID,
-		"results": map[string]interface{}{},
+		"results": summary,
 	}
 
 	return respond(200, resp)
@@ -11,6 +11,7 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"lms_v0/internal/database"
@@ -23,6 +24,7 @@ type StartQuestRequest struct {
 	Language    string `json:"language"`
 	ProjectSlug string `json:"projectSlug"`
 	LabID       string `json:"labId"`
+	UserID      string `json:"userId,omitempty"` // Owner of the lab's submissions
 }
 
 type StartQuestResponse struct {
@@ -96,6 +98,12 @@ func (s *service) AddQuest(database.AddQuestRequest) (string, error) {
 	return "", fmt.Errorf("not implemented")
 }
 func (s *service) DeleteQuest(string) error { return fmt.Errorf("not implemented") }
+func (s *service) CreateSubmission(*database.Submission) (bool, error) {
+	return false, fmt.Errorf("not implemented")
+}
+func (s *service) GetSubmissions(database.SubmissionFilter) ([]database.Submission, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 
 func jsonHeaders() map[string]string {
 	return map[string]string{
@@ -135,6 +143,11 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		b, _ := json.Marshal(res)
 		return events.APIGatewayProxyResponse{StatusCode: 400, Headers: jsonHeaders(), Body: string(b)}, nil
 	}
+	if _, err := uuid.Parse(payload.UserID); payload.UserID != "" && err != nil {
+		res := StartQuestResponse{Success: false, Error: "Invalid userId parameter"}
+		b, _ := json.Marshal(res)
+		return events.APIGatewayProxyResponse{StatusCode: 400, Headers: jsonHeaders(), Body: string(b)}, nil
+	}
 	if payload.LabID == "" {
 		payload.LabID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
@@ -182,7 +195,14 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		TestFilesKey:          "",
 		Namespace:             os.Getenv("K8S_NAMESPACE"),
 		ShouldCreateNamespace: false,
+		RecordSessions:        quest.RecordTerminalSessions,
+		APIBaseURL:            os.Getenv("API_INTERNAL_URL"),
 	}
+	questParams.SetFinalTests(quest)
+	questParams.SetJudgeTests(quest)
+	questParams.SetTestLimits(quest)
+	questParams.SetHiddenTests(quest)
+	questParams.SetTestBundles(quest)
 
 	// Create lab instance in Redis
 	labInstance := utils.LabInstanceEntry{
@@ -193,6 +213,8 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		LastUpdatedAt:  time.Now().Unix(),
 		ProgressLogs:   []utils.LabProgressEntry{},
 		DirtyReadPaths: []string{},
+		UserID:         payload.UserID,
+		QuestSlug:      payload.ProjectSlug,
 	}
 	utils.RedisUtilsInstance.CreateLabInstance(labInstance)
 
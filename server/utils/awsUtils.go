@@ -17,64 +17,116 @@ import (
 )
 
 func GeneratePresignedUrl(bucketName, objectKey string) (string, error) {
-	// Check if R2 credentials are available
-	r2AccessKey := os.Getenv("R2_ACCESS_KEY")
-	r2SecretKey := os.Getenv("R2_SECRET_KEY")
-	r2AccountId := os.Getenv("R2_ACCOUNT_ID")
-
-	if r2AccessKey != "" && r2SecretKey != "" && r2AccountId != "" {
-		// Use R2 for presigned URLs
-		r2Endpoint := "https://" + r2AccountId + ".r2.cloudflarestorage.com"
-
-		cfg, err := config.LoadDefaultConfig(context.TODO(),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				r2AccessKey,
-				r2SecretKey,
-				"", // Session token is empty
-			)),
-			config.WithRegion("auto"), // R2 uses 'auto' region
-		)
-		if err != nil {
-			log.Printf("Failed to load R2 config for presigned URL: %v", err)
-			return "", err
-		}
+	presignClient, err := getPresignClient()
+	if err != nil {
+		return "", err
+	}
 
-		s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.BaseEndpoint = &r2Endpoint
-			o.UsePathStyle = true // R2 requires path-style addressing
-		})
-		presignClient := s3.NewPresignClient(s3Client)
+	request, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &bucketName,
+		Key:    &objectKey,
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = 3 * time.Hour
+	})
 
-		request, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: &bucketName,
-			Key:    &objectKey,
-		}, func(opts *s3.PresignOptions) {
-			opts.Expires = 3 * time.Hour
-		})
+	if err != nil {
+		log.Printf("Couldn't get a presigned request to get object %v:%v. Here's why: %v\n", bucketName, objectKey, err)
+		return "", err
+	}
 
-		if err != nil {
-			log.Printf("Couldn't get a presigned request to get R2 object %v:%v. Here's why: %v\n", bucketName, objectKey, err)
-			return "", err
-		}
+	return request.URL, nil
+}
 
-		return request.URL, nil
+// GeneratePresignedUploadUrl returns a short-lived URL to PUT an object with the given content type.
+// Both the content type and the size are signed, the upload must send exactly those.
+func GeneratePresignedUploadUrl(bucketName, objectKey, contentType string, size int64) (string, error) {
+	presignClient, err := getPresignClient()
+	if err != nil {
+		return "", err
 	}
 
-	// Fall back to AWS S3
-	request, err := aws.S3PresignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: &bucketName,
-		Key:    &objectKey,
+	request, err := presignClient.PresignPutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:        &bucketName,
+		Key:           &objectKey,
+		ContentType:   &contentType,
+		ContentLength: &size,
 	}, func(opts *s3.PresignOptions) {
-		opts.Expires = 3 * time.Hour
+		opts.Expires = 15 * time.Minute
 	})
 
 	if err != nil {
-		log.Printf("Couldn't get a presigned request to get S3 object %v:%v. Here's why: %v\n", bucketName, objectKey, err)
+		log.Printf("Couldn't get a presigned request to put object %v:%v. Here's why: %v\n", bucketName, objectKey, err)
 		return "", err
 	}
 
 	return request.URL, nil
 }
+
+// Presign against R2 when its credentials are available, AWS S3 otherwise
+func getPresignClient() (*s3.PresignClient, error) {
+	r2AccessKey := os.Getenv("R2_ACCESS_KEY")
+	r2SecretKey := os.Getenv("R2_SECRET_KEY")
+	r2AccountId := os.Getenv("R2_ACCOUNT_ID")
+
+	if r2AccessKey == "" || r2SecretKey == "" || r2AccountId == "" {
+		return aws.S3PresignClient, nil
+	}
+
+	r2Endpoint := "https://" + r2AccountId + ".r2.cloudflarestorage.com"
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			r2AccessKey,
+			r2SecretKey,
+			"", // Session token is empty
+		)),
+		config.WithRegion("auto"), // R2 uses 'auto' region
+	)
+	if err != nil {
+		log.Printf("Failed to load R2 config for presigned URL: %v", err)
+		return nil, err
+	}
+
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = &r2Endpoint
+		o.UsePathStyle = true // R2 requires path-style addressing
+	})
+	return s3.NewPresignClient(s3Client), nil
+}
+
+// StoredObject describes an object returned by ListS3Objects
+type StoredObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// ListS3Objects lists every object under a prefix
+func ListS3Objects(bucket, prefix string) ([]StoredObject, error) {
+	ctx := context.TODO()
+	objects := []StoredObject{}
+
+	paginator := s3.NewListObjectsV2Paginator(aws.S3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects under %s: %w", prefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			objects = append(objects, StoredObject{
+				Key:          awsMethods.ToString(obj.Key),
+				Size:         awsMethods.ToInt64(obj.Size),
+				LastModified: awsMethods.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
 func CopyS3Folder(sourceKey, destinationKey string) error {
 	ctx := context.TODO()
 	bucket := os.Getenv("AWS_S3_BUCKET_NAME")
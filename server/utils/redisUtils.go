@@ -2,6 +2,9 @@ package utils
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 
@@ -50,6 +53,65 @@ type LabInstanceEntry struct {
 	Status         LabStatus
 	LastUpdatedAt  int64
 	ProgressLogs   []LabProgressEntry
+	// Owner and quest of a quest lab, for the submissions of its test runs
+	UserID    string
+	QuestSlug string
+
+	// Written by the lab's PTY relay
+	ActiveCheckpoint int
+	TestResults      []LabTestResult
+	FinalReport      json.RawMessage `json:",omitempty"`
+	Completed        bool
+	CompletedAt      int64
+}
+
+// LabTestResult is a checkpoint test run recorded by the PTY relay
+type LabTestResult struct {
+	Checkpoint  int
+	Status      string // PASSED, FAILED_ASSERTION, FAILED_RUNTIME, TIME_LIMIT_EXCEEDED or MEMORY_LIMIT_EXCEEDED
+	DurationMs  int64
+	Error       *LabTestError `json:",omitempty"`
+	RunID       string
+	CompletedAt int64 // Unix seconds, unset for runs of older relays
+	// Runs with hidden tests have counts instead of failure details
+	Hidden bool           `json:",omitempty"`
+	Tests  *LabTestCounts `json:",omitempty"`
+}
+
+type LabTestCounts struct {
+	Passed int
+	Total  int
+}
+
+type LabTestError struct {
+	Scenario  string
+	Expected  string
+	Received  string
+	Hint      string
+	Message   string
+	Assertion *LabAssertion `json:",omitempty"` // Set for failed assertions
+}
+
+// LabAssertion is a failed assertion as normalized by the PTY relay
+type LabAssertion struct {
+	Kind     string // string, object or value
+	Expected string
+	Actual   string
+	Diff     []LabDiffLine      `json:",omitempty"`
+	Location *LabSourceLocation `json:",omitempty"`
+	Hint     string
+}
+
+type LabDiffLine struct {
+	Op   string // equal, delete (only in expected) or insert (only in actual)
+	Text string
+}
+
+// LabSourceLocation is a place in the learner's code, relative to the workspace
+type LabSourceLocation struct {
+	File   string
+	Line   int
+	Column int
 }
 
 // RedisUtils struct to hold Redis client and context
@@ -253,6 +315,39 @@ func (r *RedisUtils) GetNumberOfActiveLabInstances() (uint64, error) {
 	return count, nil
 }
 
+// A lab's API secret authenticates the requests its PTY relay makes to the API. Only its hash
+// is kept, in its own hash map: the relay and the runner rewrite lab_instances with their own
+// view of an entry and would drop it.
+func hashLabSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetLabSecret stores the API secret of a lab
+func (r *RedisUtils) SetLabSecret(labID, secret string) error {
+	if r.Client == nil {
+		log.Fatalf("Redis client is not initialized")
+	}
+
+	return r.Client.HSet(r.Ctx, "lab_secrets", labID, hashLabSecret(secret)).Err()
+}
+
+// CheckLabSecret reports whether secret is the API secret of the lab
+func (r *RedisUtils) CheckLabSecret(labID, secret string) bool {
+	if r.Client == nil {
+		log.Fatalf("Redis client is not initialized")
+	}
+	if secret == "" {
+		return false
+	}
+
+	stored, err := r.Client.HGet(r.Ctx, "lab_secrets", labID).Result()
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hashLabSecret(secret))) == 1
+}
+
 // RemoveLabInstance removes a lab instance from current instances
 func (r *RedisUtils) RemoveLabInstance(labID string) {
 	if r.Client == nil {
@@ -266,6 +361,11 @@ func (r *RedisUtils) RemoveLabInstance(labID string) {
 		log.Printf("Lab instance %s removed", labID)
 	}
 
+	err = r.Client.HDel(r.Ctx, "lab_secrets", labID).Err()
+	if err != nil {
+		log.Printf("Failed to remove secret of lab %s: %v", labID, err)
+	}
+
 	err = r.Client.LRem(r.Ctx, "labs_monitor", 0, labID).Err()
 	if err != nil {
 		log.Printf("Failed to remove lab %s from monitoring queue: %v", labID, err)